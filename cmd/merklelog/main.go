@@ -0,0 +1,135 @@
+// Command merklelog runs a transparency log on a loopback port for testing.
+//
+//	merklelog -dir ./log -addr 127.0.0.1:8080
+//
+// The log's signing key is read from -key, and created there when missing.
+// Its public key is printed on start so clients can verify tree heads.
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/zvikinoza/merkle-tree/merklehttp"
+	"github.com/zvikinoza/merkle-tree/merklelog"
+)
+
+func main() {
+	dir := flag.String("dir", "merklelog-data", "directory holding the log")
+	addr := flag.String("addr", "127.0.0.1:8080", "loopback address to listen on")
+	keyPath := flag.String("key", "", "file holding the hex ed25519 seed, <dir>/log.key when empty")
+	interval := flag.Duration("interval", time.Second, "how often sequenced entries are integrated")
+	flag.Parse()
+
+	if err := run(*dir, *addr, *keyPath, *interval); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run(dir, addr, keyPath string, interval time.Duration) error {
+	if err := checkLoopback(addr); err != nil {
+		return err
+	}
+	if keyPath == "" {
+		keyPath = filepath.Join(dir, "log.key")
+	}
+	key, err := loadKey(keyPath)
+	if err != nil {
+		return err
+	}
+	l, err := merklelog.Open(dir, merklelog.Config{Key: key})
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{Handler: merklehttp.NewLogHandler(l), ReadHeaderTimeout: 10 * time.Second}
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- srv.Serve(ln) }()
+	runCtx, cancel := context.WithCancel(ctx)
+	runErr := make(chan error, 1)
+	go func() { runErr <- l.Run(runCtx, interval) }()
+	fmt.Printf("serving %d entries on http://%s, public key %x\n", l.Size(), ln.Addr(), []byte(l.PublicKey()))
+
+	select {
+	case <-ctx.Done():
+	case err = <-serveErr:
+	case err = <-runErr:
+		runErr <- nil // already reported
+	}
+	cancel()
+	shutdown, cancelShutdown := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelShutdown()
+	if serr := srv.Shutdown(shutdown); err == nil || errors.Is(err, http.ErrServerClosed) {
+		err = serr
+	}
+	if rerr := <-runErr; err == nil {
+		err = rerr
+	}
+	// integrate what was sequenced since the last tick before the log is closed
+	if _, ierr := l.Integrate(); err == nil {
+		err = ierr
+	}
+	return err
+}
+
+// checkLoopback rejects addresses reachable from other machines.
+func checkLoopback(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("merklelog: %q is not a loopback address", addr)
+	}
+	return nil
+}
+
+// loadKey reads the signing key seed at 'path', creating a new one when the file does not exist.
+func loadKey(path string) (ed25519.PrivateKey, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		seed := make([]byte, ed25519.SeedSize)
+		if _, err := rand.Read(seed); err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, []byte(hex.EncodeToString(seed)+"\n"), 0o600); err != nil {
+			return nil, err
+		}
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	seed, err := hex.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("merklelog: %s does not hold a hex ed25519 seed", path)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
@@ -0,0 +1,3 @@
+module github.com/zvikinoza/merkle-tree
+
+go 1.23
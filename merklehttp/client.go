@@ -0,0 +1,74 @@
+package merklehttp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/zvikinoza/merkle-tree/merkletree"
+)
+
+// LogClient reads a log served by a LogHandler. It implements merklelog.Client.
+type LogClient struct {
+	// BaseURL is the URL the LogHandler is served at, e.g. "http://127.0.0.1:8080".
+	BaseURL string
+	// HTTPClient defaults to http.DefaultClient.
+	HTTPClient *http.Client
+}
+
+// SignedTreeHead fetches the log's latest signed tree head.
+func (c *LogClient) SignedTreeHead(ctx context.Context) (*merkletree.SignedTreeHead, error) {
+	sth := new(merkletree.SignedTreeHead)
+	if err := c.get(ctx, "/sth", sth); err != nil {
+		return nil, err
+	}
+	return sth, nil
+}
+
+// InclusionProof fetches the proof of the entry at 'index' in the tree of 'size' entries.
+func (c *LogClient) InclusionProof(ctx context.Context, index, size uint64) (*merkletree.InclusionProof, error) {
+	p := new(merkletree.InclusionProof)
+	if err := c.get(ctx, fmt.Sprintf("/proof/inclusion?index=%d&size=%d", index, size), p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// ConsistencyProof fetches the proof between the trees of 'oldSize' and 'newSize' entries.
+func (c *LogClient) ConsistencyProof(ctx context.Context, oldSize, newSize uint64) (*merkletree.ConsistencyProof, error) {
+	p := new(merkletree.ConsistencyProof)
+	if err := c.get(ctx, fmt.Sprintf("/proof/consistency?old=%d&new=%d", oldSize, newSize), p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (c *LogClient) get(ctx context.Context, path string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(c.BaseURL, "/")+path, nil)
+	if err != nil {
+		return err
+	}
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<16))
+		if json.Unmarshal(body, &apiErr) != nil || apiErr.Error == "" {
+			apiErr.Error = strings.TrimSpace(string(body))
+		}
+		return fmt.Errorf("merklehttp: GET %s: %s: %s", path, resp.Status, apiErr.Error)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,196 @@
+// Package merklehttp serves merkle trees over HTTP.
+//
+// Every tree registered with a Handler is exposed under /trees/{name}:
+//
+//	GET /trees                              names of the registered trees
+//	GET /trees/{name}/root                  merkletree.Root
+//	GET /trees/{name}/metadata              merkletree.Metadata
+//	GET /trees/{name}/proof/{index}         merkletree.Proof of a leaf
+//	GET /trees/{name}/range-proof?start=&end=
+//	                                        merkletree.RangeProof of the leaves in [start, end)
+//	GET /trees/{name}/segments/{index}      raw bytes of a leaf
+//
+// Responses other than segments are JSON. Errors are JSON objects with an
+// "error" field and status 400 for malformed requests, 404 for unknown trees
+// or leaves and for segments of trees built from leaf hashes, which hold no
+// data, and 500 for failures reading a tree.
+package merklehttp
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+
+	"github.com/zvikinoza/merkle-tree/merkletree"
+)
+
+var errUnknownTree = errors.New("merklehttp: unknown tree")
+
+// Handler is an http.Handler serving registered merkle trees.
+type Handler struct {
+	mu    sync.RWMutex
+	trees map[string]*merkletree.MerkleTree
+	mux   *http.ServeMux
+}
+
+// NewHandler returns a handler serving no trees.
+func NewHandler() *Handler {
+	h := &Handler{trees: map[string]*merkletree.MerkleTree{}, mux: http.NewServeMux()}
+	h.mux.HandleFunc("GET /trees", h.list)
+	h.mux.HandleFunc("GET /trees/{name}/root", h.withTree(h.root))
+	h.mux.HandleFunc("GET /trees/{name}/metadata", h.withTree(h.metadata))
+	h.mux.HandleFunc("GET /trees/{name}/proof/{index}", h.withTree(h.proof))
+	h.mux.HandleFunc("GET /trees/{name}/range-proof", h.withTree(h.rangeProof))
+	h.mux.HandleFunc("GET /trees/{name}/segments/{index}", h.withTree(h.segment))
+	return h
+}
+
+// Register serves 'mt' under 'name', replacing any tree registered under that name.
+func (h *Handler) Register(name string, mt *merkletree.MerkleTree) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.trees[name] = mt
+}
+
+// Unregister stops serving the tree registered under 'name'.
+func (h *Handler) Unregister(name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.trees, name)
+}
+
+// ServeHTTP implements http.Handler.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *Handler) list(w http.ResponseWriter, r *http.Request) {
+	h.mu.RLock()
+	names := make([]string, 0, len(h.trees))
+	for name := range h.trees {
+		names = append(names, name)
+	}
+	h.mu.RUnlock()
+	slices.Sort(names)
+	writeJSON(w, names)
+}
+
+func (h *Handler) withTree(serve func(http.ResponseWriter, *http.Request, *merkletree.MerkleTree)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h.mu.RLock()
+		mt, ok := h.trees[r.PathValue("name")]
+		h.mu.RUnlock()
+		if !ok {
+			writeError(w, errUnknownTree)
+			return
+		}
+		serve(w, r, mt)
+	}
+}
+
+func (h *Handler) root(w http.ResponseWriter, r *http.Request, mt *merkletree.MerkleTree) {
+	writeJSON(w, mt.Root())
+}
+
+func (h *Handler) metadata(w http.ResponseWriter, r *http.Request, mt *merkletree.MerkleTree) {
+	writeJSON(w, mt.Metadata())
+}
+
+func (h *Handler) proof(w http.ResponseWriter, r *http.Request, mt *merkletree.MerkleTree) {
+	index, err := parseIndex("index", r.PathValue("index"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	p, err := mt.Proof(index)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, p)
+}
+
+func (h *Handler) rangeProof(w http.ResponseWriter, r *http.Request, mt *merkletree.MerkleTree) {
+	start, err := parseIndex("start", r.URL.Query().Get("start"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	end, err := parseIndex("end", r.URL.Query().Get("end"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if start >= end {
+		writeError(w, badRequest{"merklehttp: start must be below end"})
+		return
+	}
+	p, err := mt.RangeProof(start, end)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, p)
+}
+
+func (h *Handler) segment(w http.ResponseWriter, r *http.Request, mt *merkletree.MerkleTree) {
+	index, err := parseIndex("index", r.PathValue("index"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	segment, err := mt.Segment(index)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(len(segment)))
+	_, _ = w.Write(segment)
+}
+
+// badRequest is an error caused by a malformed request.
+type badRequest struct {
+	msg string
+}
+
+func (e badRequest) Error() string {
+	return e.msg
+}
+
+func parseIndex(name, value string) (uint64, error) {
+	index, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, badRequest{"merklehttp: invalid " + name + " " + strconv.Quote(value)}
+	}
+	return index, nil
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(append(b, '\n'))
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.As(err, new(badRequest)):
+		status = http.StatusBadRequest
+	case errors.Is(err, errUnknownTree), errors.Is(err, merkletree.ErrLeafOutOfRange), errors.Is(err, merkletree.ErrNoLeafData):
+		status = http.StatusNotFound
+	}
+	b, _ := json.Marshal(struct {
+		Error string `json:"error"`
+	}{err.Error()})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(append(b, '\n'))
+}
@@ -0,0 +1,138 @@
+package merklehttp
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/zvikinoza/merkle-tree/merkletree"
+)
+
+func get(t *testing.T, srv *httptest.Server, path string, wantStatus int, v any) []byte {
+	t.Helper()
+	resp, err := http.Get(srv.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != wantStatus {
+		t.Fatalf("GET %s: status %d, want %d: %s", path, resp.StatusCode, wantStatus, body)
+	}
+	if v != nil {
+		if err := json.Unmarshal(body, v); err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+	}
+	return body
+}
+
+func TestHandler(t *testing.T) {
+	data := bytes.Repeat([]byte("served over http "), 20)
+	mt, err := merkletree.NewMerkleTree(data, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewHandler()
+	h.Register("blob", mt)
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	var names []string
+	get(t, srv, "/trees", http.StatusOK, &names)
+	if len(names) != 1 || names[0] != "blob" {
+		t.Fatalf("trees %v, want [blob]", names)
+	}
+
+	var root merkletree.Root
+	get(t, srv, "/trees/blob/root", http.StatusOK, &root)
+	if !root.Equal(mt.Root()) {
+		t.Fatalf("root %v, want %v", root, mt.Root())
+	}
+
+	// a client trusting the metadata verifies what it downloads
+	var meta merkletree.Metadata
+	get(t, srv, "/trees/blob/metadata", http.StatusOK, &meta)
+	var p merkletree.Proof
+	get(t, srv, "/trees/blob/proof/3", http.StatusOK, &p)
+	segment := get(t, srv, "/trees/blob/segments/3", http.StatusOK, nil)
+	if err := meta.VerifyProof(segment, &p); err != nil {
+		t.Fatal(err)
+	}
+
+	var rp merkletree.RangeProof
+	get(t, srv, "/trees/blob/range-proof?start=2&end=5", http.StatusOK, &rp)
+	var rangeData []byte
+	for i := 2; i < 5; i++ {
+		rangeData = append(rangeData, get(t, srv, "/trees/blob/segments/"+strconv.Itoa(i), http.StatusOK, nil)...)
+	}
+	if err := meta.VerifyRangeProof(rangeData, &rp); err != nil {
+		t.Fatal(err)
+	}
+
+	var apiErr struct {
+		Error string `json:"error"`
+	}
+	for path, status := range map[string]int{
+		"/trees/nope/root":                      http.StatusNotFound,
+		"/trees/blob/proof/100000":              http.StatusNotFound,
+		"/trees/blob/segments/100000":           http.StatusNotFound,
+		"/trees/blob/proof/x":                   http.StatusBadRequest,
+		"/trees/blob/range-proof?start=2":       http.StatusBadRequest,
+		"/trees/blob/range-proof?start=3&end=3": http.StatusBadRequest,
+	} {
+		get(t, srv, path, status, &apiErr)
+		if apiErr.Error == "" {
+			t.Fatalf("GET %s: no error message", path)
+		}
+	}
+
+	resp, err := http.Post(srv.URL+"/trees/blob/root", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("POST status %d, want %d", resp.StatusCode, http.StatusMethodNotAllowed)
+	}
+
+	h.Unregister("blob")
+	get(t, srv, "/trees/blob/root", http.StatusNotFound, nil)
+}
+
+func TestHandlerLeafHashTree(t *testing.T) {
+	records, err := merkletree.NewMerkleTreeFromRecords([][]byte{[]byte("a"), []byte("b"), []byte("c")}, merkletree.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaves, err := records.LeafHashes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mt, err := merkletree.NewMerkleTreeFromLeafHashes(leaves, merkletree.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewHandler()
+	h.Register("hashes", mt)
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	// proofs are served, but there is no data to serve segments from
+	var p merkletree.Proof
+	get(t, srv, "/trees/hashes/proof/1", http.StatusOK, &p)
+	var apiErr struct {
+		Error string `json:"error"`
+	}
+	get(t, srv, "/trees/hashes/segments/1", http.StatusNotFound, &apiErr)
+	if apiErr.Error == "" {
+		t.Fatal("no error message")
+	}
+}
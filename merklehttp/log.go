@@ -0,0 +1,120 @@
+package merklehttp
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/zvikinoza/merkle-tree/merklelog"
+)
+
+// LogHandler is an http.Handler serving a transparency log:
+//
+//	POST /entries                               append the request body, returns {"index": n}
+//	GET  /entries/{index}                       raw bytes of an entry
+//	GET  /sth                                   latest merkletree.SignedTreeHead
+//	GET  /proof/inclusion?index=&size=          merkletree.InclusionProof
+//	GET  /proof/consistency?old=&new=           merkletree.ConsistencyProof
+//
+// The size of an inclusion proof defaults to the latest tree head. Appended
+// entries are only covered by proofs once the log has integrated them.
+type LogHandler struct {
+	log *merklelog.Log
+	mux *http.ServeMux
+}
+
+// NewLogHandler returns a handler serving 'l'.
+func NewLogHandler(l *merklelog.Log) *LogHandler {
+	h := &LogHandler{log: l, mux: http.NewServeMux()}
+	h.mux.HandleFunc("POST /entries", h.append)
+	h.mux.HandleFunc("GET /entries/{index}", h.entry)
+	h.mux.HandleFunc("GET /sth", h.treeHead)
+	h.mux.HandleFunc("GET /proof/inclusion", h.inclusionProof)
+	h.mux.HandleFunc("GET /proof/consistency", h.consistencyProof)
+	return h
+}
+
+// ServeHTTP implements http.Handler.
+func (h *LogHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *LogHandler) append(w http.ResponseWriter, r *http.Request) {
+	entry, err := io.ReadAll(http.MaxBytesReader(w, r.Body, merklelog.MaxEntrySize))
+	if err != nil {
+		if errors.As(err, new(*http.MaxBytesError)) {
+			err = badRequest{merklelog.ErrEntryTooLarge.Error()}
+		}
+		writeError(w, err)
+		return
+	}
+	index, err := h.log.Append(entry)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, struct {
+		Index uint64 `json:"index"`
+	}{index})
+}
+
+func (h *LogHandler) entry(w http.ResponseWriter, r *http.Request) {
+	index, err := parseIndex("index", r.PathValue("index"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	entry, err := h.log.Entry(index)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(len(entry)))
+	_, _ = w.Write(entry)
+}
+
+func (h *LogHandler) treeHead(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, h.log.SignedTreeHead())
+}
+
+func (h *LogHandler) inclusionProof(w http.ResponseWriter, r *http.Request) {
+	index, err := parseIndex("index", r.URL.Query().Get("index"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	size := h.log.SignedTreeHead().TreeSize
+	if s := r.URL.Query().Get("size"); s != "" {
+		if size, err = parseIndex("size", s); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+	p, err := h.log.InclusionProof(index, size)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, p)
+}
+
+func (h *LogHandler) consistencyProof(w http.ResponseWriter, r *http.Request) {
+	oldSize, err := parseIndex("old", r.URL.Query().Get("old"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	newSize, err := parseIndex("new", r.URL.Query().Get("new"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	p, err := h.log.ConsistencyProof(oldSize, newSize)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, p)
+}
@@ -0,0 +1,117 @@
+package merklehttp
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/zvikinoza/merkle-tree/merklelog"
+	"github.com/zvikinoza/merkle-tree/merkletree"
+)
+
+func TestLogHandler(t *testing.T) {
+	key := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{1}, ed25519.SeedSize))
+	l, err := merklelog.Open(t.TempDir(), merklelog.Config{Key: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	srv := httptest.NewServer(NewLogHandler(l))
+	defer srv.Close()
+	trusted := []ed25519.PublicKey{key.Public().(ed25519.PublicKey)}
+
+	add := func(entry string) uint64 {
+		t.Helper()
+		resp, err := http.Post(srv.URL+"/entries", "application/octet-stream", bytes.NewBufferString(entry))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("POST /entries: status %d, want %d: %s", resp.StatusCode, http.StatusOK, body)
+		}
+		var v struct {
+			Index uint64 `json:"index"`
+		}
+		if err := json.Unmarshal(body, &v); err != nil {
+			t.Fatal(err)
+		}
+		return v.Index
+	}
+	for i := 0; i < 6; i++ {
+		if index := add("entry " + strconv.Itoa(i)); index != uint64(i) {
+			t.Fatalf("entry appended at %d, want %d", index, i)
+		}
+	}
+
+	var older merkletree.SignedTreeHead
+	get(t, srv, "/sth", http.StatusOK, &older)
+	if older.TreeSize != 0 {
+		t.Fatalf("tree head covers %d entries before integration", older.TreeSize)
+	}
+	get(t, srv, "/proof/inclusion?index=0", http.StatusNotFound, nil)
+
+	if _, err := l.Integrate(); err != nil {
+		t.Fatal(err)
+	}
+	var sth merkletree.SignedTreeHead
+	get(t, srv, "/sth", http.StatusOK, &sth)
+	if err := sth.Verify(trusted); err != nil {
+		t.Fatal(err)
+	}
+	entry := get(t, srv, "/entries/4", http.StatusOK, nil)
+	var inclusion merkletree.InclusionProof
+	get(t, srv, "/proof/inclusion?index=4", http.StatusOK, &inclusion)
+	if err := sth.VerifyInclusion(merkletree.NewLogTree(nil).LeafHash(entry), &inclusion); err != nil {
+		t.Fatal(err)
+	}
+	var consistency merkletree.ConsistencyProof
+	get(t, srv, "/proof/consistency?old=0&new=6", http.StatusOK, &consistency)
+	if err := older.VerifyConsistency(&sth, &consistency); err != nil {
+		t.Fatal(err)
+	}
+
+	// a monitor follows the log over HTTP
+	client := &LogClient{BaseURL: srv.URL}
+	m := merklelog.NewMonitor(client, trusted)
+	if err := m.Observe(context.Background(), &older); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Poll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if m.Latest().TreeSize != sth.TreeSize {
+		t.Fatalf("monitor at %d entries, want %d", m.Latest().TreeSize, sth.TreeSize)
+	}
+	fetched, err := client.InclusionProof(context.Background(), 4, sth.TreeSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sth.VerifyInclusion(merkletree.NewLogTree(nil).LeafHash(entry), fetched); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.ConsistencyProof(context.Background(), 0, 7); err == nil {
+		t.Fatal("got a consistency proof beyond the log")
+	}
+
+	get(t, srv, "/entries/6", http.StatusNotFound, nil)
+	get(t, srv, "/proof/consistency?old=2", http.StatusBadRequest, nil)
+	resp, err := http.Post(srv.URL+"/entries", "application/octet-stream", bytes.NewReader(make([]byte, merklelog.MaxEntrySize+1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("oversized entry: status %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,79 @@
+package merklelog
+
+import (
+	"context"
+	"crypto/ed25519"
+	"sync"
+	"time"
+
+	"github.com/zvikinoza/merkle-tree/merkletree"
+)
+
+// FakeClient is an in-memory Client for testing monitors. It signs a new tree
+// head on every Append, and Fork lets it show different histories to
+// different clients, as a misbehaving log would.
+type FakeClient struct {
+	mu      sync.Mutex
+	key     ed25519.PrivateKey
+	now     func() time.Time
+	entries [][]byte
+	tree    *merkletree.LogTree
+	sth     *merkletree.SignedTreeHead
+}
+
+// NewFakeClient returns a fake of an empty log signing with 'key'.
+func NewFakeClient(key ed25519.PrivateKey) (*FakeClient, error) {
+	f := &FakeClient{key: key, now: time.Now, tree: merkletree.NewLogTree(nil)}
+	return f, f.publish()
+}
+
+func (f *FakeClient) publish() error {
+	sth, err := f.tree.SignTreeHead(f.key, f.now())
+	if err != nil {
+		return err
+	}
+	f.sth = sth
+	return nil
+}
+
+// Append adds 'entries' to the log and signs a tree head covering them.
+func (f *FakeClient) Append(entries ...[]byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, entry := range entries {
+		if _, err := f.tree.Append(entry); err != nil {
+			return err
+		}
+		f.entries = append(f.entries, append([]byte(nil), entry...))
+	}
+	return f.publish()
+}
+
+// Fork returns a fake with the same history and key whose later entries are
+// independent of this one's.
+func (f *FakeClient) Fork() (*FakeClient, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fork := &FakeClient{key: f.key, now: f.now, tree: merkletree.NewLogTree(nil), sth: f.sth}
+	for _, entry := range f.entries {
+		if _, err := fork.tree.Append(entry); err != nil {
+			return nil, err
+		}
+		fork.entries = append(fork.entries, entry)
+	}
+	return fork, nil
+}
+
+// SignedTreeHead returns the latest signed tree head.
+func (f *FakeClient) SignedTreeHead(ctx context.Context) (*merkletree.SignedTreeHead, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.sth, nil
+}
+
+// ConsistencyProof returns the proof between two sizes of this fake's history.
+func (f *FakeClient) ConsistencyProof(ctx context.Context, oldSize, newSize uint64) (*merkletree.ConsistencyProof, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.tree.ConsistencyProof(oldSize, newSize)
+}
@@ -0,0 +1,327 @@
+// Package merklelog is a tamper-evident, append-only log kept in a local
+// directory.
+//
+// Entries are sequenced as they are appended and integrated into an RFC 6962
+// merkletree.LogTree in batches; every integration publishes a new signed tree
+// head. The directory holds:
+//
+//	entries   every entry, prefixed by its length as a big endian uint32
+//	nodes     the tree's node hashes, a merkletree.FileStore
+//	sth.json  the latest signed tree head
+//
+// Entries past the latest signed tree head are sequenced but not yet
+// integrated; they are integrated by the next call to Integrate, including
+// after a restart.
+package merklelog
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/zvikinoza/merkle-tree/merkletree"
+)
+
+// MaxEntrySize is the size of the largest entry a log accepts.
+const MaxEntrySize = 1 << 20
+
+// ErrEntryTooLarge is returned when appending an entry larger than MaxEntrySize.
+var ErrEntryTooLarge = errors.New("merklelog: entry too large")
+
+// Config controls how a Log is opened.
+type Config struct {
+	// Key signs the log's tree heads. It is required.
+	Key ed25519.PrivateKey
+	// NewHash defaults to sha256.New. It must be registered with merkletree.RegisterHash.
+	NewHash func() hash.Hash
+	// Now defaults to time.Now.
+	Now func() time.Time
+}
+
+// Log is a persistent transparency log. It is safe for concurrent use.
+type Log struct {
+	mu      sync.RWMutex
+	dir     string
+	key     ed25519.PrivateKey
+	now     func() time.Time
+	entries *os.File
+	offsets []int64 // offset of every entry's length prefix, and the end of the last entry
+	nodes   *merkletree.FileStore
+	tree    *merkletree.LogTree
+	sth     *merkletree.SignedTreeHead
+}
+
+// Open opens the log in 'dir', creating it when it does not exist.
+// The stored tree head must be signed by cfg.Key and match the stored nodes.
+func Open(dir string, cfg Config) (_ *Log, err error) {
+	if len(cfg.Key) != ed25519.PrivateKeySize {
+		return nil, errors.New("merklelog: an ed25519 signing key is required")
+	}
+	if cfg.NewHash == nil {
+		cfg.NewHash = sha256.New
+	}
+	if cfg.Now == nil {
+		cfg.Now = time.Now
+	}
+	if _, err := merkletree.HashName(cfg.NewHash); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	l := &Log{dir: dir, key: cfg.Key, now: cfg.Now}
+	defer func() {
+		if err != nil {
+			_ = l.Close()
+		}
+	}()
+	if l.entries, err = os.OpenFile(filepath.Join(dir, "entries"), os.O_RDWR|os.O_CREATE, 0o644); err != nil {
+		return nil, err
+	}
+	if err := l.scanEntries(); err != nil {
+		return nil, err
+	}
+	if l.nodes, err = merkletree.OpenFileStore(filepath.Join(dir, "nodes"), cfg.NewHash().Size()); err != nil {
+		return nil, err
+	}
+
+	sth, err := l.readTreeHead()
+	if err != nil {
+		return nil, err
+	}
+	size := uint64(0)
+	if sth != nil {
+		size = sth.TreeSize
+	}
+	if size > l.size() {
+		return nil, fmt.Errorf("merklelog: tree head covers %d entries, only %d stored", size, l.size())
+	}
+	if l.tree, err = merkletree.LoadLogTree(l.nodes, size, cfg.NewHash); err != nil {
+		return nil, err
+	}
+	if sth == nil {
+		return l, l.publish()
+	}
+	if !l.tree.Root().Equal(sth.RootHash()) {
+		return nil, fmt.Errorf("merklelog: stored nodes do not match the tree head of %d entries", size)
+	}
+	l.sth = sth
+	return l, nil
+}
+
+// scanEntries indexes the entries file, dropping a final entry that was only partly written.
+func (l *Log) scanEntries() error {
+	info, err := l.entries.Stat()
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReader(io.NewSectionReader(l.entries, 0, info.Size()))
+	offset := int64(0)
+	l.offsets = []int64{0}
+	for {
+		var prefix [4]byte
+		if _, err := io.ReadFull(r, prefix[:]); err != nil {
+			break
+		}
+		n := int64(binary.BigEndian.Uint32(prefix[:]))
+		if n > MaxEntrySize || offset+4+n > info.Size() {
+			break
+		}
+		if _, err := r.Discard(int(n)); err != nil {
+			return err
+		}
+		offset += 4 + n
+		l.offsets = append(l.offsets, offset)
+	}
+	if offset < info.Size() {
+		return l.entries.Truncate(offset)
+	}
+	return nil
+}
+
+func (l *Log) readTreeHead() (*merkletree.SignedTreeHead, error) {
+	b, err := os.ReadFile(filepath.Join(l.dir, "sth.json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	sth := new(merkletree.SignedTreeHead)
+	if err := json.Unmarshal(b, sth); err != nil {
+		return nil, err
+	}
+	if err := sth.Verify([]ed25519.PublicKey{l.PublicKey()}); err != nil {
+		return nil, fmt.Errorf("merklelog: stored tree head: %w", err)
+	}
+	return sth, nil
+}
+
+// publish signs the current tree and replaces the stored tree head.
+func (l *Log) publish() error {
+	sth, err := l.tree.SignTreeHead(l.key, l.now())
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(sth)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(l.dir, "sth.json.tmp")
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(l.dir, "sth.json")); err != nil {
+		return err
+	}
+	l.sth = sth
+	return nil
+}
+
+// PublicKey returns the key verifying the log's tree heads.
+func (l *Log) PublicKey() ed25519.PublicKey {
+	return l.key.Public().(ed25519.PublicKey)
+}
+
+// Size returns the number of sequenced entries, integrated or not.
+func (l *Log) Size() uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.size()
+}
+
+func (l *Log) size() uint64 {
+	return uint64(len(l.offsets) - 1)
+}
+
+// Append sequences 'entry' and returns its index once it is on stable
+// storage. The entry is covered by a signed tree head after the next Integrate.
+func (l *Log) Append(entry []byte) (uint64, error) {
+	if len(entry) > MaxEntrySize {
+		return 0, fmt.Errorf("%w: %d bytes", ErrEntryTooLarge, len(entry))
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	offset := l.offsets[len(l.offsets)-1]
+	record := binary.BigEndian.AppendUint32(nil, uint32(len(entry)))
+	record = append(record, entry...)
+	if _, err := l.entries.WriteAt(record, offset); err != nil {
+		return 0, err
+	}
+	if err := l.entries.Sync(); err != nil {
+		return 0, err
+	}
+	index := l.size()
+	l.offsets = append(l.offsets, offset+int64(len(record)))
+	return index, nil
+}
+
+// Entry returns the sequenced entry at 'index'.
+func (l *Log) Entry(index uint64) ([]byte, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.entry(index)
+}
+
+func (l *Log) entry(index uint64) ([]byte, error) {
+	if index >= l.size() {
+		return nil, fmt.Errorf("%w: entry %d of %d", merkletree.ErrLeafOutOfRange, index, l.size())
+	}
+	start, end := l.offsets[index]+4, l.offsets[index+1]
+	entry := make([]byte, end-start)
+	if _, err := l.entries.ReadAt(entry, start); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// Integrate adds every sequenced entry to the tree and publishes a signed
+// tree head covering them. Without new entries the latest tree head is
+// returned unchanged.
+func (l *Log) Integrate() (*merkletree.SignedTreeHead, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.tree.Size() == l.size() {
+		return l.sth, nil
+	}
+	for index := l.tree.Size(); index < l.size(); index++ {
+		entry, err := l.entry(index)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := l.tree.Append(entry); err != nil {
+			return nil, err
+		}
+	}
+	if err := l.nodes.Sync(); err != nil {
+		return nil, err
+	}
+	if err := l.publish(); err != nil {
+		return nil, err
+	}
+	return l.sth, nil
+}
+
+// Run integrates sequenced entries every 'interval' until the context is done.
+func (l *Log) Run(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if _, err := l.Integrate(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// SignedTreeHead returns the latest signed tree head.
+func (l *Log) SignedTreeHead() *merkletree.SignedTreeHead {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.sth
+}
+
+// InclusionProof returns the proof of the entry at 'index' in the tree of
+// 'size' entries, which must not exceed the latest signed tree head.
+func (l *Log) InclusionProof(index, size uint64) (*merkletree.InclusionProof, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.tree.InclusionProof(index, size)
+}
+
+// ConsistencyProof returns the proof that the tree of 'oldSize' entries is a
+// prefix of the one of 'newSize' entries, which must not exceed the latest
+// signed tree head.
+func (l *Log) ConsistencyProof(oldSize, newSize uint64) (*merkletree.ConsistencyProof, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.tree.ConsistencyProof(oldSize, newSize)
+}
+
+// Close closes the log's files.
+func (l *Log) Close() error {
+	var errs []error
+	if l.entries != nil {
+		errs = append(errs, l.entries.Close())
+	}
+	if l.nodes != nil {
+		errs = append(errs, l.nodes.Close())
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,226 @@
+package merklelog
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/zvikinoza/merkle-tree/merkletree"
+)
+
+func testKey(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+	return ed25519.NewKeyFromSeed(bytes.Repeat([]byte{7}, ed25519.SeedSize))
+}
+
+func appendEntries(t *testing.T, l *Log, from, to int) {
+	t.Helper()
+	for i := from; i < to; i++ {
+		index, err := l.Append([]byte(fmt.Sprintf("entry %d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if index != uint64(i) {
+			t.Fatalf("entry appended at %d, want %d", index, i)
+		}
+	}
+}
+
+func TestLogSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	key := testKey(t)
+	trusted := []ed25519.PublicKey{key.Public().(ed25519.PublicKey)}
+
+	l, err := Open(dir, Config{Key: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	empty := l.SignedTreeHead()
+	if empty.TreeSize != 0 {
+		t.Fatalf("new log has %d entries", empty.TreeSize)
+	}
+	appendEntries(t, l, 0, 11)
+	if l.SignedTreeHead().TreeSize != 0 {
+		t.Fatal("entries were integrated before Integrate")
+	}
+	first, err := l.Integrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// sequenced but not integrated when the log is closed
+	appendEntries(t, l, 11, 20)
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err = Open(dir, Config{Key: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if got := l.SignedTreeHead(); got.TreeSize != first.TreeSize || !bytes.Equal(got.Root, first.Root) {
+		t.Fatalf("reopened at %d entries, want %d", got.TreeSize, first.TreeSize)
+	}
+	if l.Size() != 20 {
+		t.Fatalf("reopened with %d sequenced entries, want 20", l.Size())
+	}
+	second, err := l.Integrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.TreeSize != 20 {
+		t.Fatalf("integrated %d entries, want 20", second.TreeSize)
+	}
+
+	for _, sth := range []*merkletree.SignedTreeHead{empty, first, second} {
+		if err := sth.Verify(trusted); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for index := uint64(0); index < second.TreeSize; index++ {
+		entry, err := l.Entry(index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := l.InclusionProof(index, second.TreeSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := second.VerifyInclusion(merkletree.NewLogTree(nil).LeafHash(entry), p); err != nil {
+			t.Fatalf("entry %d: %v", index, err)
+		}
+	}
+	for _, older := range []*merkletree.SignedTreeHead{empty, first} {
+		p, err := l.ConsistencyProof(older.TreeSize, second.TreeSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := older.VerifyConsistency(second, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := l.InclusionProof(0, second.TreeSize+1); !errors.Is(err, merkletree.ErrLeafOutOfRange) {
+		t.Fatalf("got %v, want %v", err, merkletree.ErrLeafOutOfRange)
+	}
+}
+
+func TestLogDropsPartialEntry(t *testing.T) {
+	dir := t.TempDir()
+	key := testKey(t)
+	l, err := Open(dir, Config{Key: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendEntries(t, l, 0, 3)
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a crash halfway through writing a fourth entry
+	f, err := os.OpenFile(filepath.Join(dir, "entries"), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte{0, 0, 0, 9, 'p', 'a', 'r'}); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	l, err = Open(dir, Config{Key: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if l.Size() != 3 {
+		t.Fatalf("reopened with %d entries, want 3", l.Size())
+	}
+	appendEntries(t, l, 3, 4)
+	if entry, err := l.Entry(3); err != nil || string(entry) != "entry 3" {
+		t.Fatalf("entry 3 is %q, %v", entry, err)
+	}
+}
+
+func TestLogDropsPartialNode(t *testing.T) {
+	dir := t.TempDir()
+	key := testKey(t)
+	l, err := Open(dir, Config{Key: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendEntries(t, l, 0, 3)
+	if _, err := l.Integrate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a crash halfway through writing a node
+	f, err := os.OpenFile(filepath.Join(dir, "nodes"), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte{0, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	l, err = Open(dir, Config{Key: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if l.SignedTreeHead().TreeSize != 3 {
+		t.Fatalf("reopened with a tree head of %d entries, want 3", l.SignedTreeHead().TreeSize)
+	}
+	appendEntries(t, l, 3, 5)
+	sth, err := l.Integrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := l.InclusionProof(4, sth.TreeSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := merkletree.VerifyInclusion(sth.RootHash(), l.tree.LeafHash([]byte("entry 4")), p); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLogRejectsTampering(t *testing.T) {
+	dir := t.TempDir()
+	key := testKey(t)
+	l, err := Open(dir, Config{Key: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendEntries(t, l, 0, 5)
+	if _, err := l.Integrate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	other := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{8}, ed25519.SeedSize))
+	if _, err := Open(dir, Config{Key: other}); !errors.Is(err, merkletree.ErrUntrustedKey) {
+		t.Fatalf("opened with another key: %v", err)
+	}
+
+	// rewrite the stored hash of the subtree over the first four entries
+	nodes, err := merkletree.OpenFileStore(filepath.Join(dir, "nodes"), 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := nodes.Put(6, make([]byte, 32)); err != nil {
+		t.Fatal(err)
+	}
+	nodes.Close()
+	if _, err := Open(dir, Config{Key: key}); err == nil {
+		t.Fatal("opened a log whose nodes do not match its tree head")
+	}
+}
@@ -0,0 +1,204 @@
+package merklelog
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/zvikinoza/merkle-tree/merkletree"
+)
+
+var (
+	// ErrNotAFork is returned when verifying evidence that does not show a split view.
+	ErrNotAFork = errors.New("merklelog: evidence does not show a fork")
+	// ErrSuspectedFork is returned when verifying evidence of a suspected fork,
+	// which cannot be confirmed from the evidence alone.
+	ErrSuspectedFork = errors.New("merklelog: fork is suspected, not proven")
+)
+
+// Client reads a log, wherever it runs.
+type Client interface {
+	SignedTreeHead(ctx context.Context) (*merkletree.SignedTreeHead, error)
+	ConsistencyProof(ctx context.Context, oldSize, newSize uint64) (*merkletree.ConsistencyProof, error)
+}
+
+// LocalClient is a Client reading a Log in the same process.
+type LocalClient struct {
+	Log *Log
+}
+
+// SignedTreeHead returns the log's latest signed tree head.
+func (c LocalClient) SignedTreeHead(ctx context.Context) (*merkletree.SignedTreeHead, error) {
+	return c.Log.SignedTreeHead(), nil
+}
+
+// ConsistencyProof returns the log's consistency proof between two sizes.
+func (c LocalClient) ConsistencyProof(ctx context.Context, oldSize, newSize uint64) (*merkletree.ConsistencyProof, error) {
+	return c.Log.ConsistencyProof(oldSize, newSize)
+}
+
+// ForkEvidence shows that a log signed two tree heads that are not versions
+// of the same append-only tree.
+//
+// When both heads have the same size and different roots the heads alone are
+// conclusive. Otherwise the fork is only suspected: Proof holds the
+// consistency proof the log served between them, which fails to verify, but a
+// broken proof may as well come from a faulty server or a corrupted response
+// as from a fork. Anyone can settle it by asking the log for another proof.
+type ForkEvidence struct {
+	// Older has at most as many entries as Newer.
+	Older *merkletree.SignedTreeHead   `json:"older"`
+	Newer *merkletree.SignedTreeHead   `json:"newer"`
+	Proof *merkletree.ConsistencyProof `json:"proof,omitempty"`
+	Err   string                       `json:"error"`
+}
+
+func (e *ForkEvidence) Error() string {
+	kind := "fork"
+	if e.Suspected() {
+		kind = "suspected fork"
+	}
+	return fmt.Sprintf("merklelog: %s between tree heads of %d and %d entries: %s", kind, e.Older.TreeSize, e.Newer.TreeSize, e.Err)
+}
+
+// Suspected reports whether the heads have different sizes, so that the
+// evidence rests on a proof that failed to verify rather than on the heads.
+func (e *ForkEvidence) Suspected() bool {
+	return e.Older.TreeSize != e.Newer.TreeSize
+}
+
+// Verify checks that the evidence shows a fork of a log signing with one of
+// the 'trusted' keys. Evidence of a suspected fork is checked as far as it
+// can be and then reported with ErrSuspectedFork, never as proven.
+func (e *ForkEvidence) Verify(trusted []ed25519.PublicKey) error {
+	if e.Older == nil || e.Newer == nil {
+		return fmt.Errorf("%w: missing tree head", ErrNotAFork)
+	}
+	for _, sth := range []*merkletree.SignedTreeHead{e.Older, e.Newer} {
+		if err := sth.Verify(trusted); err != nil {
+			return err
+		}
+	}
+	if !bytes.Equal(e.Older.KeyID, e.Newer.KeyID) {
+		return fmt.Errorf("%w: tree heads signed by different keys", ErrNotAFork)
+	}
+	if e.Older.TreeSize > e.Newer.TreeSize {
+		return fmt.Errorf("%w: older tree head has more entries", ErrNotAFork)
+	}
+	if !e.Suspected() {
+		if e.Older.Algorithm == e.Newer.Algorithm && bytes.Equal(e.Older.Root, e.Newer.Root) {
+			return fmt.Errorf("%w: tree heads have the same root", ErrNotAFork)
+		}
+		return nil
+	}
+	if e.Proof == nil {
+		return fmt.Errorf("%w: missing consistency proof", ErrNotAFork)
+	}
+	if e.Proof.OldSize != e.Older.TreeSize || e.Proof.NewSize != e.Newer.TreeSize {
+		return fmt.Errorf("%w: consistency proof is for other tree heads", ErrNotAFork)
+	}
+	err := e.Older.VerifyConsistency(e.Newer, e.Proof)
+	if err == nil {
+		return fmt.Errorf("%w: tree heads are consistent", ErrNotAFork)
+	}
+	return fmt.Errorf("%w: consistency proof between %d and %d entries fails: %v", ErrSuspectedFork, e.Older.TreeSize, e.Newer.TreeSize, err)
+}
+
+// Monitor follows a log and checks that every tree head it observes is
+// consistent with the largest one verified so far.
+type Monitor struct {
+	client  Client
+	trusted []ed25519.PublicKey
+
+	mu     sync.Mutex
+	latest *merkletree.SignedTreeHead
+}
+
+// NewMonitor returns a monitor following the log read by 'client', whose
+// tree heads must be signed by one of the 'trusted' keys.
+func NewMonitor(client Client, trusted []ed25519.PublicKey) *Monitor {
+	return &Monitor{client: client, trusted: trusted}
+}
+
+// Latest returns the largest tree head verified so far, nil before the first.
+func (m *Monitor) Latest() *merkletree.SignedTreeHead {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.latest
+}
+
+// Poll fetches the log's current tree head and checks it with Observe.
+func (m *Monitor) Poll(ctx context.Context) error {
+	sth, err := m.client.SignedTreeHead(ctx)
+	if err != nil {
+		return err
+	}
+	return m.Observe(ctx, sth)
+}
+
+// Observe checks a tree head of the log, fetched by the monitor or obtained
+// elsewhere, against the largest one verified so far, asking the log for a
+// consistency proof between them. It returns a *ForkEvidence when they are
+// not consistent, a suspected one when the log's proof fails to verify; the
+// head is then not accepted.
+func (m *Monitor) Observe(ctx context.Context, sth *merkletree.SignedTreeHead) error {
+	if err := sth.Verify(m.trusted); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.latest == nil {
+		m.latest = sth
+		return nil
+	}
+
+	older, newer := m.latest, sth
+	if older.TreeSize > newer.TreeSize {
+		older, newer = newer, older
+	}
+	if older.TreeSize == newer.TreeSize {
+		if !older.RootHash().Equal(newer.RootHash()) {
+			return &ForkEvidence{Older: older, Newer: newer, Err: "same size with different roots"}
+		}
+		return nil
+	}
+	p, err := m.client.ConsistencyProof(ctx, older.TreeSize, newer.TreeSize)
+	if err != nil {
+		return err
+	}
+	if p.OldSize != older.TreeSize || p.NewSize != newer.TreeSize {
+		return fmt.Errorf("merklelog: asked for a consistency proof between %d and %d entries, got %d and %d",
+			older.TreeSize, newer.TreeSize, p.OldSize, p.NewSize)
+	}
+	if err := older.VerifyConsistency(newer, p); err != nil {
+		return &ForkEvidence{Older: older, Newer: newer, Proof: p, Err: err.Error()}
+	}
+	m.latest = newer
+	return nil
+}
+
+// Run polls the log every 'interval' until the context is done, passing fork
+// evidence, suspected or not, to 'onFork'. It returns on the first other error.
+func (m *Monitor) Run(ctx context.Context, interval time.Duration, onFork func(*ForkEvidence)) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		err := m.Poll(ctx)
+		var fork *ForkEvidence
+		switch {
+		case errors.As(err, &fork):
+			onFork(fork)
+		case err != nil:
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
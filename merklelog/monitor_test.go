@@ -0,0 +1,162 @@
+package merklelog
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/zvikinoza/merkle-tree/merkletree"
+)
+
+func TestMonitorFollowsHonestLog(t *testing.T) {
+	ctx := context.Background()
+	key := testKey(t)
+	trusted := []ed25519.PublicKey{key.Public().(ed25519.PublicKey)}
+	l, err := Open(t.TempDir(), Config{Key: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	m := NewMonitor(LocalClient{Log: l}, trusted)
+	for i := 0; i < 5; i++ {
+		appendEntries(t, l, i*3, i*3+3)
+		if _, err := l.Integrate(); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Poll(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if got := m.Latest().TreeSize; got != uint64(i*3+3) {
+			t.Fatalf("monitor at %d entries, want %d", got, i*3+3)
+		}
+	}
+
+	other := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{8}, ed25519.SeedSize))
+	impostor, err := NewFakeClient(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sth, _ := impostor.SignedTreeHead(ctx)
+	if err := m.Observe(ctx, sth); !errors.Is(err, merkletree.ErrUntrustedKey) {
+		t.Fatalf("got %v, want %v", err, merkletree.ErrUntrustedKey)
+	}
+}
+
+func TestMonitorDetectsFork(t *testing.T) {
+	ctx := context.Background()
+	key := testKey(t)
+	trusted := []ed25519.PublicKey{key.Public().(ed25519.PublicKey)}
+	log, err := NewFakeClient(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := log.Append([]byte("a"), []byte("b"), []byte("c")); err != nil {
+		t.Fatal(err)
+	}
+	// the log shows one history to the monitor and another to a victim
+	victim, err := log.Fork()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := log.Append([]byte("d"), []byte("e"), []byte("f")); err != nil {
+		t.Fatal(err)
+	}
+	if err := victim.Append([]byte("evil")); err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewMonitor(log, trusted)
+	if err := m.Poll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	victimHead, _ := victim.SignedTreeHead(ctx)
+	err = m.Observe(ctx, victimHead)
+	var fork *ForkEvidence
+	if !errors.As(err, &fork) {
+		t.Fatalf("got %v, want fork evidence", err)
+	}
+	if fork.Older.TreeSize != 4 || fork.Newer.TreeSize != 6 || fork.Proof == nil || !fork.Suspected() {
+		t.Fatalf("evidence between %d and %d entries", fork.Older.TreeSize, fork.Newer.TreeSize)
+	}
+	if m.Latest().TreeSize != 6 {
+		t.Fatal("monitor accepted the forked tree head")
+	}
+
+	// the evidence survives being passed on as JSON
+	b, err := json.Marshal(fork)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded ForkEvidence
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if err := decoded.Verify(trusted); !errors.Is(err, ErrSuspectedFork) {
+		t.Fatalf("got %v, want %v", err, ErrSuspectedFork)
+	}
+
+	// two heads of the same size are conclusive on their own
+	sameSize, err := log.Fork()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := victim.Append([]byte("g"), []byte("h")); err != nil {
+		t.Fatal(err)
+	}
+	victimHead, _ = victim.SignedTreeHead(ctx)
+	err = m.Observe(ctx, victimHead)
+	if !errors.As(err, &fork) || fork.Proof != nil || fork.Suspected() {
+		t.Fatalf("got %v, want fork evidence without a proof", err)
+	}
+	if err := fork.Verify(trusted); err != nil {
+		t.Fatal(err)
+	}
+
+	// consistent heads are not evidence
+	older, _ := sameSize.SignedTreeHead(ctx)
+	if err := sameSize.Append([]byte("g")); err != nil {
+		t.Fatal(err)
+	}
+	newer, _ := sameSize.SignedTreeHead(ctx)
+	p, err := sameSize.ConsistencyProof(ctx, older.TreeSize, newer.TreeSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	honest := &ForkEvidence{Older: older, Newer: newer, Proof: p}
+	if err := honest.Verify(trusted); !errors.Is(err, ErrNotAFork) {
+		t.Fatalf("got %v, want %v", err, ErrNotAFork)
+	}
+}
+
+func TestForkEvidenceRejectsCorruptedProof(t *testing.T) {
+	ctx := context.Background()
+	key := testKey(t)
+	trusted := []ed25519.PublicKey{key.Public().(ed25519.PublicKey)}
+	log, err := NewFakeClient(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := log.Append([]byte("a"), []byte("b"), []byte("c")); err != nil {
+		t.Fatal(err)
+	}
+	older, _ := log.SignedTreeHead(ctx)
+	if err := log.Append([]byte("d"), []byte("e"), []byte("f")); err != nil {
+		t.Fatal(err)
+	}
+	newer, _ := log.SignedTreeHead(ctx)
+	p, err := log.ConsistencyProof(ctx, older.TreeSize, newer.TreeSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an honest log's proof broken in transit is no proof of a fork
+	p.Hashes[0] = make([]byte, len(p.Hashes[0]))
+	evidence := &ForkEvidence{Older: older, Newer: newer, Proof: p, Err: "corrupted"}
+	if err := evidence.Verify(trusted); !errors.Is(err, ErrSuspectedFork) {
+		t.Fatalf("got %v, want %v", err, ErrSuspectedFork)
+	}
+}
@@ -0,0 +1,454 @@
+package merkletree
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// maxBlockTransactions bounds the transaction count a partial merkle tree may
+// claim, mirroring Bitcoin Core's MAX_BLOCK_WEIGHT / MIN_TRANSACTION_WEIGHT.
+const maxBlockTransactions = 4000000 / 240
+
+// BlockHeaderSize is the size of a serialized Bitcoin block header.
+const BlockHeaderSize = 80
+
+var (
+	// ErrInvalidTxID is returned when a transaction id is not 32 bytes long.
+	ErrInvalidTxID = errors.New("merkletree: transaction id must be 32 bytes")
+	// ErrNoTransactions is returned when a Bitcoin tree is built from no leaves.
+	ErrNoTransactions = errors.New("merkletree: no transactions")
+	// ErrInvalidPartialTree is returned when a BIP37 partial merkle tree is malformed.
+	ErrInvalidPartialTree = errors.New("merkletree: invalid partial merkle tree")
+	// ErrMerkleRootMismatch is returned when a merkle block does not commit to its header.
+	ErrMerkleRootMismatch = errors.New("merkletree: merkle root does not match block header")
+)
+
+// BitcoinTree is a transaction merkle tree built the way Bitcoin does:
+// nodes are double SHA-256 of their concatenated children and the last hash
+// of every odd level is paired with itself.
+type BitcoinTree struct {
+	// levels[0] holds the transaction ids, the last level holds the root.
+	levels [][][]byte
+}
+
+// NewBitcoinTree returns the Bitcoin merkle tree over 'txids'.
+// Transaction ids are expected in internal byte order (as hashed, not as displayed),
+// use ParseDisplayHash to convert from the usual hex representation.
+func NewBitcoinTree(txids [][]byte) (*BitcoinTree, error) {
+	if len(txids) == 0 {
+		return nil, ErrNoTransactions
+	}
+	level := make([][]byte, len(txids))
+	for i, id := range txids {
+		if len(id) != sha256.Size {
+			return nil, ErrInvalidTxID
+		}
+		level[i] = append([]byte(nil), id...)
+	}
+
+	bt := &BitcoinTree{levels: [][][]byte{level}}
+	for len(level) > 1 {
+		next := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			right := level[i]
+			if i+1 < len(level) {
+				right = level[i+1]
+			}
+			next = append(next, doubleSHA256Pair(level[i], right))
+		}
+		bt.levels = append(bt.levels, next)
+		level = next
+	}
+	return bt, nil
+}
+
+// GetRootHash returns the merkle root in internal byte order.
+func (bt *BitcoinTree) GetRootHash() []byte {
+	return append([]byte(nil), bt.levels[len(bt.levels)-1][0]...)
+}
+
+// String returns the merkle root in display (byte reversed) hex.
+func (bt *BitcoinTree) String() string {
+	return DisplayHash(bt.levels[len(bt.levels)-1][0])
+}
+
+// HasMutation reports whether the tree is vulnerable to CVE-2012-2459, i.e.
+// some level ends in two identical hashes so a different transaction list
+// produces the same root.
+func (bt *BitcoinTree) HasMutation() bool {
+	for _, level := range bt.levels[:len(bt.levels)-1] {
+		for i := 0; i+1 < len(level); i += 2 {
+			if bytes.Equal(level[i], level[i+1]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// DisplayHash returns the hex encoding of 'h' in the byte reversed order
+// Bitcoin uses to display transaction ids and block hashes.
+func DisplayHash(h []byte) string {
+	return hex.EncodeToString(reverseBytes(h))
+}
+
+// ParseDisplayHash decodes a hash displayed by Bitcoin tooling into internal byte order.
+func ParseDisplayHash(s string) ([]byte, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != sha256.Size {
+		return nil, ErrInvalidTxID
+	}
+	return reverseBytes(b), nil
+}
+
+func reverseBytes(b []byte) []byte {
+	r := make([]byte, len(b))
+	for i := range b {
+		r[len(b)-1-i] = b[i]
+	}
+	return r
+}
+
+func doubleSHA256(b []byte) []byte {
+	first := sha256.Sum256(b)
+	second := sha256.Sum256(first[:])
+	return second[:]
+}
+
+func doubleSHA256Pair(left, right []byte) []byte {
+	concat := make([]byte, 0, len(left)+len(right))
+	concat = append(concat, left...)
+	concat = append(concat, right...)
+	return doubleSHA256(concat)
+}
+
+// PartialMerkleTree is a BIP37 partial merkle tree, the proof of inclusion
+// carried by a CMerkleBlock.
+type PartialMerkleTree struct {
+	Transactions uint32
+	Hashes       [][]byte
+	Flags        []bool
+}
+
+// NewPartialMerkleTree returns the partial merkle tree over 'txids' proving
+// inclusion of every transaction whose entry in 'matches' is true.
+func NewPartialMerkleTree(txids [][]byte, matches []bool) (*PartialMerkleTree, error) {
+	if len(txids) == 0 {
+		return nil, ErrNoTransactions
+	}
+	if len(txids) != len(matches) {
+		return nil, fmt.Errorf("merkletree: %d transactions but %d match flags", len(txids), len(matches))
+	}
+	for _, id := range txids {
+		if len(id) != sha256.Size {
+			return nil, ErrInvalidTxID
+		}
+	}
+
+	pmt := &PartialMerkleTree{Transactions: uint32(len(txids))}
+	pmt.traverseAndBuild(pmt.height(), 0, txids, matches)
+	return pmt, nil
+}
+
+// width returns the number of nodes at 'height', leaves being at height 0.
+func (pmt *PartialMerkleTree) width(height uint) uint32 {
+	return uint32((uint64(pmt.Transactions) + (1 << height) - 1) >> height)
+}
+
+func (pmt *PartialMerkleTree) height() uint {
+	height := uint(0)
+	for pmt.width(height) > 1 {
+		height++
+	}
+	return height
+}
+
+func (pmt *PartialMerkleTree) calcHash(height uint, pos uint32, txids [][]byte) []byte {
+	if height == 0 {
+		return txids[pos]
+	}
+	left := pmt.calcHash(height-1, pos*2, txids)
+	right := left
+	if pos*2+1 < pmt.width(height-1) {
+		right = pmt.calcHash(height-1, pos*2+1, txids)
+	}
+	return doubleSHA256Pair(left, right)
+}
+
+func (pmt *PartialMerkleTree) traverseAndBuild(height uint, pos uint32, txids [][]byte, matches []bool) {
+	// does this node have any matched descendant
+	parentOfMatch := false
+	for p := uint64(pos) << height; p < uint64(pos+1)<<height && p < uint64(pmt.Transactions); p++ {
+		parentOfMatch = parentOfMatch || matches[p]
+	}
+	pmt.Flags = append(pmt.Flags, parentOfMatch)
+
+	if height == 0 || !parentOfMatch {
+		pmt.Hashes = append(pmt.Hashes, append([]byte(nil), pmt.calcHash(height, pos, txids)...))
+		return
+	}
+	pmt.traverseAndBuild(height-1, pos*2, txids, matches)
+	if pos*2+1 < pmt.width(height-1) {
+		pmt.traverseAndBuild(height-1, pos*2+1, txids, matches)
+	}
+}
+
+type pmtExtractor struct {
+	bitsUsed, hashUsed int
+	matched            [][]byte
+	indices            []uint32
+}
+
+func (pmt *PartialMerkleTree) traverseAndExtract(height uint, pos uint32, ex *pmtExtractor) ([]byte, error) {
+	if ex.bitsUsed >= len(pmt.Flags) {
+		return nil, ErrInvalidPartialTree
+	}
+	parentOfMatch := pmt.Flags[ex.bitsUsed]
+	ex.bitsUsed++
+
+	if height == 0 || !parentOfMatch {
+		if ex.hashUsed >= len(pmt.Hashes) {
+			return nil, ErrInvalidPartialTree
+		}
+		h := pmt.Hashes[ex.hashUsed]
+		ex.hashUsed++
+		if height == 0 && parentOfMatch {
+			ex.matched = append(ex.matched, h)
+			ex.indices = append(ex.indices, pos)
+		}
+		return h, nil
+	}
+
+	left, err := pmt.traverseAndExtract(height-1, pos*2, ex)
+	if err != nil {
+		return nil, err
+	}
+	right := left
+	if pos*2+1 < pmt.width(height-1) {
+		right, err = pmt.traverseAndExtract(height-1, pos*2+1, ex)
+		if err != nil {
+			return nil, err
+		}
+		// two identical children would allow CVE-2012-2459 style mutations
+		if bytes.Equal(left, right) {
+			return nil, ErrInvalidPartialTree
+		}
+	}
+	return doubleSHA256Pair(left, right), nil
+}
+
+// ExtractMatches validates the partial merkle tree and returns the merkle root
+// it commits to together with the matched transaction ids and their positions in the block.
+func (pmt *PartialMerkleTree) ExtractMatches() (root []byte, matched [][]byte, indices []uint32, err error) {
+	if pmt.Transactions == 0 || pmt.Transactions > maxBlockTransactions {
+		return nil, nil, nil, ErrInvalidPartialTree
+	}
+	// there can never be more hashes provided than one for every txid
+	if uint64(len(pmt.Hashes)) > uint64(pmt.Transactions) {
+		return nil, nil, nil, ErrInvalidPartialTree
+	}
+	// there must be at least one bit per node in the partial tree, and at least one node per hash
+	if len(pmt.Flags) < len(pmt.Hashes) {
+		return nil, nil, nil, ErrInvalidPartialTree
+	}
+	for _, h := range pmt.Hashes {
+		if len(h) != sha256.Size {
+			return nil, nil, nil, ErrInvalidPartialTree
+		}
+	}
+
+	ex := &pmtExtractor{}
+	root, err = pmt.traverseAndExtract(pmt.height(), 0, ex)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	// all bits and hashes must be consumed, up to the padding of the last flag byte
+	if (ex.bitsUsed+7)/8 != (len(pmt.Flags)+7)/8 || ex.hashUsed != len(pmt.Hashes) {
+		return nil, nil, nil, ErrInvalidPartialTree
+	}
+	return root, ex.matched, ex.indices, nil
+}
+
+// MarshalBinary encodes the partial merkle tree in the BIP37 wire format.
+func (pmt *PartialMerkleTree) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	var u32 [4]byte
+	binary.LittleEndian.PutUint32(u32[:], pmt.Transactions)
+	buf.Write(u32[:])
+
+	writeCompactSize(&buf, uint64(len(pmt.Hashes)))
+	for _, h := range pmt.Hashes {
+		if len(h) != sha256.Size {
+			return nil, ErrInvalidTxID
+		}
+		buf.Write(h)
+	}
+
+	flags := make([]byte, (len(pmt.Flags)+7)/8)
+	for i, f := range pmt.Flags {
+		if f {
+			flags[i/8] |= 1 << (i % 8)
+		}
+	}
+	writeCompactSize(&buf, uint64(len(flags)))
+	buf.Write(flags)
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes a partial merkle tree in the BIP37 wire format.
+func (pmt *PartialMerkleTree) UnmarshalBinary(data []byte) error {
+	r := bytes.NewReader(data)
+	if err := pmt.decode(r); err != nil {
+		return err
+	}
+	if r.Len() != 0 {
+		return ErrInvalidPartialTree
+	}
+	return nil
+}
+
+func (pmt *PartialMerkleTree) decode(r *bytes.Reader) error {
+	if r.Len() < 4 {
+		return ErrInvalidPartialTree
+	}
+	var u32 [4]byte
+	_, _ = r.Read(u32[:])
+	transactions := binary.LittleEndian.Uint32(u32[:])
+
+	n, err := readCompactSize(r)
+	if err != nil || n > uint64(r.Len())/sha256.Size {
+		return ErrInvalidPartialTree
+	}
+	hashes := make([][]byte, n)
+	for i := range hashes {
+		hashes[i] = make([]byte, sha256.Size)
+		_, _ = r.Read(hashes[i])
+	}
+
+	n, err = readCompactSize(r)
+	if err != nil || n > uint64(r.Len()) {
+		return ErrInvalidPartialTree
+	}
+	flags := make([]bool, n*8)
+	for i := uint64(0); i < n; i++ {
+		b, _ := r.ReadByte()
+		for bit := uint64(0); bit < 8; bit++ {
+			flags[i*8+bit] = b&(1<<bit) != 0
+		}
+	}
+
+	pmt.Transactions = transactions
+	pmt.Hashes = hashes
+	pmt.Flags = flags
+	return nil
+}
+
+// MerkleBlock is a BIP37 CMerkleBlock: a block header and a partial merkle
+// tree proving inclusion of some of the block's transactions.
+type MerkleBlock struct {
+	Header [BlockHeaderSize]byte
+	Tree   PartialMerkleTree
+}
+
+// MerkleRoot returns the merkle root committed to by the block header, in internal byte order.
+func (mb *MerkleBlock) MerkleRoot() []byte {
+	return append([]byte(nil), mb.Header[36:68]...)
+}
+
+// BlockHash returns the hash of the block header, in internal byte order.
+func (mb *MerkleBlock) BlockHash() []byte {
+	return doubleSHA256(mb.Header[:])
+}
+
+// Verify checks the partial merkle tree against the block header and returns
+// the matched transaction ids and their positions in the block.
+func (mb *MerkleBlock) Verify() (matched [][]byte, indices []uint32, err error) {
+	root, matched, indices, err := mb.Tree.ExtractMatches()
+	if err != nil {
+		return nil, nil, err
+	}
+	if !bytes.Equal(root, mb.Header[36:68]) {
+		return nil, nil, ErrMerkleRootMismatch
+	}
+	return matched, indices, nil
+}
+
+// MarshalBinary encodes the merkle block in the BIP37 wire format.
+func (mb *MerkleBlock) MarshalBinary() ([]byte, error) {
+	tree, err := mb.Tree.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte(nil), mb.Header[:]...), tree...), nil
+}
+
+// UnmarshalBinary decodes a merkle block in the BIP37 wire format.
+func (mb *MerkleBlock) UnmarshalBinary(data []byte) error {
+	if len(data) < BlockHeaderSize {
+		return ErrInvalidPartialTree
+	}
+	var tree PartialMerkleTree
+	if err := tree.UnmarshalBinary(data[BlockHeaderSize:]); err != nil {
+		return err
+	}
+	copy(mb.Header[:], data[:BlockHeaderSize])
+	mb.Tree = tree
+	return nil
+}
+
+func writeCompactSize(buf *bytes.Buffer, n uint64) {
+	var b [9]byte
+	switch {
+	case n < 0xfd:
+		buf.WriteByte(byte(n))
+	case n <= 0xffff:
+		b[0] = 0xfd
+		binary.LittleEndian.PutUint16(b[1:], uint16(n))
+		buf.Write(b[:3])
+	case n <= 0xffffffff:
+		b[0] = 0xfe
+		binary.LittleEndian.PutUint32(b[1:], uint32(n))
+		buf.Write(b[:5])
+	default:
+		b[0] = 0xff
+		binary.LittleEndian.PutUint64(b[1:], n)
+		buf.Write(b[:9])
+	}
+}
+
+func readCompactSize(r *bytes.Reader) (uint64, error) {
+	prefix, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	var size int
+	var least uint64
+	switch prefix {
+	case 0xfd:
+		size, least = 2, 0xfd
+	case 0xfe:
+		size, least = 4, 0x10000
+	case 0xff:
+		size, least = 8, 0x100000000
+	default:
+		return uint64(prefix), nil
+	}
+	if r.Len() < size {
+		return 0, ErrInvalidPartialTree
+	}
+	var b [8]byte
+	_, _ = r.Read(b[:size])
+	n := binary.LittleEndian.Uint64(b[:])
+	// non-canonical encodings are rejected like Bitcoin Core does
+	if n < least {
+		return 0, ErrInvalidPartialTree
+	}
+	return n, nil
+}
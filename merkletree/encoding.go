@@ -0,0 +1,765 @@
+package merkletree
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalidEncoding is returned when a textual or JSON encoding cannot be decoded.
+var ErrInvalidEncoding = errors.New("merkletree: invalid encoding")
+
+// hexBytes is a byte slice that encodes as a hex string in JSON.
+type hexBytes []byte
+
+func (h hexBytes) MarshalText() ([]byte, error) {
+	return []byte(hex.EncodeToString(h)), nil
+}
+
+func (h *hexBytes) UnmarshalText(text []byte) error {
+	b, err := hex.DecodeString(string(text))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidEncoding, err)
+	}
+	*h = b
+	return nil
+}
+
+// checkDigest verifies 'digest' has the size produced by the algorithm registered as 'algorithm'.
+func checkDigest(algorithm string, digest []byte) error {
+	hashfn, err := LookupHash(algorithm)
+	if err != nil {
+		return fmt.Errorf("%w %q", err, algorithm)
+	}
+	if size := hashfn().Size(); len(digest) != size {
+		return fmt.Errorf("%w: %s digest must be %d bytes, got %d", ErrInvalidEncoding, algorithm, size, len(digest))
+	}
+	return nil
+}
+
+// Root is a merkle root together with the name of the hash algorithm that produced it.
+// Its text form is "<algorithm>:<hex digest>", e.g. "sha256:9f86d0...".
+type Root struct {
+	Algorithm string
+	Hash      []byte
+}
+
+// Root returns the root hash of the tree tagged with its hash algorithm.
+// Algorithm is empty when the tree's hash function was never registered with RegisterHash.
+func (mt *MerkleTree) Root() Root {
+	return Root{Algorithm: mt.algorithm, Hash: mt.GetRootHash()}
+}
+
+// Root returns the merkle root in internal byte order tagged as double SHA-256.
+func (bt *BitcoinTree) Root() Root {
+	return Root{Algorithm: AlgorithmSHA256D, Hash: bt.GetRootHash()}
+}
+
+// Equal reports whether both roots have the same algorithm and digest.
+func (r Root) Equal(o Root) bool {
+	return r.Algorithm == o.Algorithm && bytes.Equal(r.Hash, o.Hash)
+}
+
+func (r Root) String() string {
+	return r.Algorithm + ":" + hex.EncodeToString(r.Hash)
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (r Root) MarshalText() ([]byte, error) {
+	if err := checkDigest(r.Algorithm, r.Hash); err != nil {
+		return nil, err
+	}
+	return []byte(r.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (r *Root) UnmarshalText(text []byte) error {
+	algorithm, digest, ok := strings.Cut(string(text), ":")
+	if !ok {
+		return fmt.Errorf("%w: root %q is not <algorithm>:<hex>", ErrInvalidEncoding, text)
+	}
+	var h hexBytes
+	if err := h.UnmarshalText([]byte(digest)); err != nil {
+		return err
+	}
+	if err := checkDigest(algorithm, h); err != nil {
+		return err
+	}
+	r.Algorithm, r.Hash = algorithm, h
+	return nil
+}
+
+type rootJSON struct {
+	Algorithm string   `json:"algorithm"`
+	Hash      hexBytes `json:"hash"`
+}
+
+// MarshalJSON implements json.Marshaler.
+func (r Root) MarshalJSON() ([]byte, error) {
+	if err := checkDigest(r.Algorithm, r.Hash); err != nil {
+		return nil, err
+	}
+	return json.Marshal(rootJSON{Algorithm: r.Algorithm, Hash: r.Hash})
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (r *Root) UnmarshalJSON(data []byte) error {
+	var v rootJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	if err := checkDigest(v.Algorithm, v.Hash); err != nil {
+		return err
+	}
+	r.Algorithm, r.Hash = v.Algorithm, v.Hash
+	return nil
+}
+
+// Metadata describes how a MerkleTree was built, without its data.
+// Its text form is "<algorithm>:<segment size>:<data size>:<hex root>",
+// followed by ":arity=<arity>" for trees other than binary ones, by
+// ":shape=<shape>" for shapes other than ShapeBytes, by ":key=<key ID>"
+// for keyed trees and by ":salt=<hex salt>" for salted ones.
+// A record tree has no segment size and its size counts records.
+type Metadata struct {
+	Algorithm   string
+	SegmentSize uint64
+	Size        uint64
+	Root        []byte
+	// Arity is the number of children per node, zero for binary trees.
+	Arity int
+	Shape Shape
+	// KeyID identifies the key of a keyed tree, empty for others. The key
+	// itself is never part of the metadata.
+	KeyID string
+	// Salt is the tree's salt, empty when unsalted.
+	Salt []byte
+}
+
+// Metadata returns the tree's metadata.
+func (mt *MerkleTree) Metadata() Metadata {
+	m := Metadata{
+		Algorithm:   mt.algorithm,
+		SegmentSize: mt.segmentSize,
+		Size:        uint64(mt.size),
+		Root:        mt.GetRootHash(),
+	}
+	if mt.records {
+		m.SegmentSize = 0
+	}
+	if mt.arity != 2 {
+		m.Arity = int(mt.arity)
+	}
+	m.Shape = mt.shape
+	m.KeyID = mt.keyID
+	if mt.salt != nil {
+		m.Salt = append([]byte(nil), mt.salt...)
+	}
+	return m
+}
+
+func (m Metadata) validate() error {
+	if m.SegmentSize == 0 && m.Size == 0 {
+		return fmt.Errorf("%w: record tree without records", ErrInvalidEncoding)
+	}
+	if m.Arity != 0 && (m.Arity < 2 || m.Arity > maxArity) {
+		return fmt.Errorf("%w: arity %d", ErrInvalidEncoding, m.Arity)
+	}
+	if _, err := m.Shape.MarshalText(); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidEncoding, err)
+	}
+	if m.KeyID != "" && !validKeyID(m.KeyID) {
+		return fmt.Errorf("%w: key ID %q", ErrInvalidEncoding, m.KeyID)
+	}
+	if len(m.Salt) > maxSaltSize {
+		return fmt.Errorf("%w: salt of %d bytes", ErrInvalidEncoding, len(m.Salt))
+	}
+	return checkDigest(m.Algorithm, m.Root)
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (m Metadata) MarshalText() ([]byte, error) {
+	if err := m.validate(); err != nil {
+		return nil, err
+	}
+	text := fmt.Sprintf("%s:%d:%d:%x", m.Algorithm, m.SegmentSize, m.Size, m.Root)
+	if m.Arity != 0 {
+		text += fmt.Sprintf(":arity=%d", m.Arity)
+	}
+	if m.Shape != ShapeBytes {
+		text += ":shape=" + m.Shape.String()
+	}
+	if m.KeyID != "" {
+		text += ":key=" + m.KeyID
+	}
+	if len(m.Salt) > 0 {
+		text += fmt.Sprintf(":salt=%x", m.Salt)
+	}
+	return []byte(text), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (m *Metadata) UnmarshalText(text []byte) error {
+	parts := strings.Split(string(text), ":")
+	if len(parts) < 4 {
+		return fmt.Errorf("%w: metadata %q is not <algorithm>:<segment size>:<size>:<hex root>", ErrInvalidEncoding, text)
+	}
+	segmentSize, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidEncoding, err)
+	}
+	size, err := strconv.ParseUint(parts[2], 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidEncoding, err)
+	}
+	var root hexBytes
+	if err := root.UnmarshalText([]byte(parts[3])); err != nil {
+		return err
+	}
+	v := Metadata{Algorithm: parts[0], SegmentSize: segmentSize, Size: size, Root: root}
+	for _, option := range parts[4:] {
+		key, value, _ := strings.Cut(option, "=")
+		switch key {
+		case "arity":
+			arity, err := strconv.ParseUint(value, 10, 16)
+			if err != nil {
+				return fmt.Errorf("%w: %v", ErrInvalidEncoding, err)
+			}
+			v.Arity = int(arity)
+		case "shape":
+			if err := v.Shape.UnmarshalText([]byte(value)); err != nil {
+				return fmt.Errorf("%w: %v", ErrInvalidEncoding, err)
+			}
+		case "key":
+			v.KeyID = value
+		case "salt":
+			var salt hexBytes
+			if err := salt.UnmarshalText([]byte(value)); err != nil {
+				return err
+			}
+			v.Salt = salt
+		default:
+			return fmt.Errorf("%w: unknown metadata option %q", ErrInvalidEncoding, option)
+		}
+	}
+	if err := v.validate(); err != nil {
+		return err
+	}
+	*m = v
+	return nil
+}
+
+type metadataJSON struct {
+	Algorithm   string   `json:"algorithm"`
+	SegmentSize uint64   `json:"segmentSize"`
+	Size        uint64   `json:"size"`
+	Root        hexBytes `json:"root"`
+	Arity       int      `json:"arity,omitempty"`
+	Shape       Shape    `json:"shape,omitempty"`
+	KeyID       string   `json:"keyId,omitempty"`
+	Salt        hexBytes `json:"salt,omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler.
+func (m Metadata) MarshalJSON() ([]byte, error) {
+	if err := m.validate(); err != nil {
+		return nil, err
+	}
+	return json.Marshal(metadataJSON{Algorithm: m.Algorithm, SegmentSize: m.SegmentSize, Size: m.Size, Root: m.Root, Arity: m.Arity, Shape: m.Shape, KeyID: m.KeyID, Salt: m.Salt})
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (m *Metadata) UnmarshalJSON(data []byte) error {
+	var v metadataJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	meta := Metadata{Algorithm: v.Algorithm, SegmentSize: v.SegmentSize, Size: v.Size, Root: v.Root, Arity: v.Arity, Shape: v.Shape, KeyID: v.KeyID, Salt: v.Salt}
+	if err := meta.validate(); err != nil {
+		return err
+	}
+	*m = meta
+	return nil
+}
+
+type partialMerkleTreeJSON struct {
+	Algorithm    string     `json:"algorithm"`
+	Transactions uint32     `json:"transactions"`
+	Hashes       []hexBytes `json:"hashes"`
+	Flags        []bool     `json:"flags"`
+}
+
+func (pmt *PartialMerkleTree) toJSON() partialMerkleTreeJSON {
+	v := partialMerkleTreeJSON{
+		Algorithm:    AlgorithmSHA256D,
+		Transactions: pmt.Transactions,
+		Hashes:       make([]hexBytes, len(pmt.Hashes)),
+		Flags:        pmt.Flags,
+	}
+	for i, h := range pmt.Hashes {
+		v.Hashes[i] = h
+	}
+	return v
+}
+
+func (v partialMerkleTreeJSON) toTree() (PartialMerkleTree, error) {
+	if v.Algorithm != AlgorithmSHA256D {
+		return PartialMerkleTree{}, fmt.Errorf("%w %q for a partial merkle tree", ErrUnknownHash, v.Algorithm)
+	}
+	pmt := PartialMerkleTree{Transactions: v.Transactions, Hashes: make([][]byte, len(v.Hashes)), Flags: v.Flags}
+	for i, h := range v.Hashes {
+		if err := checkDigest(AlgorithmSHA256D, h); err != nil {
+			return PartialMerkleTree{}, err
+		}
+		pmt.Hashes[i] = h
+	}
+	return pmt, nil
+}
+
+// MarshalJSON implements json.Marshaler. Hashes are hex encoded in internal byte order.
+func (pmt *PartialMerkleTree) MarshalJSON() ([]byte, error) {
+	return json.Marshal(pmt.toJSON())
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (pmt *PartialMerkleTree) UnmarshalJSON(data []byte) error {
+	var v partialMerkleTreeJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	tree, err := v.toTree()
+	if err != nil {
+		return err
+	}
+	*pmt = tree
+	return nil
+}
+
+// MarshalText implements encoding.TextMarshaler as the hex of the BIP37 wire format.
+func (pmt *PartialMerkleTree) MarshalText() ([]byte, error) {
+	b, err := pmt.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return hexBytes(b).MarshalText()
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (pmt *PartialMerkleTree) UnmarshalText(text []byte) error {
+	var b hexBytes
+	if err := b.UnmarshalText(text); err != nil {
+		return err
+	}
+	return pmt.UnmarshalBinary(b)
+}
+
+type merkleBlockJSON struct {
+	Header hexBytes              `json:"header"`
+	Tree   partialMerkleTreeJSON `json:"tree"`
+}
+
+// MarshalJSON implements json.Marshaler.
+func (mb *MerkleBlock) MarshalJSON() ([]byte, error) {
+	return json.Marshal(merkleBlockJSON{Header: mb.Header[:], Tree: mb.Tree.toJSON()})
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (mb *MerkleBlock) UnmarshalJSON(data []byte) error {
+	var v merkleBlockJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	if len(v.Header) != BlockHeaderSize {
+		return fmt.Errorf("%w: block header must be %d bytes", ErrInvalidEncoding, BlockHeaderSize)
+	}
+	tree, err := v.Tree.toTree()
+	if err != nil {
+		return err
+	}
+	copy(mb.Header[:], v.Header)
+	mb.Tree = tree
+	return nil
+}
+
+// MarshalText implements encoding.TextMarshaler as the hex of the BIP37 wire
+// format, the same encoding bitcoind's gettxoutproof returns.
+func (mb *MerkleBlock) MarshalText() ([]byte, error) {
+	b, err := mb.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return hexBytes(b).MarshalText()
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (mb *MerkleBlock) UnmarshalText(text []byte) error {
+	var b hexBytes
+	if err := b.UnmarshalText(text); err != nil {
+		return err
+	}
+	return mb.UnmarshalBinary(b)
+}
+
+type proofJSON struct {
+	Algorithm string     `json:"algorithm"`
+	KeyID     string     `json:"keyId,omitempty"`
+	Index     uint64     `json:"index"`
+	Siblings  []hexBytes `json:"siblings"`
+}
+
+func (p *Proof) validate() error {
+	if p.KeyID != "" && !validKeyID(p.KeyID) {
+		return fmt.Errorf("%w: key ID %q", ErrInvalidEncoding, p.KeyID)
+	}
+	for _, sibling := range p.Siblings {
+		if err := checkDigest(p.Algorithm, sibling); err != nil {
+			return err
+		}
+	}
+	if _, err := LookupHash(p.Algorithm); err != nil {
+		return fmt.Errorf("%w %q", err, p.Algorithm)
+	}
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler.
+func (p *Proof) MarshalJSON() ([]byte, error) {
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+	v := proofJSON{Algorithm: p.Algorithm, KeyID: p.KeyID, Index: p.Index, Siblings: make([]hexBytes, len(p.Siblings))}
+	for i, sibling := range p.Siblings {
+		v.Siblings[i] = sibling
+	}
+	return json.Marshal(v)
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (p *Proof) UnmarshalJSON(data []byte) error {
+	var v proofJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	proof := Proof{Algorithm: v.Algorithm, KeyID: v.KeyID, Index: v.Index, Siblings: make([][]byte, len(v.Siblings))}
+	for i, sibling := range v.Siblings {
+		proof.Siblings[i] = sibling
+	}
+	if err := proof.validate(); err != nil {
+		return err
+	}
+	*p = proof
+	return nil
+}
+
+// MarshalText implements encoding.TextMarshaler.
+// The text form is "<algorithm>:<index>:<hex sibling>,<hex sibling>,...",
+// followed by ":key=<key ID>" for keyed trees.
+func (p *Proof) MarshalText() ([]byte, error) {
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+	siblings := make([]string, len(p.Siblings))
+	for i, sibling := range p.Siblings {
+		siblings[i] = hex.EncodeToString(sibling)
+	}
+	return []byte(fmt.Sprintf("%s:%d:%s", p.Algorithm, p.Index, strings.Join(siblings, ",")) + keySuffix(p.KeyID)), nil
+}
+
+// keySuffix returns the ":key=<key ID>" ending the text form of keyed proofs.
+func keySuffix(keyID string) string {
+	if keyID == "" {
+		return ""
+	}
+	return ":key=" + keyID
+}
+
+// cutKeySuffix splits the optional ":key=<key ID>" off the text form of a proof with 'fields' fields.
+func cutKeySuffix(parts []string, fields int) ([]string, string, bool) {
+	switch {
+	case len(parts) == fields:
+		return parts, "", true
+	case len(parts) == fields+1 && strings.HasPrefix(parts[fields], "key="):
+		return parts[:fields], strings.TrimPrefix(parts[fields], "key="), true
+	}
+	return nil, "", false
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (p *Proof) UnmarshalText(text []byte) error {
+	parts, keyID, ok := cutKeySuffix(strings.Split(string(text), ":"), 3)
+	if !ok {
+		return fmt.Errorf("%w: proof %q is not <algorithm>:<index>:<siblings>", ErrInvalidEncoding, text)
+	}
+	index, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidEncoding, err)
+	}
+	proof := Proof{Algorithm: parts[0], KeyID: keyID, Index: index, Siblings: [][]byte{}}
+	if parts[2] != "" {
+		for _, s := range strings.Split(parts[2], ",") {
+			var sibling hexBytes
+			if err := sibling.UnmarshalText([]byte(s)); err != nil {
+				return err
+			}
+			proof.Siblings = append(proof.Siblings, sibling)
+		}
+	}
+	if err := proof.validate(); err != nil {
+		return err
+	}
+	*p = proof
+	return nil
+}
+
+type rangeProofJSON struct {
+	Algorithm string     `json:"algorithm"`
+	KeyID     string     `json:"keyId,omitempty"`
+	Start     uint64     `json:"start"`
+	End       uint64     `json:"end"`
+	Hashes    []hexBytes `json:"hashes"`
+}
+
+func (p *RangeProof) validate() error {
+	if _, err := LookupHash(p.Algorithm); err != nil {
+		return fmt.Errorf("%w %q", err, p.Algorithm)
+	}
+	if p.Start >= p.End {
+		return fmt.Errorf("%w: empty range [%d, %d)", ErrInvalidEncoding, p.Start, p.End)
+	}
+	if p.KeyID != "" && !validKeyID(p.KeyID) {
+		return fmt.Errorf("%w: key ID %q", ErrInvalidEncoding, p.KeyID)
+	}
+	for _, h := range p.Hashes {
+		if err := checkDigest(p.Algorithm, h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler.
+func (p *RangeProof) MarshalJSON() ([]byte, error) {
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+	v := rangeProofJSON{Algorithm: p.Algorithm, KeyID: p.KeyID, Start: p.Start, End: p.End, Hashes: make([]hexBytes, len(p.Hashes))}
+	for i, h := range p.Hashes {
+		v.Hashes[i] = h
+	}
+	return json.Marshal(v)
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (p *RangeProof) UnmarshalJSON(data []byte) error {
+	var v rangeProofJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	proof := RangeProof{Algorithm: v.Algorithm, KeyID: v.KeyID, Start: v.Start, End: v.End, Hashes: make([][]byte, len(v.Hashes))}
+	for i, h := range v.Hashes {
+		proof.Hashes[i] = h
+	}
+	if err := proof.validate(); err != nil {
+		return err
+	}
+	*p = proof
+	return nil
+}
+
+// MarshalText implements encoding.TextMarshaler.
+// The text form is "<algorithm>:<start>-<end>:<hex hash>,<hex hash>,...",
+// followed by ":key=<key ID>" for keyed trees.
+func (p *RangeProof) MarshalText() ([]byte, error) {
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+	hashes := make([]string, len(p.Hashes))
+	for i, h := range p.Hashes {
+		hashes[i] = hex.EncodeToString(h)
+	}
+	return []byte(fmt.Sprintf("%s:%d-%d:%s", p.Algorithm, p.Start, p.End, strings.Join(hashes, ",")) + keySuffix(p.KeyID)), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (p *RangeProof) UnmarshalText(text []byte) error {
+	parts, keyID, ok := cutKeySuffix(strings.Split(string(text), ":"), 3)
+	if !ok {
+		return fmt.Errorf("%w: range proof %q is not <algorithm>:<start>-<end>:<hashes>", ErrInvalidEncoding, text)
+	}
+	from, to, ok := strings.Cut(parts[1], "-")
+	if !ok {
+		return fmt.Errorf("%w: range %q is not <start>-<end>", ErrInvalidEncoding, parts[1])
+	}
+	start, err := strconv.ParseUint(from, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidEncoding, err)
+	}
+	end, err := strconv.ParseUint(to, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidEncoding, err)
+	}
+	proof := RangeProof{Algorithm: parts[0], KeyID: keyID, Start: start, End: end, Hashes: [][]byte{}}
+	if parts[2] != "" {
+		for _, s := range strings.Split(parts[2], ",") {
+			var h hexBytes
+			if err := h.UnmarshalText([]byte(s)); err != nil {
+				return err
+			}
+			proof.Hashes = append(proof.Hashes, h)
+		}
+	}
+	if err := proof.validate(); err != nil {
+		return err
+	}
+	*p = proof
+	return nil
+}
+
+type inclusionProofJSON struct {
+	Algorithm string     `json:"algorithm"`
+	Index     uint64     `json:"index"`
+	TreeSize  uint64     `json:"treeSize"`
+	Hashes    []hexBytes `json:"hashes"`
+}
+
+func validateLogHashes(algorithm string, hashes [][]byte) error {
+	if _, err := LookupHash(algorithm); err != nil {
+		return fmt.Errorf("%w %q", err, algorithm)
+	}
+	for _, h := range hashes {
+		if err := checkDigest(algorithm, h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler.
+func (p *InclusionProof) MarshalJSON() ([]byte, error) {
+	if err := validateLogHashes(p.Algorithm, p.Hashes); err != nil {
+		return nil, err
+	}
+	v := inclusionProofJSON{Algorithm: p.Algorithm, Index: p.Index, TreeSize: p.TreeSize, Hashes: make([]hexBytes, len(p.Hashes))}
+	for i, h := range p.Hashes {
+		v.Hashes[i] = h
+	}
+	return json.Marshal(v)
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (p *InclusionProof) UnmarshalJSON(data []byte) error {
+	var v inclusionProofJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	proof := InclusionProof{Algorithm: v.Algorithm, Index: v.Index, TreeSize: v.TreeSize, Hashes: make([][]byte, len(v.Hashes))}
+	for i, h := range v.Hashes {
+		proof.Hashes[i] = h
+	}
+	if err := validateLogHashes(proof.Algorithm, proof.Hashes); err != nil {
+		return err
+	}
+	*p = proof
+	return nil
+}
+
+type consistencyProofJSON struct {
+	Algorithm string     `json:"algorithm"`
+	OldSize   uint64     `json:"oldSize"`
+	NewSize   uint64     `json:"newSize"`
+	Hashes    []hexBytes `json:"hashes"`
+}
+
+// MarshalJSON implements json.Marshaler.
+func (p *ConsistencyProof) MarshalJSON() ([]byte, error) {
+	if err := validateLogHashes(p.Algorithm, p.Hashes); err != nil {
+		return nil, err
+	}
+	v := consistencyProofJSON{Algorithm: p.Algorithm, OldSize: p.OldSize, NewSize: p.NewSize, Hashes: make([]hexBytes, len(p.Hashes))}
+	for i, h := range p.Hashes {
+		v.Hashes[i] = h
+	}
+	return json.Marshal(v)
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (p *ConsistencyProof) UnmarshalJSON(data []byte) error {
+	var v consistencyProofJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	proof := ConsistencyProof{Algorithm: v.Algorithm, OldSize: v.OldSize, NewSize: v.NewSize, Hashes: make([][]byte, len(v.Hashes))}
+	for i, h := range v.Hashes {
+		proof.Hashes[i] = h
+	}
+	if err := validateLogHashes(proof.Algorithm, proof.Hashes); err != nil {
+		return err
+	}
+	*p = proof
+	return nil
+}
+
+type signedTreeHeadJSON struct {
+	Algorithm string   `json:"algorithm"`
+	TreeSize  uint64   `json:"treeSize"`
+	Timestamp int64    `json:"timestamp"` // milliseconds since the Unix epoch
+	Root      hexBytes `json:"root"`
+	KeyID     hexBytes `json:"keyId"`
+	Signature hexBytes `json:"signature"`
+}
+
+func (sth *SignedTreeHead) validate() error {
+	if err := checkDigest(sth.Algorithm, sth.Root); err != nil {
+		return err
+	}
+	if len(sth.KeyID) != sha256.Size {
+		return fmt.Errorf("%w: key id must be %d bytes, got %d", ErrInvalidEncoding, sha256.Size, len(sth.KeyID))
+	}
+	if len(sth.Signature) != ed25519.SignatureSize {
+		return fmt.Errorf("%w: signature must be %d bytes, got %d", ErrInvalidEncoding, ed25519.SignatureSize, len(sth.Signature))
+	}
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler.
+func (sth *SignedTreeHead) MarshalJSON() ([]byte, error) {
+	if err := sth.validate(); err != nil {
+		return nil, err
+	}
+	return json.Marshal(signedTreeHeadJSON{
+		Algorithm: sth.Algorithm,
+		TreeSize:  sth.TreeSize,
+		Timestamp: sth.Timestamp.UnixMilli(),
+		Root:      sth.Root,
+		KeyID:     sth.KeyID,
+		Signature: sth.Signature,
+	})
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (sth *SignedTreeHead) UnmarshalJSON(data []byte) error {
+	var v signedTreeHeadJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	head := SignedTreeHead{
+		Algorithm: v.Algorithm,
+		TreeSize:  v.TreeSize,
+		Timestamp: time.UnixMilli(v.Timestamp).UTC(),
+		Root:      v.Root,
+		KeyID:     v.KeyID,
+		Signature: v.Signature,
+	}
+	if err := head.validate(); err != nil {
+		return err
+	}
+	*sth = head
+	return nil
+}
@@ -0,0 +1,130 @@
+package merkletree
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"math/bits"
+)
+
+const (
+	fsVerityDescriptorSize = 256
+	fsVerityMaxSaltSize    = 32
+)
+
+// fsVerityAlgorithms maps supported hash names to FS_VERITY_HASH_ALG_* values.
+var fsVerityAlgorithms = map[string]uint8{
+	"sha256": 1,
+	"sha512": 2,
+}
+
+// FSVerityParams describes how the fs-verity Merkle tree of a file is built.
+type FSVerityParams struct {
+	// Algorithm is "sha256" or "sha512", "sha256" when empty.
+	Algorithm string
+	// BlockSize is the size of data and tree blocks, 4096 when zero.
+	BlockSize uint32
+	Salt      []byte
+}
+
+// fsVerity is an fs-verity tree over a file.
+type fsVerity struct {
+	*verity
+	FSVerityParams
+	hashfn        func() hash.Hash
+	hashAlgorithm uint8
+	digestSize    int
+}
+
+func newFSVerity(p FSVerityParams, size int64) (*fsVerity, error) {
+	if p.Algorithm == "" {
+		p.Algorithm = "sha256"
+	}
+	if p.BlockSize == 0 {
+		p.BlockSize = 4096
+	}
+	if p.BlockSize < 1024 || p.BlockSize&(p.BlockSize-1) != 0 {
+		return nil, fmt.Errorf("merkletree: fs-verity block size %d is not a power of two of at least 1024", p.BlockSize)
+	}
+	if len(p.Salt) > fsVerityMaxSaltSize {
+		return nil, fmt.Errorf("merkletree: fs-verity salt longer than %d bytes", fsVerityMaxSaltSize)
+	}
+	if size < 0 {
+		return nil, fmt.Errorf("merkletree: negative file size %d", size)
+	}
+	alg, ok := fsVerityAlgorithms[p.Algorithm]
+	if !ok {
+		return nil, fmt.Errorf("%w %q for fs-verity", ErrUnknownHash, p.Algorithm)
+	}
+	hashfn, err := LookupHash(p.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	// the salt is zero padded to the hash's block size so that it fills whole
+	// compression blocks and can be hashed once
+	salt := p.Salt
+	if len(salt) > 0 {
+		blockSize := hashfn().BlockSize()
+		salt = make([]byte, (len(p.Salt)+blockSize-1)/blockSize*blockSize)
+		copy(salt, p.Salt)
+	}
+
+	v := &fsVerity{FSVerityParams: p, hashfn: hashfn, hashAlgorithm: alg, digestSize: hashfn().Size()}
+	if size > 0 {
+		v.verity, err = newVerityTree(hasher{newHash: hashfn}, size, p.BlockSize, p.BlockSize, v.digestSize, salt, 0)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+// FSVerityFormat writes the fs-verity Merkle tree of the first 'size' bytes of
+// 'data' to 'tree', with the top level first as the kernel stores it, and
+// returns the root hash. An empty file has no tree and an all zero root hash.
+func FSVerityFormat(data io.ReaderAt, size int64, tree VerityDevice, p FSVerityParams) ([]byte, error) {
+	v, err := newFSVerity(p, size)
+	if err != nil {
+		return nil, err
+	}
+	return v.root(data, tree)
+}
+
+func (v *fsVerity) root(data io.ReaderAt, tree VerityDevice) ([]byte, error) {
+	if v.verity == nil {
+		return make([]byte, v.digestSize), nil
+	}
+	return v.createOrVerify(data, tree, false)
+}
+
+// descriptor returns the fs-verity descriptor of a file of 'size' bytes with the given root hash.
+func (v *fsVerity) descriptor(size int64, root []byte) []byte {
+	d := make([]byte, fsVerityDescriptorSize)
+	d[0] = 1
+	d[1] = v.hashAlgorithm
+	d[2] = uint8(bits.TrailingZeros32(v.BlockSize))
+	d[3] = uint8(len(v.Salt))
+	binary.LittleEndian.PutUint64(d[8:], uint64(size))
+	copy(d[16:80], root)
+	copy(d[80:112], v.Salt)
+	return d
+}
+
+// FSVerityDigest returns the fs-verity file digest of the first 'size' bytes
+// of 'data', the value the kernel reports for FS_IOC_MEASURE_VERITY.
+// The tree is built in memory; use FSVerityFormat to keep it elsewhere.
+func FSVerityDigest(data io.ReaderAt, size int64, p FSVerityParams) ([]byte, error) {
+	v, err := newFSVerity(p, size)
+	if err != nil {
+		return nil, err
+	}
+	root, err := v.root(data, &memoryDevice{})
+	if err != nil {
+		return nil, err
+	}
+	d := v.hashfn()
+	_, _ = d.Write(v.descriptor(size, root))
+	return d.Sum(nil), nil
+}
@@ -0,0 +1,112 @@
+package merkletree
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"hash"
+	"reflect"
+	"sync"
+)
+
+// ErrUnknownHash is returned when a hash function or algorithm name is not registered.
+var ErrUnknownHash = errors.New("merkletree: unknown hash algorithm")
+
+// AlgorithmSHA256D is the name of Bitcoin's double SHA-256.
+const AlgorithmSHA256D = "sha256d"
+
+var hashRegistry = struct {
+	sync.RWMutex
+	byName map[string]func() hash.Hash
+	// byFunc is empty for functions registered under several names.
+	byFunc map[uintptr]string
+}{
+	byName: map[string]func() hash.Hash{},
+	byFunc: map[uintptr]string{},
+}
+
+func init() {
+	RegisterHash("sha1", sha1.New)
+	RegisterHash("sha224", sha256.New224)
+	RegisterHash("sha256", sha256.New)
+	RegisterHash("sha384", sha512.New384)
+	RegisterHash("sha512", sha512.New)
+	RegisterHash("sha512/256", sha512.New512_256)
+	RegisterHash(AlgorithmSHA256D, newDoubleSHA256)
+}
+
+// RegisterHash makes 'hashfn' known under 'name', so trees built with it
+// can be encoded and decoded with an explicit algorithm.
+func RegisterHash(name string, hashfn func() hash.Hash) {
+	hashRegistry.Lock()
+	defer hashRegistry.Unlock()
+	hashRegistry.byName[name] = hashfn
+	ptr := reflect.ValueOf(hashfn).Pointer()
+	if registered, ok := hashRegistry.byFunc[ptr]; ok && registered != name {
+		name = ""
+	}
+	hashRegistry.byFunc[ptr] = name
+}
+
+// LookupHash returns the hash function registered under 'name'.
+func LookupHash(name string) (func() hash.Hash, error) {
+	hashRegistry.RLock()
+	defer hashRegistry.RUnlock()
+	hashfn, ok := hashRegistry.byName[name]
+	if !ok {
+		return nil, ErrUnknownHash
+	}
+	return hashfn, nil
+}
+
+// HashName returns the name 'hashfn' was registered under. Functions are
+// told apart by their code, so closures of one function literal, or method
+// values of one method, registered under different names have no name:
+// build trees over them with Config.Algorithm instead.
+func HashName(hashfn func() hash.Hash) (string, error) {
+	hashRegistry.RLock()
+	defer hashRegistry.RUnlock()
+	name, ok := hashRegistry.byFunc[reflect.ValueOf(hashfn).Pointer()]
+	if !ok || name == "" {
+		return "", ErrUnknownHash
+	}
+	return name, nil
+}
+
+// resolveHash returns the name and function of the hash registered as
+// 'name' or, when 'name' is empty, those of 'hashfn', sha256.New when nil.
+// 'hashfn' overrides the registered function, and an unregistered one has no name.
+func resolveHash(name string, hashfn func() hash.Hash) (string, func() hash.Hash, error) {
+	switch {
+	case name != "":
+		registered, err := LookupHash(name)
+		if err != nil {
+			return "", nil, fmt.Errorf("%w %q", err, name)
+		}
+		if hashfn == nil {
+			hashfn = registered
+		}
+	case hashfn == nil:
+		name, hashfn = "sha256", sha256.New
+	default:
+		name, _ = HashName(hashfn)
+	}
+	return name, hashfn, nil
+}
+
+// doubleSHA256Hash is SHA-256 applied twice, as used by Bitcoin.
+type doubleSHA256Hash struct {
+	hash.Hash
+}
+
+func newDoubleSHA256() hash.Hash {
+	return doubleSHA256Hash{sha256.New()}
+}
+
+func (d doubleSHA256Hash) Sum(b []byte) []byte {
+	first := d.Hash.Sum(nil)
+	second := sha256.Sum256(first)
+	return append(b, second[:]...)
+}
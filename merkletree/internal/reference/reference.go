@@ -0,0 +1,147 @@
+// Package reference is a deliberately simple and slow merkle tree that tests
+// compare the merkletree package against. Every node is an allocated struct
+// and every question is answered by walking the whole tree.
+package reference
+
+import "hash"
+
+// Node is a node of a reference tree.
+type Node struct {
+	Hash     []byte
+	Children []*Node
+	// Padding marks the all-zero leaves that fill a complete tree.
+	Padding bool
+}
+
+// Bytes returns the tree over 'data' split by bytes into 'arity' parts, or
+// one per byte when shorter, until every leaf holds at most 'segmentSize'
+// bytes, leaves hashing their bytes and nodes the concatenation of their
+// children's digests.
+func Bytes(data []byte, segmentSize, arity int, newHash func() hash.Hash) *Node {
+	if len(data) <= segmentSize {
+		return &Node{Hash: sum(newHash, data)}
+	}
+	n := min(arity, len(data))
+	children := make([]*Node, n)
+	for i := range children {
+		children[i] = Bytes(data[i*len(data)/n:(i+1)*len(data)/n], segmentSize, arity, newHash)
+	}
+	return parent(newHash, children)
+}
+
+// Records returns the tree with one leaf per record, split by record count.
+func Records(records [][]byte, arity int, newHash func() hash.Hash) *Node {
+	if len(records) == 1 {
+		return &Node{Hash: sum(newHash, records[0])}
+	}
+	n := min(arity, len(records))
+	children := make([]*Node, n)
+	for i := range children {
+		children[i] = Records(records[i*len(records)/n:(i+1)*len(records)/n], arity, newHash)
+	}
+	return parent(newHash, children)
+}
+
+// Segments cuts 'data' into leaves of 'segmentSize' bytes, the last one
+// possibly shorter, or a single empty leaf when there is no data.
+func Segments(data []byte, segmentSize int) [][]byte {
+	segments := [][]byte{data[:min(segmentSize, len(data))]}
+	for start := segmentSize; start < len(data); start += segmentSize {
+		segments = append(segments, data[start:min(start+segmentSize, len(data))])
+	}
+	return segments
+}
+
+// LeftBalanced returns the tree with one leaf per record whose nodes put as
+// many records in each child as the largest power of 'arity' below their count.
+func LeftBalanced(records [][]byte, arity int, newHash func() hash.Hash) *Node {
+	if len(records) == 1 {
+		return &Node{Hash: sum(newHash, records[0])}
+	}
+	per := 1
+	for per*arity < len(records) {
+		per *= arity
+	}
+	var children []*Node
+	for start := 0; start < len(records); start += per {
+		children = append(children, LeftBalanced(records[start:min(start+per, len(records))], arity, newHash))
+	}
+	return parent(newHash, children)
+}
+
+// Complete returns the tree with one leaf per record, padded with all-zero
+// leaves to a power of 'arity' leaves, every node having 'arity' children.
+func Complete(records [][]byte, arity int, newHash func() hash.Hash) *Node {
+	var leaves []*Node
+	for _, record := range records {
+		leaves = append(leaves, &Node{Hash: sum(newHash, record)})
+	}
+	padded := 1
+	for padded < len(leaves) {
+		padded *= arity
+	}
+	for len(leaves) < padded {
+		leaves = append(leaves, &Node{Hash: make([]byte, newHash().Size()), Padding: true})
+	}
+	for len(leaves) > 1 {
+		var level []*Node
+		for start := 0; start < len(leaves); start += arity {
+			level = append(level, parent(newHash, leaves[start:start+arity]))
+		}
+		leaves = level
+	}
+	return leaves[0]
+}
+
+func parent(newHash func() hash.Hash, children []*Node) *Node {
+	digests := make([][]byte, len(children))
+	for i, c := range children {
+		digests[i] = c.Hash
+	}
+	return &Node{Hash: sum(newHash, digests...), Children: children}
+}
+
+func sum(newHash func() hash.Hash, parts ...[]byte) []byte {
+	h := newHash()
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return h.Sum(nil)
+}
+
+// Leaves returns the leaves from left to right, without padding.
+func (n *Node) Leaves() []*Node {
+	if n.Padding {
+		return nil
+	}
+	if n.Children == nil {
+		return []*Node{n}
+	}
+	var leaves []*Node
+	for _, c := range n.Children {
+		leaves = append(leaves, c.Leaves()...)
+	}
+	return leaves
+}
+
+// Proof returns the digests next to the path from leaf 'index' to the root,
+// starting at the leaf and from left to right within a level.
+func (n *Node) Proof(index int) [][]byte {
+	if n.Children == nil {
+		return nil
+	}
+	for i, c := range n.Children {
+		if leaves := len(c.Leaves()); index >= leaves {
+			index -= leaves
+			continue
+		}
+		proof := c.Proof(index)
+		for j, sibling := range n.Children {
+			if j != i {
+				proof = append(proof, sibling.Hash)
+			}
+		}
+		return proof
+	}
+	return nil
+}
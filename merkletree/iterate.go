@@ -0,0 +1,163 @@
+package merkletree
+
+import "iter"
+
+// Node is a node of a tree as walked by the iterators.
+type Node struct {
+	// Pos is the node's position in the store.
+	Pos uint64
+	// Depth is the number of edges between the node and the root.
+	Depth int
+	// Start and End delimit the bytes the node covers, or its records in a
+	// record tree. In a complete tree they extend past the data over padding.
+	Start, End uint64
+	// FirstLeaf is the index of the leftmost leaf under the node.
+	FirstLeaf uint64
+	Leaf      bool
+	// Hash is nil when the store cannot read the node.
+	Hash []byte
+}
+
+// Order is the order in which Nodes walks a tree.
+type Order int
+
+const (
+	// DepthFirst visits every node before its children, left subtree first.
+	DepthFirst Order = iota
+	// BreadthFirst visits the nodes level by level, from left to right.
+	BreadthFirst
+)
+
+// LeafCount returns the number of leaves, not counting the padding of complete trees.
+func (mt *MerkleTree) LeafCount() uint64 {
+	return mt.leaves()
+}
+
+// NodeCount returns the number of nodes, leaves and padding included.
+func (mt *MerkleTree) NodeCount() uint64 {
+	return mt.nodeCount(mt.extent())
+}
+
+// Depth returns the number of edges on the longest path from the root to a
+// leaf, zero for a tree of a single leaf.
+func (mt *MerkleTree) Depth() int {
+	// a longer subtree is never shallower, so the path through the longest children is the longest
+	depth := 0
+	for length := mt.extent(); !mt.isLeaf(0, length); depth++ {
+		var longest uint64
+		for _, c := range mt.childRanges(0, length) {
+			longest = max(longest, c.end-c.start)
+		}
+		length = longest
+	}
+	return depth
+}
+
+// Leaves returns an iterator over the leaves, from left to right, without padding.
+// Like every iterator of the tree it walks the version current when it
+// starts, unaffected by updates during the walk.
+func (mt *MerkleTree) Leaves() iter.Seq[Node] {
+	return func(yield func(Node) bool) {
+		w := mt.newWalk()
+		w.depthFirst(w.root(), func(n Node) (bool, bool) {
+			switch {
+			case w.mt.padding(n.Start):
+				return false, false
+			case !n.Leaf:
+				return true, true
+			}
+			return yield(w.withHash(n)), false
+		})
+	}
+}
+
+// Level returns an iterator over the nodes 'depth' edges below the root, from left to right.
+func (mt *MerkleTree) Level(depth int) iter.Seq[Node] {
+	return func(yield func(Node) bool) {
+		w := mt.newWalk()
+		w.depthFirst(w.root(), func(n Node) (bool, bool) {
+			if n.Depth < depth {
+				return true, true
+			}
+			return yield(w.withHash(n)), false
+		})
+	}
+}
+
+// Nodes returns an iterator over every node in the given order.
+func (mt *MerkleTree) Nodes(order Order) iter.Seq[Node] {
+	return func(yield func(Node) bool) {
+		w := mt.newWalk()
+		if order == DepthFirst {
+			w.depthFirst(w.root(), func(n Node) (bool, bool) {
+				return yield(w.withHash(n)), true
+			})
+			return
+		}
+		queue := []Node{w.root()}
+		for len(queue) > 0 {
+			n := queue[0]
+			queue = queue[1:]
+			if !yield(w.withHash(n)) {
+				return
+			}
+			if !n.Leaf {
+				queue = append(queue, w.children(n)...)
+			}
+		}
+	}
+}
+
+// walk reads the nodes of the version current when it was made.
+type walk struct {
+	mt      *MerkleTree
+	version uint64
+}
+
+func (mt *MerkleTree) newWalk() walk {
+	return walk{mt: mt, version: mt.Version()}
+}
+
+func (w walk) root() Node {
+	return Node{Pos: w.mt.rootPos(), End: w.mt.extent(), Leaf: w.mt.isLeaf(0, w.mt.extent())}
+}
+
+func (w walk) children(n Node) []Node {
+	l := w.mt.layout
+	children := l.children(n.Pos, n.Start, n.End)
+	nodes := make([]Node, len(children))
+	first := n.FirstLeaf
+	for i, c := range children {
+		nodes[i] = Node{Pos: c.pos, Depth: n.Depth + 1, Start: c.start, End: c.end, FirstLeaf: first, Leaf: l.isLeaf(c.start, c.end)}
+		first += l.leafCount(c.end - c.start)
+	}
+	return nodes
+}
+
+// depthFirst calls 'visit' on 'n' and its descendants, before their
+// children, until it returns false for 'more'; 'descend' false skips the children.
+func (w walk) depthFirst(n Node, visit func(Node) (more, descend bool)) bool {
+	more, descend := visit(n)
+	if !more {
+		return false
+	}
+	if !descend || n.Leaf {
+		return true
+	}
+	for _, c := range w.children(n) {
+		if !w.depthFirst(c, visit) {
+			return false
+		}
+	}
+	return true
+}
+
+// withHash reads the node's digest at the walk's version.
+func (w walk) withHash(n Node) Node {
+	w.mt.mu.RLock()
+	defer w.mt.mu.RUnlock()
+	if w.mt.checkVersion(w.version) == nil {
+		n.Hash = append([]byte(nil), storedDigest(versionView{w.mt, w.version}, n.Pos)...)
+	}
+	return n
+}
@@ -0,0 +1,51 @@
+package merkletree
+
+import (
+	"crypto/hmac"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+)
+
+var (
+	// ErrUnknownKey is returned when verifying a keyed tree whose key ID is not in the Verifier's keys.
+	ErrUnknownKey = errors.New("merkletree: unknown key")
+	// ErrInvalidKey is returned for keyed trees without a key or a usable key ID.
+	ErrInvalidKey = errors.New("merkletree: invalid key")
+)
+
+// Keyring holds the keys of keyed trees by key ID. It belongs to its caller:
+// nothing in this package keeps or shares keys between verifiers.
+type Keyring map[string][]byte
+
+// Verifier checks proofs, leaf hashes and streams against trusted Metadata,
+// like the methods of Metadata and the VerifyingReader constructors do, and
+// also those of keyed trees whose key is in Keys. The zero Verifier only
+// verifies unkeyed trees.
+type Verifier struct {
+	Keys Keyring
+}
+
+// checkKey reports empty keys and key IDs that are empty or would break the text encodings.
+func checkKey(id string, key []byte) error {
+	switch {
+	case len(key) == 0:
+		return fmt.Errorf("%w: empty key", ErrInvalidKey)
+	case !validKeyID(id):
+		return fmt.Errorf("%w: key ID %q", ErrInvalidKey, id)
+	}
+	return nil
+}
+
+func validKeyID(id string) bool {
+	return id != "" && !strings.ContainsAny(id, ":=, \t\n")
+}
+
+// keyed returns 'h' hashing with HMAC under 'key'. Only the returned
+// closure holds the key, so printing a tree, even with %#v, never shows it.
+func (h hasher) keyed(key []byte) hasher {
+	newHash, key := h.newHash, append([]byte(nil), key...)
+	h.hmac = func() hash.Hash { return hmac.New(newHash, key) }
+	return h
+}
@@ -0,0 +1,369 @@
+package merkletree
+
+import (
+	"bytes"
+	"fmt"
+	"hash"
+	"math/bits"
+)
+
+// RFC 6962 domain separation prefixes.
+const (
+	logLeafPrefix = 0x00
+	logNodePrefix = 0x01
+)
+
+// LogTree is an append-only list of entries hashed as in RFC 6962: every
+// entry is a leaf, and the tree over n leaves is split after the largest
+// power of two below n. Unlike a MerkleTree, every earlier version of the
+// tree is a prefix of the current one, so consistency between two sizes can
+// be proved.
+//
+// Only complete subtrees are kept in the store, in post-order, so appending
+// to the log only ever writes past the positions already written.
+type LogTree struct {
+	hasher
+	// algorithm names the hash, empty when it was never registered.
+	algorithm string
+	store     NodeStore
+	size      uint64
+	root      []byte
+}
+
+// InclusionProof is the RFC 6962 audit path of a leaf in a LogTree of TreeSize leaves.
+type InclusionProof struct {
+	Algorithm string
+	Index     uint64
+	TreeSize  uint64
+	// Hashes starts next to the leaf.
+	Hashes [][]byte
+}
+
+// ConsistencyProof proves that the LogTree of OldSize leaves is a prefix of
+// the one of NewSize leaves.
+type ConsistencyProof struct {
+	Algorithm string
+	OldSize   uint64
+	NewSize   uint64
+	Hashes    [][]byte
+}
+
+// NewLogTree returns an empty in-memory log hashed with 'hashfn', sha256.New when nil.
+func NewLogTree(hashfn func() hash.Hash) *LogTree {
+	t, _ := LoadLogTree(NewMemoryStore(), 0, hashfn)
+	return t
+}
+
+// LoadLogTree returns the log of 'size' entries whose nodes were previously
+// written to 'store', hashed with 'hashfn', sha256.New when nil.
+// Loading an empty log from an empty store starts a new log.
+func LoadLogTree(store NodeStore, size uint64, hashfn func() hash.Hash) (*LogTree, error) {
+	name, hashfn, _ := resolveHash("", hashfn)
+	t := &LogTree{hasher: hasher{newHash: hashfn}, algorithm: name, store: store, size: size}
+	root, err := t.RootAt(size)
+	if err != nil {
+		return nil, err
+	}
+	t.root = root.Hash
+	return t, nil
+}
+
+func (h hasher) hashLogLeaf(entry []byte) []byte {
+	d := h.newHash()
+	_, _ = d.Write([]byte{logLeafPrefix})
+	_, _ = d.Write(entry)
+	return d.Sum(nil)
+}
+
+func (h hasher) hashLogNode(left, right []byte) []byte {
+	d := h.newHash()
+	_, _ = d.Write([]byte{logNodePrefix})
+	_, _ = d.Write(left)
+	_, _ = d.Write(right)
+	return d.Sum(nil)
+}
+
+// storedIndex returns the store position of the complete subtree over the
+// leaves [i<<level, (i+1)<<level): the number of complete subtrees finished
+// before it in post-order.
+func storedIndex(level int, i uint64) uint64 {
+	// the last leaf of the subtree, and every subtree finished up to it
+	n := (i+1)<<level - 1
+	pos := uint64(0)
+	for ; n > 0; n >>= 1 {
+		pos += n
+	}
+	return pos + uint64(level)
+}
+
+// Append adds 'entry' to the log and returns its index.
+func (t *LogTree) Append(entry []byte) (uint64, error) {
+	return t.AppendLeafHash(t.hashLogLeaf(entry))
+}
+
+// AppendLeafHash adds an entry given its leaf hash, as returned by LeafHash, and returns its index.
+func (t *LogTree) AppendLeafHash(leaf []byte) (uint64, error) {
+	index := t.size
+	if err := t.store.Put(storedIndex(0, index), leaf); err != nil {
+		return 0, err
+	}
+	// every completed pair of subtrees becomes a complete subtree one level up
+	digest := leaf
+	for l, i := 0, index; i&1 == 1; l, i = l+1, i>>1 {
+		left, err := t.store.Get(storedIndex(l, i-1))
+		if err != nil {
+			return 0, err
+		}
+		digest = t.hashLogNode(left, digest)
+		if err := t.store.Put(storedIndex(l+1, i>>1), digest); err != nil {
+			return 0, err
+		}
+	}
+	t.size++
+	root, err := t.RootAt(t.size)
+	if err != nil {
+		return 0, err
+	}
+	t.root = root.Hash
+	return index, nil
+}
+
+// LeafHash returns the RFC 6962 leaf hash of 'entry' in this log.
+func (t *LogTree) LeafHash(entry []byte) []byte {
+	return t.hashLogLeaf(entry)
+}
+
+// Size returns the number of entries in the log.
+func (t *LogTree) Size() uint64 {
+	return t.size
+}
+
+// Root returns the root of the current tree.
+func (t *LogTree) Root() Root {
+	return Root{Algorithm: t.algorithm, Hash: t.root}
+}
+
+// RootAt returns the root of the tree over the first 'size' entries.
+// The root of the empty tree is the hash of no bytes.
+func (t *LogTree) RootAt(size uint64) (Root, error) {
+	if size > t.Size() {
+		return Root{}, fmt.Errorf("%w: log has %d entries, asked for %d", ErrLeafOutOfRange, t.Size(), size)
+	}
+	if size == 0 {
+		return Root{Algorithm: t.algorithm, Hash: t.newHash().Sum(nil)}, nil
+	}
+	digest, err := t.subtree(0, size)
+	if err != nil {
+		return Root{}, err
+	}
+	return Root{Algorithm: t.algorithm, Hash: digest}, nil
+}
+
+// splitPoint returns the largest power of two below 'n', for n > 1.
+func splitPoint(n uint64) uint64 {
+	return 1 << (bits.Len64(n-1) - 1)
+}
+
+// subtree returns the digest of the tree over the leaves [start, end).
+func (t *LogTree) subtree(start, end uint64) ([]byte, error) {
+	if n := end - start; n&(n-1) == 0 && start%n == 0 {
+		l := bits.TrailingZeros64(n)
+		return t.store.Get(storedIndex(l, start>>l))
+	}
+	k := splitPoint(end - start)
+	left, err := t.subtree(start, start+k)
+	if err != nil {
+		return nil, err
+	}
+	right, err := t.subtree(start+k, end)
+	if err != nil {
+		return nil, err
+	}
+	return t.hashLogNode(left, right), nil
+}
+
+// InclusionProof returns the proof of the entry at 'index' in the tree over the first 'size' entries.
+func (t *LogTree) InclusionProof(index, size uint64) (*InclusionProof, error) {
+	if size > t.Size() || index >= size {
+		return nil, fmt.Errorf("%w: entry %d of %d in a log of %d", ErrLeafOutOfRange, index, size, t.Size())
+	}
+	p := &InclusionProof{Algorithm: t.algorithm, Index: index, TreeSize: size, Hashes: [][]byte{}}
+	var path func(m, start, end uint64) error
+	path = func(m, start, end uint64) error {
+		if end-start == 1 {
+			return nil
+		}
+		k := splitPoint(end - start)
+		var (
+			digest []byte
+			err    error
+		)
+		if m < k {
+			if err := path(m, start, start+k); err != nil {
+				return err
+			}
+			digest, err = t.subtree(start+k, end)
+		} else {
+			if err := path(m-k, start+k, end); err != nil {
+				return err
+			}
+			digest, err = t.subtree(start, start+k)
+		}
+		p.Hashes = append(p.Hashes, digest)
+		return err
+	}
+	if err := path(index, 0, size); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// ConsistencyProof returns the proof that the tree over the first 'oldSize'
+// entries is a prefix of the tree over the first 'newSize' entries.
+func (t *LogTree) ConsistencyProof(oldSize, newSize uint64) (*ConsistencyProof, error) {
+	if newSize > t.Size() || oldSize > newSize {
+		return nil, fmt.Errorf("%w: sizes %d and %d in a log of %d", ErrLeafOutOfRange, oldSize, newSize, t.Size())
+	}
+	p := &ConsistencyProof{Algorithm: t.algorithm, OldSize: oldSize, NewSize: newSize, Hashes: [][]byte{}}
+	if oldSize == 0 || oldSize == newSize {
+		return p, nil
+	}
+	var subproof func(m, start, end uint64, complete bool) error
+	subproof = func(m, start, end uint64, complete bool) error {
+		if m == end-start {
+			if complete {
+				return nil
+			}
+			digest, err := t.subtree(start, end)
+			p.Hashes = append(p.Hashes, digest)
+			return err
+		}
+		k := splitPoint(end - start)
+		var (
+			digest []byte
+			err    error
+		)
+		if m <= k {
+			if err := subproof(m, start, start+k, complete); err != nil {
+				return err
+			}
+			digest, err = t.subtree(start+k, end)
+		} else {
+			if err := subproof(m-k, start+k, end, false); err != nil {
+				return err
+			}
+			digest, err = t.subtree(start, start+k)
+		}
+		p.Hashes = append(p.Hashes, digest)
+		return err
+	}
+	if err := subproof(oldSize, 0, newSize, true); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// VerifyInclusion checks that 'p' proves 'leaf', a leaf hash, is the entry
+// at p.Index of the tree of p.TreeSize entries with root 'root'.
+func VerifyInclusion(root Root, leaf []byte, p *InclusionProof) error {
+	if p.Algorithm != root.Algorithm {
+		return fmt.Errorf("%w: proof uses %q, root uses %q", ErrInvalidProof, p.Algorithm, root.Algorithm)
+	}
+	hashfn, err := LookupHash(root.Algorithm)
+	if err != nil {
+		return err
+	}
+	h := hasher{newHash: hashfn}
+	if p.Index >= p.TreeSize {
+		return fmt.Errorf("%w: entry %d of %d", ErrLeafOutOfRange, p.Index, p.TreeSize)
+	}
+
+	// RFC 9162, section 2.1.3.2
+	fn, sn, r := p.Index, p.TreeSize-1, leaf
+	for _, c := range p.Hashes {
+		if sn == 0 {
+			return fmt.Errorf("%w: too many hashes", ErrInvalidProof)
+		}
+		if fn&1 == 1 || fn == sn {
+			r = h.hashLogNode(c, r)
+			for fn&1 == 0 && fn != 0 {
+				fn, sn = fn>>1, sn>>1
+			}
+		} else {
+			r = h.hashLogNode(r, c)
+		}
+		fn, sn = fn>>1, sn>>1
+	}
+	if sn != 0 {
+		return fmt.Errorf("%w: too few hashes", ErrInvalidProof)
+	}
+	if !bytes.Equal(r, root.Hash) {
+		return ErrInvalidProof
+	}
+	return nil
+}
+
+// VerifyConsistency checks that 'p' proves the tree of p.OldSize entries with
+// root 'oldRoot' is a prefix of the tree of p.NewSize entries with root 'newRoot'.
+func VerifyConsistency(oldRoot, newRoot Root, p *ConsistencyProof) error {
+	if p.Algorithm != oldRoot.Algorithm || p.Algorithm != newRoot.Algorithm {
+		return fmt.Errorf("%w: proof uses %q, roots use %q and %q", ErrInvalidProof, p.Algorithm, oldRoot.Algorithm, newRoot.Algorithm)
+	}
+	hashfn, err := LookupHash(p.Algorithm)
+	if err != nil {
+		return err
+	}
+	h := hasher{newHash: hashfn}
+	switch {
+	case p.OldSize > p.NewSize:
+		return fmt.Errorf("%w: old size %d above new size %d", ErrInvalidProof, p.OldSize, p.NewSize)
+	case p.OldSize == p.NewSize:
+		if len(p.Hashes) != 0 || !bytes.Equal(oldRoot.Hash, newRoot.Hash) {
+			return ErrInvalidProof
+		}
+		return nil
+	case p.OldSize == 0:
+		// the empty tree is a prefix of every tree, but only the empty tree has size zero
+		if len(p.Hashes) != 0 {
+			return fmt.Errorf("%w: %d unused hashes", ErrInvalidProof, len(p.Hashes))
+		}
+		if !bytes.Equal(oldRoot.Hash, hashfn().Sum(nil)) {
+			return fmt.Errorf("%w: old root is not the root of the empty tree", ErrInvalidProof)
+		}
+		return nil
+	case len(p.Hashes) == 0:
+		return fmt.Errorf("%w: too few hashes", ErrInvalidProof)
+	}
+
+	// RFC 9162, section 2.1.4.2
+	path := p.Hashes
+	if p.OldSize&(p.OldSize-1) == 0 {
+		path = append([][]byte{oldRoot.Hash}, path...)
+	}
+	fn, sn := p.OldSize-1, p.NewSize-1
+	for fn&1 == 1 {
+		fn, sn = fn>>1, sn>>1
+	}
+	fr, sr := path[0], path[0]
+	for _, c := range path[1:] {
+		if sn == 0 {
+			return fmt.Errorf("%w: too many hashes", ErrInvalidProof)
+		}
+		if fn&1 == 1 || fn == sn {
+			fr, sr = h.hashLogNode(c, fr), h.hashLogNode(c, sr)
+			for fn&1 == 0 && fn != 0 {
+				fn, sn = fn>>1, sn>>1
+			}
+		} else {
+			sr = h.hashLogNode(sr, c)
+		}
+		fn, sn = fn>>1, sn>>1
+	}
+	if sn != 0 {
+		return fmt.Errorf("%w: too few hashes", ErrInvalidProof)
+	}
+	if !bytes.Equal(fr, oldRoot.Hash) || !bytes.Equal(sr, newRoot.Hash) {
+		return ErrInvalidProof
+	}
+	return nil
+}
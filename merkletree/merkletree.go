@@ -2,145 +2,716 @@ package merkletree
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
+	"errors"
 	"fmt"
 	"hash"
+	"io"
+	"sync"
+	"sync/atomic"
 )
 
 // note: crypto/hash.Hash.Write never returns error.
 
+var (
+	// ErrInvalidSegmentSize is returned when a tree is built with a zero segment size.
+	ErrInvalidSegmentSize = errors.New("merkletree: segment size must be positive")
+	// ErrNoRecords is returned when a tree is built from no records or leaf hashes.
+	ErrNoRecords = errors.New("merkletree: no records")
+	// ErrNoLeafData is returned when reading leaves of a tree built from leaf hashes.
+	ErrNoLeafData = errors.New("merkletree: tree holds leaf hashes only")
+	// ErrInvalidSalt is returned for salts longer than 256 bytes.
+	ErrInvalidSalt = errors.New("merkletree: salt longer than 256 bytes")
+	// ErrInvalidArity is returned when a tree is built with fewer than two or more than 256 children per node.
+	ErrInvalidArity = errors.New("merkletree: arity must be between 2 and 256")
+)
+
 // MerkleTree ...
+//
+// A MerkleTree is safe for concurrent use: reads run in parallel, so the
+// store's Get and the data's ReadAt are called concurrently, while Update
+// waits for them and runs alone.
 type MerkleTree struct {
-	root        *node
-	data        []byte
-	segmentSize uint32
-	newHash     func() hash.Hash
+	layout
+	hasher
+	// id orders the locks of two trees compared with each other.
+	id uint64
+	// mu guards the nodes, the root and the leaves against Update.
+	mu    sync.RWMutex
+	store NodeStore
+	root  []byte
+	data  io.ReaderAt
+	// leafRecords or leafHashes hold the leaves of a record tree, with data unset.
+	leafRecords [][]byte
+	leafHashes  [][]byte
+	// segments holds the segments of a byte tree replaced by Update, by start offset.
+	segments map[uint64][]byte
+	// version counts updates; history keeps the retained versions before it.
+	version  uint64
+	history  history
+	observer Observer
+	// algorithm names the hash, empty when it was never registered.
+	algorithm string
+	// keyID identifies the key of a keyed tree, whose key only the hasher holds.
+	keyID string
+}
+
+// treeIDs hands out the ids of trees.
+var treeIDs atomic.Uint64
+
+// streamBufferSize bounds the buffer leaves of the data are hashed through,
+// so that building over large segments does not hold a whole segment in memory.
+const streamBufferSize = 32 << 10
+
+// maxSize bounds the bytes or records of a tree so that node positions fit in 64 bits.
+const maxSize = 1 << 62
+
+// maxArity bounds the children per node.
+const maxArity = 256
+
+// maxSaltSize bounds the salt, as dm-verity does.
+const maxSaltSize = 256
+
+// layout is the shape of a tree over 'size' bytes: ranges are split into at
+// most 'arity' children as 'shape' says until they hold at most 'segmentSize' bytes.
+// A record tree is laid out over 'size' records with a segment size of one.
+type layout struct {
+	size        uint64
+	segmentSize uint64
+	arity       uint64
+	shape       Shape
+	records     bool
+	// counted is set by withCounts once the layout is known to be valid.
+	counted *countTable
+}
+
+// child is a child of a node, at 'pos' and spanning [start, end).
+type child struct {
+	pos        uint64
+	start, end uint64
+}
+
+// hasher computes leaf and node digests, as HMACs with newHash when 'hmac'
+// is set, each starting with the salt.
+type hasher struct {
+	newHash func() hash.Hash
+	hmac    func() hash.Hash
+	salt    []byte
+	meter   *meter
+}
+
+// Config controls how a MerkleTree is built.
+type Config struct {
+	// SegmentSize is the maximum number of bytes in a leaf. Record trees ignore it.
+	SegmentSize uint64
+	// Arity is the number of children per node, 2 when zero.
+	Arity int
+	// Shape defaults to ShapeBytes.
+	Shape Shape
+	// Algorithm is the name of a hash registered with RegisterHash, recorded
+	// in the tree's roots, metadata and proofs. When empty it is the name
+	// NewHash was registered under, found with HashName.
+	Algorithm string
+	// NewHash defaults to the hash registered as Algorithm, or sha256.New.
+	NewHash func() hash.Hash
+	// Key, when set, makes a keyed tree whose leaves and nodes are HMACs under
+	// Key with NewHash, so that only holders of the key can compute its root.
+	// The tree keeps a copy of Key and never prints or encodes it.
+	Key []byte
+	// KeyID identifies Key in the tree's metadata and proofs, so that
+	// verifiers can pick the key from the keys of their Verifier. It is required with Key.
+	KeyID string
+	// Salt, when set, is hashed before the bytes of every leaf and node, as
+	// dm-verity does, so that digests cannot be precomputed across trees. It
+	// is recorded in the metadata, which proofs verify against, and holds at
+	// most 256 bytes.
+	Salt []byte
+	// Store defaults to a new MemoryStore.
+	Store NodeStore
+	// Progress, when set, is called after every leaf is hashed.
+	Progress func(Progress)
+	// Observer defaults to the one set with SetDefaultObserver.
+	Observer Observer
 }
 
-type node struct {
-	left  *node
-	right *node
-	hash  hash.Hash
+// Progress reports how far a build or validation has got. Trees built from
+// leaf hashes hash no bytes.
+type Progress struct {
+	BytesHashed uint64
+	TotalBytes  uint64
+	LeavesDone  uint64
+	TotalLeaves uint64
 }
 
-func min(a, b uint32) uint32 {
-	if a < b {
-		return a
+// tracker stops a walk over the leaves when its context is done and reports progress.
+// Its hasher counts the hashing in the walk's span.
+type tracker struct {
+	ctx      context.Context
+	progress func(Progress)
+	hasher   hasher
+	Progress
+}
+
+func (mt *MerkleTree) newTracker(ctx context.Context, progress func(Progress), s *span) *tracker {
+	t := &tracker{ctx: ctx, progress: progress, hasher: s.hasher(mt.hasher)}
+	t.TotalLeaves = mt.leaves()
+	switch {
+	case mt.leafRecords != nil:
+		for _, record := range mt.leafRecords {
+			t.TotalBytes += uint64(len(record))
+		}
+	case mt.leafHashes == nil:
+		t.TotalBytes = uint64(mt.size)
+	}
+	return t
+}
+
+// leafDone records a leaf of 'n' bytes as hashed.
+func (t *tracker) leafDone(n uint64) {
+	t.BytesHashed += n
+	t.LeavesDone++
+	if t.progress != nil {
+		t.progress(t.Progress)
 	}
-	return b
 }
 
 // NewMerkleTree returns new merkle tree created by the data in the 'data'.
-// All leaves will we 'segmentSize' bytes except the last leaf,
-// which will not be padded out if there are not enough bytes remaining in the 'data'.
-func NewMerkleTree(data []byte, segmentSize uint32) (*MerkleTree, error) {
+// The data is halved by bytes until every leaf holds at most 'segmentSize' bytes.
+func NewMerkleTree(data []byte, segmentSize uint64) (*MerkleTree, error) {
 	return NewMerkleTreeWithCostumHash(data, segmentSize, sha256.New)
 }
 
 // NewMerkleTreeWithCostumHash ...
-func NewMerkleTreeWithCostumHash(data []byte, segmentSize uint32, hashfn func() hash.Hash) (*MerkleTree, error) {
-	mt := MerkleTree{
-		root:        nil,
-		data:        data,
-		segmentSize: segmentSize,
-		newHash:     hashfn,
+func NewMerkleTreeWithCostumHash(data []byte, segmentSize uint64, hashfn func() hash.Hash) (*MerkleTree, error) {
+	return NewMerkleTreeFromReader(bytes.NewReader(data), uint64(len(data)), Config{
+		SegmentSize: segmentSize,
+		NewHash:     hashfn,
+	})
+}
+
+// NewMerkleTreeFromReader returns new merkle tree over the first 'size' bytes of 'r',
+// writing every node digest to the configured store.
+func NewMerkleTreeFromReader(r io.ReaderAt, size uint64, cfg Config) (*MerkleTree, error) {
+	return NewMerkleTreeFromReaderContext(context.Background(), r, size, cfg)
+}
+
+// NewMerkleTreeFromReaderContext is NewMerkleTreeFromReader returning
+// ctx.Err() as soon as the context is done.
+func NewMerkleTreeFromReaderContext(ctx context.Context, r io.ReaderAt, size uint64, cfg Config) (*MerkleTree, error) {
+	mt, err := newMerkleTree(r, size, cfg)
+	if err != nil {
+		return nil, err
 	}
+	return mt, mt.build(ctx, cfg.Progress)
+}
 
-	segments := chopData(data, segmentSize)
-	mt.root = mt.buildTree(segments, uint32(0), uint32(len(data)))
-	return &mt, nil
+// build hashes every leaf and writes the tree's nodes to the store.
+func (mt *MerkleTree) build(ctx context.Context, progress func(Progress)) (err error) {
+	s := startSpan(OpBuild, mt.leaves())
+	defer func() { s.end(mt.observer, err) }()
+	pos := uint64(0)
+	buf := make([]byte, max(1, min(mt.size, mt.segmentSize, streamBufferSize)))
+	root, err := mt.buildTree(0, mt.extent(), &pos, buf, mt.newTracker(ctx, progress, s))
+	if err != nil {
+		return err
+	}
+	mt.root = root
+	return nil
 }
 
-// chop data in segmentSize pieces
-func chopData(data []byte, segmentSize uint32) [][]byte {
-	segments := [][]byte{}
-	dataLen := uint32(len(data))
-	for i := uint32(0); i < dataLen; i += segmentSize {
-		currSegmentSize := min(dataLen-i, segmentSize)
-		segment := make([]byte, currSegmentSize)
-		_ = copy(segment, data[i:i+currSegmentSize])
-		segments = append(segments, segment)
+// NewMerkleTreeFromRecords returns new merkle tree with one leaf per record,
+// so proofs reference record indices. cfg.SegmentSize is ignored.
+func NewMerkleTreeFromRecords(records [][]byte, cfg Config) (*MerkleTree, error) {
+	return NewMerkleTreeFromRecordsContext(context.Background(), records, cfg)
+}
+
+// NewMerkleTreeFromRecordsContext is NewMerkleTreeFromRecords returning
+// ctx.Err() as soon as the context is done.
+func NewMerkleTreeFromRecordsContext(ctx context.Context, records [][]byte, cfg Config) (*MerkleTree, error) {
+	mt, err := newRecordTree(len(records), cfg)
+	if err != nil {
+		return nil, err
 	}
-	return segments
+	// copied so that Update leaves the caller's slice alone
+	mt.leafRecords = append([][]byte(nil), records...)
+	return mt, mt.build(ctx, cfg.Progress)
 }
 
-// BuildTree ...
-func (mt *MerkleTree) buildTree(segments [][]byte, start, end uint32) *node {
-	// base case, no more segments left
-	if len(segments) == 0 {
-		return nil
+// NewMerkleTreeFromLeafHashes returns new merkle tree whose leaves are the
+// given digests of records, hashed elsewhere with cfg.NewHash after cfg.Salt,
+// as HMACs under cfg.Key for a keyed tree. The tree has the same root as
+// NewMerkleTreeFromRecords over the records, but holds no
+// data: Segment and WriteInterleaved fail with ErrNoLeafData.
+func NewMerkleTreeFromLeafHashes(leaves [][]byte, cfg Config) (*MerkleTree, error) {
+	mt, err := newRecordTree(len(leaves), cfg)
+	if err != nil {
+		return nil, err
+	}
+	size := mt.newHash().Size()
+	for i, leaf := range leaves {
+		if len(leaf) != size {
+			return nil, fmt.Errorf("merkletree: leaf hash %d has %d bytes, want %d", i, len(leaf), size)
+		}
+	}
+	mt.leafHashes = append([][]byte(nil), leaves...)
+	return mt, mt.build(context.Background(), cfg.Progress)
+}
+
+func newRecordTree(records int, cfg Config) (*MerkleTree, error) {
+	if records == 0 {
+		return nil, ErrNoRecords
 	}
+	cfg.SegmentSize = 1
+	mt, err := newMerkleTree(nil, uint64(records), cfg)
+	if err != nil {
+		return nil, err
+	}
+	mt.records = true
+	return mt, nil
+}
+
+// LoadMerkleTree returns the merkle tree over 'r' whose nodes were previously
+// written to cfg.Store, without hashing the data again. Use Validate to check
+// the stored nodes against the data.
+func LoadMerkleTree(r io.ReaderAt, size uint64, cfg Config) (*MerkleTree, error) {
+	if cfg.Store == nil {
+		return nil, errors.New("merkletree: loading a tree requires a store")
+	}
+	mt, err := newMerkleTree(r, size, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if mt.root, err = mt.store.Get(mt.rootPos()); err != nil {
+		return nil, err
+	}
+	return mt, nil
+}
 
-	// leaf node
-	if end-start <= mt.segmentSize {
-		leaf := &node{
-			left:  nil,
-			right: nil,
-			hash:  mt.newHash(),
+func newMerkleTree(r io.ReaderAt, size uint64, cfg Config) (*MerkleTree, error) {
+	if cfg.SegmentSize == 0 {
+		return nil, ErrInvalidSegmentSize
+	}
+	if size > maxSize {
+		return nil, fmt.Errorf("merkletree: data size %d too large", size)
+	}
+	if cfg.Arity == 0 {
+		cfg.Arity = 2
+	}
+	if cfg.Arity < 2 || cfg.Arity > maxArity {
+		return nil, ErrInvalidArity
+	}
+	mt := &MerkleTree{
+		id:       treeIDs.Add(1),
+		layout:   layout{size: size, segmentSize: cfg.SegmentSize, arity: uint64(cfg.Arity), shape: cfg.Shape},
+		store:    cfg.Store,
+		data:     r,
+		observer: cfg.Observer,
+	}
+	if err := mt.check(); err != nil {
+		return nil, err
+	}
+	mt.layout = mt.withCounts()
+	var err error
+	if mt.algorithm, mt.newHash, err = resolveHash(cfg.Algorithm, cfg.NewHash); err != nil {
+		return nil, err
+	}
+	if cfg.Key != nil || cfg.KeyID != "" {
+		if err := checkKey(cfg.KeyID, cfg.Key); err != nil {
+			return nil, err
 		}
-		_, _ = leaf.hash.Write(segments[0])
-		segments = segments[1:]
-		return leaf
+		mt.hasher, mt.keyID = mt.keyed(cfg.Key), cfg.KeyID
+	}
+	if len(cfg.Salt) > maxSaltSize {
+		return nil, ErrInvalidSalt
+	}
+	if len(cfg.Salt) > 0 {
+		mt.salt = append([]byte(nil), cfg.Salt...)
 	}
+	if mt.store == nil {
+		mt.store = NewMemoryStore()
+	}
+	return mt, nil
+}
 
-	// intermediate node
-	mid := start + ((end - start) / 2)
-	n := &node{
-		left:  mt.buildTree(segments, start, mid),
-		right: mt.buildTree(segments, mid, end),
-		hash:  mt.newHash(),
+// buildTree hashes the bytes in [start, end) and stores the subtree's nodes
+// in post-order starting at 'pos', returning the subtree's root digest.
+func (mt *MerkleTree) buildTree(start, end uint64, pos *uint64, buf []byte, t *tracker) ([]byte, error) {
+	var digest []byte
+
+	if mt.isLeaf(start, end) {
+		var err error
+		if digest, err = mt.trackedLeafDigest(start, end, buf, t); err != nil {
+			return nil, err
+		}
+	} else {
+		children := mt.childRanges(start, end)
+		digests := make([][]byte, len(children))
+		for i, c := range children {
+			var err error
+			if digests[i], err = mt.buildTree(c.start, c.end, pos, buf, t); err != nil {
+				return nil, err
+			}
+		}
+		digest = t.hasher.hashNode(digests...)
+	}
+
+	if err := mt.store.Put(*pos, digest); err != nil {
+		return nil, err
 	}
+	*pos++
+	return digest, nil
+}
+
+func (l layout) isLeaf(start, end uint64) bool {
+	return end-start <= l.segmentSize
+}
 
-	concat := append(n.left.hash.Sum(nil), n.right.hash.Sum(nil)...)
-	_, _ = n.hash.Write(concat)
+// count is the number of leaves and of nodes of a subtree.
+type count struct{ leaves, nodes uint64 }
+
+// countTable holds the counts of the subtrees of a layout by length. The
+// walks ask for them at every node, so they are computed once per layout.
+type countTable struct {
+	byLength map[uint64]count
+}
 
-	return n
+// withCounts returns 'l' carrying the counts of every subtree of its tree.
+// Splitting yields few distinct lengths per level, so the table is logarithmic in size.
+func (l layout) withCounts() layout {
+	table := &countTable{byLength: map[uint64]count{}}
+	l.countInto(l.extent(), table.byLength)
+	l.counted = table
+	return l
+}
+
+// counts returns the number of leaves and of nodes of a subtree spanning 'length' bytes.
+func (l layout) counts(length uint64) (leaves, nodes uint64) {
+	if length <= l.segmentSize {
+		return 1, 1
+	}
+	c, ok := count{}, false
+	if l.counted != nil {
+		c, ok = l.counted.byLength[length]
+	}
+	if !ok {
+		// a length that is not a subtree of the tree, or a layout made without withCounts
+		c = l.countInto(length, map[uint64]count{})
+	}
+	return c.leaves, c.nodes
+}
+
+// countInto returns the counts of a subtree spanning 'length' bytes,
+// recording them and those of every subtree below it in 'memo'.
+func (l layout) countInto(length uint64, memo map[uint64]count) count {
+	if length <= l.segmentSize {
+		return count{1, 1}
+	}
+	if c, ok := memo[length]; ok {
+		return c
+	}
+	c := count{nodes: 1}
+	for _, child := range l.childRanges(0, length) {
+		cc := l.countInto(child.end-child.start, memo)
+		c.leaves += cc.leaves
+		c.nodes += cc.nodes
+	}
+	memo[length] = c
+	return c
+}
+
+// same reports whether both layouts describe the same tree.
+func (l layout) same(other layout) bool {
+	l.counted, other.counted = nil, nil
+	return l == other
+}
+
+// nodeCount returns the number of nodes of a subtree spanning 'length' bytes.
+func (l layout) nodeCount(length uint64) uint64 {
+	if l.arity == 2 {
+		return 2*l.leafCount(length) - 1
+	}
+	_, nodes := l.counts(length)
+	return nodes
+}
+
+// rootPos returns the position of the root, which is written last.
+func (l layout) rootPos() uint64 {
+	return l.nodeCount(l.extent()) - 1
+}
+
+// children returns the children of the node at 'pos' spanning [start, end),
+// from left to right. Subtrees are stored in post-order, so the last child
+// sits right before its parent and every other child before its right sibling's subtree.
+func (l layout) children(pos uint64, start, end uint64) []child {
+	children := l.childRanges(start, end)
+	next := pos
+	for i := len(children) - 1; i >= 0; i-- {
+		children[i].pos = next - 1
+		next -= l.nodeCount(children[i].end - children[i].start)
+	}
+	return children
+}
+
+// readSegment returns the bytes of the leaf spanning [start, end), read into 'buf' from the data.
+func (mt *MerkleTree) readSegment(start, end uint64, buf []byte) ([]byte, error) {
+	switch {
+	case mt.leafRecords != nil:
+		return append(buf[:0], mt.leafRecords[start]...), nil
+	case mt.leafHashes != nil:
+		return nil, ErrNoLeafData
+	}
+	if segment, ok := mt.segments[start]; ok {
+		return append(buf[:0], segment...), nil
+	}
+	return mt.readData(start, end, buf)
+}
+
+// readData reads the bytes in [start, end) into 'buf' from the data.
+func (mt *MerkleTree) readData(start, end uint64, buf []byte) ([]byte, error) {
+	segment := buf[:end-start]
+	n, err := mt.data.ReadAt(segment, int64(start))
+	if n == len(segment) {
+		return segment, nil
+	}
+	if err == nil || err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return nil, err
+}
+
+// trackedLeafDigest is leafDigest stopping once the tracker's context is done.
+func (mt *MerkleTree) trackedLeafDigest(start, end uint64, buf []byte, t *tracker) ([]byte, error) {
+	if err := t.ctx.Err(); err != nil {
+		return nil, err
+	}
+	if mt.padding(start) {
+		return t.hasher.zero(), nil
+	}
+	end = min(end, mt.size)
+	digest, err := mt.leafDigest(t.hasher, start, end, buf)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case mt.leafRecords != nil:
+		t.leafDone(uint64(len(mt.leafRecords[start])))
+	case mt.leafHashes != nil:
+		t.leafDone(0)
+	default:
+		t.leafDone(end - start)
+	}
+	return digest, nil
+}
+
+// leafDigest returns the digest of the leaf spanning [start, end), hashed with 'h'.
+func (mt *MerkleTree) leafDigest(h hasher, start, end uint64, buf []byte) ([]byte, error) {
+	if mt.leafHashes != nil {
+		return mt.leafHashes[start], nil
+	}
+	if _, updated := mt.segments[start]; mt.leafRecords == nil && !updated {
+		return h.hashLeafFrom(io.NewSectionReader(mt.data, int64(start), int64(end-start)), end-start, buf)
+	}
+	segment, err := mt.readSegment(start, end, buf)
+	if err != nil {
+		return nil, err
+	}
+	return h.hashLeaf(segment), nil
+}
+
+// new returns a hash for one leaf or node digest, with the salt written.
+func (h hasher) new() hash.Hash {
+	d := h.newHash
+	if h.hmac != nil {
+		d = h.hmac
+	}
+	digest := d()
+	_, _ = digest.Write(h.salt)
+	return digest
+}
+
+// hashLeafFrom hashes a leaf of 'n' bytes read from 'r' through 'buf'.
+func (h hasher) hashLeafFrom(r io.Reader, n uint64, buf []byte) ([]byte, error) {
+	h.meter.count(uint64(len(h.salt)) + n)
+	d := h.new()
+	written, err := io.CopyBuffer(d, r, buf)
+	if err != nil {
+		return nil, err
+	}
+	if uint64(written) != n {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return d.Sum(nil), nil
+}
+
+func (h hasher) hashLeaf(segment []byte) []byte {
+	h.meter.count(uint64(len(h.salt) + len(segment)))
+	d := h.new()
+	_, _ = d.Write(segment)
+	return d.Sum(nil)
+}
+
+// zero returns the all-zero digest of padding leaves.
+func (h hasher) zero() []byte {
+	return make([]byte, h.new().Size())
+}
+
+// hashNode hashes the concatenated digests of a node's children, from left to right.
+func (h hasher) hashNode(children ...[]byte) []byte {
+	d := h.new()
+	n := len(h.salt)
+	for _, child := range children {
+		_, _ = d.Write(child)
+		n += len(child)
+	}
+	h.meter.count(uint64(n))
+	return d.Sum(nil)
 }
 
 // GetRootHash ...
 func (mt *MerkleTree) GetRootHash() []byte {
-	return mt.root.hash.Sum(nil)
+	mt.mu.RLock()
+	defer mt.mu.RUnlock()
+	return append([]byte(nil), mt.root...)
 }
 
 // Validate entire trees' correctness
 func (mt *MerkleTree) Validate() (bool, error) {
-	nmt, err := NewMerkleTreeWithCostumHash(mt.data, mt.segmentSize, mt.newHash)
+	return mt.ValidateContext(context.Background(), nil)
+}
+
+// ValidateContext is Validate returning ctx.Err() as soon as the context is
+// done and, when 'progress' is set, calling it after every leaf is hashed.
+func (mt *MerkleTree) ValidateContext(ctx context.Context, progress func(Progress)) (_ bool, err error) {
+	s := startSpan(OpValidate, mt.leaves())
+	defer func() { s.end(mt.observer, err) }()
+	mt.mu.RLock()
+	defer mt.mu.RUnlock()
+	buf := make([]byte, max(1, min(mt.size, mt.segmentSize, streamBufferSize)))
+	root, ok, err := mt.validateTree(mt.rootPos(), 0, mt.extent(), buf, mt.newTracker(ctx, progress, s))
+	if err != nil {
+		return false, err
+	}
+	return ok && bytes.Equal(root, mt.root), nil
+}
+
+// validateTree recomputes the subtree rooted at 'pos' from the data and
+// reports whether every stored digest matches.
+func (mt *MerkleTree) validateTree(pos uint64, start, end uint64, buf []byte, t *tracker) ([]byte, bool, error) {
+	var digest []byte
+	ok := true
+
+	if mt.isLeaf(start, end) {
+		var err error
+		if digest, err = mt.trackedLeafDigest(start, end, buf, t); err != nil {
+			return nil, false, err
+		}
+	} else {
+		children := mt.children(pos, start, end)
+		digests := make([][]byte, len(children))
+		for i, c := range children {
+			var childOk bool
+			var err error
+			if digests[i], childOk, err = mt.validateTree(c.pos, c.start, c.end, buf, t); err != nil {
+				return nil, false, err
+			}
+			ok = ok && childOk
+		}
+		digest = t.hasher.hashNode(digests...)
+	}
+
+	stored, err := mt.store.Get(pos)
+	if err == ErrNodeNotFound {
+		return digest, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return digest, ok && bytes.Equal(digest, stored), nil
+}
+
+// storedDigest returns the digest at 'pos' or nil if it cannot be read.
+func storedDigest(store NodeStore, pos uint64) []byte {
+	digest, err := store.Get(pos)
 	if err != nil {
-		return false, nil
+		return nil
 	}
-	return mt.Equals(nmt), nil
+	return digest
 }
 
 func (mt *MerkleTree) String() string {
-	str := fmt.Sprintf("MerkleTree:\ndata:%v\nsegmentSize:%v\ntree:\n", mt.data, mt.segmentSize)
-	str += subTreeToString(mt.root, "")
+	mt.mu.RLock()
+	defer mt.mu.RUnlock()
+	var str string
+	switch {
+	case mt.leafRecords != nil:
+		str = fmt.Sprintf("MerkleTree:\nrecords:%v\ntree:\n", mt.leafRecords)
+	case mt.leafHashes != nil:
+		str = fmt.Sprintf("MerkleTree:\nleafHashes:%v\ntree:\n", mt.leafHashes)
+	default:
+		data := make([]byte, mt.size)
+		_, _ = mt.data.ReadAt(data, 0)
+		for start, segment := range mt.segments {
+			copy(data[start:], segment)
+		}
+		str = fmt.Sprintf("MerkleTree:\ndata:%v\nsegmentSize:%v\ntree:\n", data, mt.segmentSize)
+	}
+	str += mt.subTreeToString(mt.rootPos(), 0, mt.extent(), "")
 	return str
 }
 
-// Equals ...
+// Equals reports whether both trees have the same shape and every node digest matches.
 func (mt *MerkleTree) Equals(other *MerkleTree) bool {
-	return mt.root.subTreeEquals(other.root)
+	if !mt.same(other.layout) {
+		return false
+	}
+	defer readLockBoth(mt, other)()
+	return mt.subTreeEquals(other, mt.rootPos(), 0, mt.extent())
 }
 
-func (n *node) subTreeEquals(o *node) bool {
-	if n == nil && o == nil {
-		return true
+// readLockBoth read-locks both trees, always in id order so that two
+// comparisons of the same trees cannot deadlock behind pending updates,
+// and returns the function unlocking them.
+func readLockBoth(a, b *MerkleTree) (unlock func()) {
+	if a == b {
+		a.mu.RLock()
+		return a.mu.RUnlock
+	}
+	if b.id < a.id {
+		a, b = b, a
+	}
+	a.mu.RLock()
+	b.mu.RLock()
+	return func() {
+		b.mu.RUnlock()
+		a.mu.RUnlock()
 	}
-	if o == nil || n == nil {
+}
+
+func (mt *MerkleTree) subTreeEquals(other *MerkleTree, pos uint64, start, end uint64) bool {
+	n, o := storedDigest(mt.store, pos), storedDigest(other.store, pos)
+	if n == nil || o == nil || !bytes.Equal(n, o) {
 		return false
 	}
-	if bytes.Equal(n.hash.Sum(nil), n.hash.Sum(nil)) {
+	if mt.isLeaf(start, end) {
 		return true
 	}
-	// current nodes may be corrupted so compare recursively
-	return n.left.subTreeEquals(o.left) && n.right.subTreeEquals(o.right)
+	// matching digests may still hide corrupted descendants so compare recursively
+	for _, c := range mt.children(pos, start, end) {
+		if !mt.subTreeEquals(other, c.pos, c.start, c.end) {
+			return false
+		}
+	}
+	return true
 }
 
-func subTreeToString(n *node, prepad string) string {
-	if n == nil {
-		return ""
+func (mt *MerkleTree) subTreeToString(pos uint64, start, end uint64, prepad string) string {
+	str := prepad + fmt.Sprintf("hash:%v", storedDigest(mt.store, pos))
+	if mt.isLeaf(start, end) {
+		return str
 	}
-	return prepad + fmt.Sprintf("hash:%v", n.hash.Sum(nil)) +
-		subTreeToString(n.left, prepad+"\t") +
-		subTreeToString(n.right, prepad+"\t")
+	for _, c := range mt.children(pos, start, end) {
+		str += mt.subTreeToString(c.pos, c.start, c.end, prepad+"\t")
+	}
+	return str
 }
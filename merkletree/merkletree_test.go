@@ -1 +1,2659 @@
 package merkletree
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"flag"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zvikinoza/merkle-tree/merkletree/internal/reference"
+)
+
+// block 100000 of the Bitcoin main chain
+var (
+	block100000TxIDs = []string{
+		"8c14f0db3df150123e6f3dbbf30f8b955a8249b62ac1d1ff16284aefa3d06d87",
+		"fff2525b8931402dd09222c50775608f75787bd2b87e56995a7bdd30f79702c4",
+		"6359f0868171b1d194cbee1af2f16ea598ae8fad666d9b012c8ed2b79a236ec4",
+		"e9a66845e05d5abc0ad04ec80f774a7e585c6e8db975962d069a522137b80c1d",
+	}
+	block100000Root = "f3e94742aca4b5ef85488dc37c06c3282295ffec960994b2c0d5ac2a25a95766"
+	block100000Prev = "000000000002d01c1fccc21636b607dfd930d31d01c3a62104612a1719011250"
+	block100000Hash = "000000000003ba27aa200b1cecaad478d2b00432346c3f1f3986da1afd33e506"
+	// bitcoin-cli gettxoutproof '["e9a66845e05d5abc0ad04ec80f774a7e585c6e8db975962d069a522137b80c1d"]'
+	block100000TxOutProof = "0100000050120119172a610421a6c3011dd330d9df07b63616c2cc1f1cd00200000000006657a9252aacd5c0b2940996ecff952228c3067cc38d4885efb5a4ac4247e9f337221b4d4c86041b0f2b5710040000000315b88c5107195bf09eb9da89b83d95b3d070079a3c5c5d3d17d0dcd873fbdaccc46e239ab7d28e2c019b6d66ad8fae98a56ef1f21aeecb94d1b1718186f059631d0cb83721529a062d9675b98d6e5c587e4a770fc84ed00abc5a5de04568a6e90115"
+)
+
+func parseDisplayHashes(t *testing.T, hashes []string) [][]byte {
+	t.Helper()
+	out := make([][]byte, len(hashes))
+	for i, s := range hashes {
+		h, err := ParseDisplayHash(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out[i] = h
+	}
+	return out
+}
+
+func block100000Header(t *testing.T) [BlockHeaderSize]byte {
+	t.Helper()
+	var header [BlockHeaderSize]byte
+	prev, _ := ParseDisplayHash(block100000Prev)
+	root, _ := ParseDisplayHash(block100000Root)
+	binary.LittleEndian.PutUint32(header[0:], 1)
+	copy(header[4:36], prev)
+	copy(header[36:68], root)
+	binary.LittleEndian.PutUint32(header[68:], 1293623863)
+	binary.LittleEndian.PutUint32(header[72:], 0x1b04864c)
+	binary.LittleEndian.PutUint32(header[76:], 274148111)
+	return header
+}
+
+func TestBitcoinTreeRoot(t *testing.T) {
+	tests := []struct {
+		name  string
+		txids []string
+		root  string
+	}{
+		{
+			name:  "genesis",
+			txids: []string{"4a5e1e4baab89f3a32518a88c31bc87f618f76673e2cc77ab2127b7afdeda33b"},
+			root:  "4a5e1e4baab89f3a32518a88c31bc87f618f76673e2cc77ab2127b7afdeda33b",
+		},
+		{
+			name: "block 170",
+			txids: []string{
+				"b1fea52486ce0c62bb442b530a3f0132b826c74e473d1f2c220bfa78111c5082",
+				"f4184fc596403b9d638783cf57adfe4c75c605f6356fbc91338530e9831e9e16",
+			},
+			root: "7dac2c5666815c17a3b36427de37bb9d2e2c5ccec3f8633eb91a4205cb4c10ff",
+		},
+		{name: "block 100000", txids: block100000TxIDs, root: block100000Root},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bt, err := NewBitcoinTree(parseDisplayHashes(t, tt.txids))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bt.String() != tt.root {
+				t.Fatalf("root %s, want %s", bt.String(), tt.root)
+			}
+		})
+	}
+}
+
+func TestBitcoinTreeOddLevel(t *testing.T) {
+	txids := parseDisplayHashes(t, block100000TxIDs[:3])
+	bt, err := NewBitcoinTree(txids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// duplicating the last transaction yields the same root
+	mutated, err := NewBitcoinTree(append(txids, txids[2]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bt.GetRootHash(), mutated.GetRootHash()) {
+		t.Fatal("odd level was not paired with itself")
+	}
+	if bt.HasMutation() || !mutated.HasMutation() {
+		t.Fatal("HasMutation did not flag the duplicated transaction")
+	}
+}
+
+func TestMerkleBlock(t *testing.T) {
+	txids := parseDisplayHashes(t, block100000TxIDs)
+	header := block100000Header(t)
+	mb := MerkleBlock{Header: header}
+	if got := DisplayHash(mb.BlockHash()); got != block100000Hash {
+		t.Fatalf("block hash %s, want %s", got, block100000Hash)
+	}
+
+	for mask := 0; mask < 1<<len(txids); mask++ {
+		matches := make([]bool, len(txids))
+		var want []uint32
+		for i := range matches {
+			matches[i] = mask&(1<<i) != 0
+			if matches[i] {
+				want = append(want, uint32(i))
+			}
+		}
+		pmt, err := NewPartialMerkleTree(txids, matches)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mb.Tree = *pmt
+
+		encoded, err := mb.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded MerkleBlock
+		if err := decoded.UnmarshalBinary(encoded); err != nil {
+			t.Fatal(err)
+		}
+		matched, indices, err := decoded.Verify()
+		if err != nil {
+			t.Fatalf("mask %b: %v", mask, err)
+		}
+		if len(indices) != len(want) {
+			t.Fatalf("mask %b: matched %v, want %v", mask, indices, want)
+		}
+		for i, idx := range indices {
+			if idx != want[i] || !bytes.Equal(matched[i], txids[idx]) {
+				t.Fatalf("mask %b: matched %v, want %v", mask, indices, want)
+			}
+		}
+	}
+}
+
+func TestMerkleBlockRejectsTampering(t *testing.T) {
+	txids := parseDisplayHashes(t, block100000TxIDs)
+	pmt, err := NewPartialMerkleTree(txids, []bool{false, true, false, false})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mb := MerkleBlock{Header: block100000Header(t), Tree: *pmt}
+
+	tampered := mb
+	tampered.Tree.Hashes = append([][]byte{}, pmt.Hashes...)
+	tampered.Tree.Hashes[0] = txids[3]
+	if _, _, err := tampered.Verify(); err != ErrMerkleRootMismatch {
+		t.Fatalf("got %v, want %v", err, ErrMerkleRootMismatch)
+	}
+
+	extra := mb
+	extra.Tree.Hashes = append(append([][]byte{}, pmt.Hashes...), txids[0])
+	if _, _, err := extra.Verify(); err != ErrInvalidPartialTree {
+		t.Fatalf("got %v, want %v", err, ErrInvalidPartialTree)
+	}
+
+	encoded, _ := mb.MarshalBinary()
+	var decoded MerkleBlock
+	if err := decoded.UnmarshalBinary(encoded[:len(encoded)-1]); err == nil {
+		t.Fatal("truncated merkle block decoded")
+	}
+}
+
+func TestRootEncoding(t *testing.T) {
+	mt, err := NewMerkleTree([]byte("hello merkle tree"), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := mt.Root()
+	if root.Algorithm != "sha256" {
+		t.Fatalf("algorithm %q, want sha256", root.Algorithm)
+	}
+
+	b, err := json.Marshal(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fromJSON Root
+	if err := json.Unmarshal(b, &fromJSON); err != nil {
+		t.Fatal(err)
+	}
+	if !fromJSON.Equal(root) {
+		t.Fatalf("json round trip: got %v, want %v", fromJSON, root)
+	}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	var fromFlag Root
+	fs.TextVar(&fromFlag, "root", Root{}, "trusted root")
+	if err := fs.Parse([]string{"-root", root.String()}); err != nil {
+		t.Fatal(err)
+	}
+	if !fromFlag.Equal(root) {
+		t.Fatalf("flag round trip: got %v, want %v", fromFlag, root)
+	}
+
+	for _, bad := range []string{
+		`{"algorithm":"nope","hash":"00"}`,
+		`{"algorithm":"sha256","hash":"00"}`,
+		`{"algorithm":"sha256","hash":"zz"}`,
+	} {
+		if err := json.Unmarshal([]byte(bad), &fromJSON); err == nil {
+			t.Fatalf("decoded %s", bad)
+		}
+	}
+}
+
+func TestEncodingRoundTrip(t *testing.T) {
+	mt, err := NewMerkleTree([]byte("hello merkle tree"), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bt, err := NewBitcoinTree(parseDisplayHashes(t, block100000TxIDs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pmt, err := NewPartialMerkleTree(parseDisplayHashes(t, block100000TxIDs), []bool{true, false, false, true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mb := &MerkleBlock{Header: block100000Header(t), Tree: *pmt}
+	proof, err := mt.Proof(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rangeProof, err := mt.RangeProof(1, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		value any
+		fresh func() any
+	}{
+		{"root", mt.Root(), func() any { return new(Root) }},
+		{"bitcoin root", bt.Root(), func() any { return new(Root) }},
+		{"metadata", mt.Metadata(), func() any { return new(Metadata) }},
+		{"inclusion proof", proof, func() any { return new(Proof) }},
+		{"range proof", rangeProof, func() any { return new(RangeProof) }},
+		{"partial merkle tree", pmt, func() any { return new(PartialMerkleTree) }},
+		{"merkle block", mb, func() any { return new(MerkleBlock) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := reflect.Indirect(reflect.ValueOf(tt.value)).Interface()
+
+			b, err := json.Marshal(tt.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fromJSON := tt.fresh()
+			if err := json.Unmarshal(b, fromJSON); err != nil {
+				t.Fatal(err)
+			}
+			if got := reflect.Indirect(reflect.ValueOf(fromJSON)).Interface(); !reflect.DeepEqual(got, want) {
+				t.Fatalf("json round trip: got %+v, want %+v", got, want)
+			}
+
+			text, err := tt.value.(encoding.TextMarshaler).MarshalText()
+			if err != nil {
+				t.Fatal(err)
+			}
+			fromText := tt.fresh()
+			if err := fromText.(encoding.TextUnmarshaler).UnmarshalText(text); err != nil {
+				t.Fatal(err)
+			}
+			// BIP37 pads flags to whole bytes, so compare encodings rather than values
+			again, err := fromText.(encoding.TextMarshaler).MarshalText()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(again, text) {
+				t.Fatalf("text round trip: got %s, want %s", again, text)
+			}
+		})
+	}
+
+	t.Run("gettxoutproof", func(t *testing.T) {
+		var mb MerkleBlock
+		if err := mb.UnmarshalText([]byte(block100000TxOutProof)); err != nil {
+			t.Fatal(err)
+		}
+		if got := DisplayHash(mb.BlockHash()); got != block100000Hash {
+			t.Fatalf("block hash %s, want %s", got, block100000Hash)
+		}
+		if got := DisplayHash(mb.MerkleRoot()); got != block100000Root {
+			t.Fatalf("merkle root %s, want %s", got, block100000Root)
+		}
+		matched, indices, err := mb.Verify()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(matched) != 1 || DisplayHash(matched[0]) != block100000TxIDs[3] || indices[0] != 3 {
+			t.Fatalf("matched %x at %v, want %s at 3", matched, indices, block100000TxIDs[3])
+		}
+		text, err := mb.MarshalText()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(text) != block100000TxOutProof {
+			t.Fatalf("re-encoded as %s, want %s", text, block100000TxOutProof)
+		}
+	})
+}
+
+func TestHashAlgorithmNames(t *testing.T) {
+	// closures of one literal share their code, so only the names given at build time tell them apart
+	hmacWith := func(key string) func() hash.Hash {
+		return func() hash.Hash { return hmac.New(sha256.New, []byte(key)) }
+	}
+	RegisterHash("hmac-test-a", hmacWith("a"))
+	RegisterHash("hmac-test-b", hmacWith("b"))
+	if name, err := HashName(hmacWith("a")); !errors.Is(err, ErrUnknownHash) {
+		t.Fatalf("HashName of a closure = %q, %v; want %v", name, err, ErrUnknownHash)
+	}
+
+	data := []byte("named by the config")
+	for _, name := range []string{"hmac-test-a", "hmac-test-b"} {
+		mt, err := NewMerkleTreeFromReader(bytes.NewReader(data), uint64(len(data)), Config{SegmentSize: 4, Algorithm: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := mt.Root().Algorithm; got != name {
+			t.Fatalf("root tagged %q, want %q", got, name)
+		}
+		p, err := mt.Proof(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		segment, _ := mt.Segment(1)
+		if p.Algorithm != name {
+			t.Fatalf("proof tagged %q, want %q", p.Algorithm, name)
+		}
+		if err := mt.Metadata().VerifyProof(segment, p); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+	if _, err := NewMerkleTreeFromReader(bytes.NewReader(data), uint64(len(data)), Config{SegmentSize: 4, Algorithm: "nope"}); !errors.Is(err, ErrUnknownHash) {
+		t.Fatalf("got %v, want %v", err, ErrUnknownHash)
+	}
+}
+
+func TestStoresBuildIdenticalTrees(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 100)
+	mem, err := NewMerkleTree(data, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "nodes")
+	fs, err := OpenFileStore(path, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{SegmentSize: 7, Store: fs}
+	file, err := NewMerkleTreeFromReader(bytes.NewReader(data), uint64(len(data)), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(mem.GetRootHash(), file.GetRootHash()) || !mem.Equals(file) || !file.Equals(mem) {
+		t.Fatal("memory and file backed trees differ")
+	}
+	if ok, err := file.Validate(); !ok || err != nil {
+		t.Fatalf("Validate() = %v, %v", ok, err)
+	}
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// reopening the store restores the tree without rehashing
+	fs, err = OpenFileStore(path, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	cfg.Store = fs
+	loaded, err := LoadMerkleTree(bytes.NewReader(data), uint64(len(data)), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.Equals(mem) {
+		t.Fatal("reloaded tree differs")
+	}
+
+	// a rewritten node is appended and shadows the original
+	if err := fs.Put(3, make([]byte, 32)); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := loaded.Validate(); ok || err != nil {
+		t.Fatalf("Validate() on corrupted store = %v, %v", ok, err)
+	}
+	if loaded.Equals(mem) {
+		t.Fatal("corrupted tree equals original")
+	}
+}
+
+func TestLeavesCoverTheirSegments(t *testing.T) {
+	data := []byte("abcdefghij")
+	mt, err := NewMerkleTree(data, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range data {
+		mutated := append([]byte(nil), data...)
+		mutated[i] ^= 1
+		other, err := NewMerkleTree(mutated, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Equal(mt.GetRootHash(), other.GetRootHash()) || mt.Equals(other) {
+			t.Fatalf("flipping byte %d did not change the root", i)
+		}
+	}
+	if _, err := NewMerkleTree(data, 0); err != ErrInvalidSegmentSize {
+		t.Fatalf("got %v, want %v", err, ErrInvalidSegmentSize)
+	}
+}
+
+func TestProofs(t *testing.T) {
+	data := bytes.Repeat([]byte("merkle"), 37)
+	for _, segmentSize := range []uint64{1, 5, 16, 64, 1000} {
+		mt, err := NewMerkleTree(data, segmentSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		meta := mt.Metadata()
+		leaves, err := mt.LeafHashes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		offset := uint64(0)
+		for i := range leaves {
+			p, err := mt.Proof(uint64(i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, start, end, _, _ := mt.leafPath(uint64(i))
+			if start != offset {
+				t.Fatalf("leaf %d starts at %d, want %d", i, start, offset)
+			}
+			offset = end
+			if err := meta.VerifyProof(data[start:end], p); err != nil {
+				t.Fatalf("segment size %d leaf %d: %v", segmentSize, i, err)
+			}
+			tampered := append([]byte(nil), data[start:end]...)
+			tampered[0] ^= 1
+			if err := meta.VerifyProof(tampered, p); !errors.Is(err, ErrInvalidProof) {
+				t.Fatalf("tampered leaf %d verified: %v", i, err)
+			}
+		}
+		if offset != uint64(len(data)) {
+			t.Fatalf("leaves end at %d, want %d", offset, len(data))
+		}
+		if _, err := mt.Proof(uint64(len(leaves))); err != ErrLeafOutOfRange {
+			t.Fatalf("got %v, want %v", err, ErrLeafOutOfRange)
+		}
+	}
+}
+
+func TestRangeProofs(t *testing.T) {
+	data := bytes.Repeat([]byte("ranges"), 41)
+	for _, segmentSize := range []uint64{7, 16, 1000} {
+		mt, err := NewMerkleTree(data, segmentSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		meta := mt.Metadata()
+		leaves := mt.leafCount(mt.size)
+		for start := uint64(0); start < leaves; start++ {
+			for end := start + 1; end <= leaves; end++ {
+				p, err := mt.RangeProof(start, end)
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, from, _, _, _ := mt.leafPath(start)
+				_, _, to, _, _ := mt.leafPath(end - 1)
+				if err := meta.VerifyRangeProof(data[from:to], p); err != nil {
+					t.Fatalf("segment size %d range [%d, %d): %v", segmentSize, start, end, err)
+				}
+				if err := meta.VerifyRangeProof(data[from:to-1], p); !errors.Is(err, ErrInvalidProof) {
+					t.Fatalf("short range [%d, %d) verified: %v", start, end, err)
+				}
+				tampered := append([]byte(nil), data[from:to]...)
+				tampered[len(tampered)-1] ^= 1
+				if err := meta.VerifyRangeProof(tampered, p); !errors.Is(err, ErrInvalidProof) {
+					t.Fatalf("tampered range [%d, %d) verified: %v", start, end, err)
+				}
+			}
+		}
+		if _, err := mt.RangeProof(0, leaves+1); err != ErrLeafOutOfRange {
+			t.Fatalf("got %v, want %v", err, ErrLeafOutOfRange)
+		}
+	}
+}
+
+func TestVerifyingReader(t *testing.T) {
+	data := bytes.Repeat([]byte("verify me "), 50)
+	mt, err := NewMerkleTree(data, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := mt.Metadata()
+	leaves, err := mt.LeafHashes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var interleaved bytes.Buffer
+	if err := mt.WriteInterleaved(&interleaved); err != nil {
+		t.Fatal(err)
+	}
+
+	// corrupt a byte of the leaf at index 'bad'
+	bad := uint64(len(leaves) / 2)
+	_, start, _, _, _ := mt.leafPath(bad)
+	corrupted := append([]byte(nil), data...)
+	corrupted[start] ^= 0xff
+	// a tree loaded over the corrupted data still serves the original proofs
+	stale, err := LoadMerkleTree(bytes.NewReader(corrupted), uint64(len(corrupted)), Config{SegmentSize: 16, Store: mt.store})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var corruptedStream bytes.Buffer
+	if err := stale.WriteInterleaved(&corruptedStream); err != nil {
+		t.Fatal(err)
+	}
+
+	readers := map[string]func(good bool) (io.Reader, error){
+		"leaf hashes": func(good bool) (io.Reader, error) {
+			if good {
+				return NewVerifyingReader(bytes.NewReader(data), meta, leaves)
+			}
+			return NewVerifyingReader(bytes.NewReader(corrupted), meta, leaves)
+		},
+		"interleaved": func(good bool) (io.Reader, error) {
+			if good {
+				return NewInterleavedVerifyingReader(bytes.NewReader(interleaved.Bytes()), meta)
+			}
+			return NewInterleavedVerifyingReader(bytes.NewReader(corruptedStream.Bytes()), meta)
+		},
+	}
+	for name, newReader := range readers {
+		t.Run(name, func(t *testing.T) {
+			r, err := newReader(true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(r)
+			if err != nil || !bytes.Equal(got, data) {
+				t.Fatalf("ReadAll() = %d bytes, %v", len(got), err)
+			}
+
+			r, err = newReader(false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err = io.ReadAll(r)
+			var ie *IntegrityError
+			if !errors.As(err, &ie) || ie.Index != bad || ie.Offset != start {
+				t.Fatalf("got %v, want integrity error for leaf %d", err, bad)
+			}
+			// nothing from the corrupted segment is returned
+			if !bytes.Equal(got, data[:start]) {
+				t.Fatalf("read %d bytes before failing, want %d", len(got), start)
+			}
+		})
+	}
+
+	wrong := append([][]byte(nil), leaves...)
+	wrong[0] = leaves[1]
+	if _, err := NewVerifyingReader(bytes.NewReader(data), meta, wrong); !errors.Is(err, ErrInvalidProof) {
+		t.Fatalf("got %v, want %v", err, ErrInvalidProof)
+	}
+
+	var ie *IntegrityError
+	r, _ := NewVerifyingReader(bytes.NewReader(data[:len(data)-1]), meta, leaves)
+	if _, err := io.ReadAll(r); !errors.As(err, &ie) || !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("truncated data: got %v", err)
+	}
+
+	// a stream is verified a segment at a time, so huge segments are refused up front
+	huge := meta
+	huge.Size, huge.SegmentSize = 1<<40, 1<<30
+	if _, err := NewInterleavedVerifyingReader(bytes.NewReader(nil), huge); err == nil {
+		t.Fatalf("read a stream of %d byte segments", huge.SegmentSize)
+	}
+
+	// a tree of leaf hashes has no data to stream and writes nothing
+	fromHashes, err := NewMerkleTreeFromLeafHashes(leaves, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var empty bytes.Buffer
+	if err := fromHashes.WriteInterleaved(&empty); !errors.Is(err, ErrNoLeafData) || empty.Len() != 0 {
+		t.Fatalf("got %v after writing %d bytes, want %v before any", err, empty.Len(), ErrNoLeafData)
+	}
+}
+
+type verityVector struct {
+	Name          string `json:"name"`
+	DataSize      int64  `json:"dataSize"`
+	DataBlockSize uint32 `json:"dataBlockSize"`
+	HashBlockSize uint32 `json:"hashBlockSize"`
+	Salt          string `json:"salt"`
+	Algorithm     string `json:"algorithm"`
+	Superblock    bool   `json:"superblock"`
+	UUID          string `json:"uuid"`
+	Root          string `json:"root"`
+}
+
+// testImage returns the image the testdata vectors were generated from.
+func testImage(size int64) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	return data
+}
+
+func TestVerityVectors(t *testing.T) {
+	b, err := os.ReadFile("testdata/dm-verity/vectors.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vectors []verityVector
+	if err := json.Unmarshal(b, &vectors); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range vectors {
+		t.Run(v.Name, func(t *testing.T) {
+			want, err := os.ReadFile(filepath.Join("testdata/dm-verity", v.Name+".hash"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			salt, _ := hex.DecodeString(v.Salt)
+			params := VerityParams{
+				Algorithm:     v.Algorithm,
+				DataBlockSize: v.DataBlockSize,
+				HashBlockSize: v.HashBlockSize,
+				Salt:          salt,
+				NoSuperblock:  !v.Superblock,
+			}
+			uuid, _ := hex.DecodeString(strings.ReplaceAll(v.UUID, "-", ""))
+			copy(params.UUID[:], uuid)
+			data := testImage(v.DataSize)
+
+			hashDev, err := os.Create(filepath.Join(t.TempDir(), "hash"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer hashDev.Close()
+			root, err := VerityFormat(bytes.NewReader(data), v.DataSize, hashDev, params)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hex.EncodeToString(root) != v.Root {
+				t.Fatalf("root %x, want %s", root, v.Root)
+			}
+			got, err := os.ReadFile(hashDev.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatalf("hash device differs from veritysetup's (%d vs %d bytes)", len(got), len(want))
+			}
+
+			if v.Superblock {
+				sbParams, size, err := ReadVeritySuperblock(bytes.NewReader(want))
+				if err != nil {
+					t.Fatal(err)
+				}
+				sameSalt := bytes.Equal(sbParams.Salt, params.Salt)
+				sbParams.Salt = params.Salt
+				if size != v.DataSize || !sameSalt || !reflect.DeepEqual(sbParams, params) {
+					t.Fatalf("superblock %+v size %d, want %+v size %d", sbParams, size, params, v.DataSize)
+				}
+			}
+			if err := VerityVerify(bytes.NewReader(data), v.DataSize, hashDev, root, params); err != nil {
+				t.Fatal(err)
+			}
+
+			data[len(data)-1] ^= 1
+			err = VerityVerify(bytes.NewReader(data), v.DataSize, hashDev, root, params)
+			if v.DataSize == int64(v.DataBlockSize) {
+				// a single block has no hash tree, only the root covers it
+				if err != ErrVerityRootMismatch {
+					t.Fatalf("got %v, want %v", err, ErrVerityRootMismatch)
+				}
+			} else if !errors.Is(err, ErrVerityMismatch) {
+				t.Fatalf("got %v, want %v", err, ErrVerityMismatch)
+			}
+		})
+	}
+}
+
+func TestFSVerityVectors(t *testing.T) {
+	b, err := os.ReadFile("testdata/fs-verity/vectors.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vectors []struct {
+		Name       string `json:"name"`
+		Size       int64  `json:"size"`
+		Algorithm  string `json:"algorithm"`
+		BlockSize  uint32 `json:"blockSize"`
+		Salt       string `json:"salt"`
+		Root       string `json:"root"`
+		Digest     string `json:"digest"`
+		TreeSHA256 string `json:"treeSHA256"`
+	}
+	if err := json.Unmarshal(b, &vectors); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range vectors {
+		t.Run(v.Name, func(t *testing.T) {
+			salt, _ := hex.DecodeString(v.Salt)
+			params := FSVerityParams{Algorithm: v.Algorithm, BlockSize: v.BlockSize, Salt: salt}
+			data := testImage(v.Size)
+
+			digest, err := FSVerityDigest(bytes.NewReader(data), v.Size, params)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hex.EncodeToString(digest) != v.Digest {
+				t.Fatalf("digest %x, want %s", digest, v.Digest)
+			}
+
+			tree := &memoryDevice{}
+			root, err := FSVerityFormat(bytes.NewReader(data), v.Size, tree, params)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hex.EncodeToString(root) != v.Root {
+				t.Fatalf("root %x, want %s", root, v.Root)
+			}
+			if sum := sha256.Sum256(tree.b); hex.EncodeToString(sum[:]) != v.TreeSHA256 {
+				t.Fatalf("tree of %d bytes does not match", len(tree.b))
+			}
+		})
+	}
+}
+
+// the RFC 6962 test vectors used by Certificate Transparency implementations
+var (
+	logEntries = []string{"", "00", "10", "2021", "3031", "40414243", "5051525354555657", "606162636465666768696a6b6c6d6e6f"}
+	logRoots   = []string{
+		"6e340b9cffb37a989ca544e6bb780a2c78901d3fb33738768511a30617afa01d",
+		"fac54203e7cc696cf0dfcb42c92a1d9dbaf70ad9e621f4bd8d98662f00e3c125",
+		"aeb6bcfe274b70a14fb067a5e5578264db0fa9b51af5e0ba159158f329e06e77",
+		"d37ee418976dd95753c1c73862b9398fa2a2cf9b4ff0fdfe8b30cd95209614b7",
+		"4e3bbb1f7b478dcfe71fb631631519a3bca12c9aefca1612bfce4c13a86264d4",
+		"76e67dadbcdf1e10e1b74ddc608abd2f98dfb16fbce75277b5232a127f2087ef",
+		"ddb89be403809e325750d3d263cd78929c2942b7942a34b77e122c9594a74c8c",
+		"5dc9da79a70659a9ad559cb701ded9a2ab9d823aad2f4960cfe370eff4604328",
+	}
+)
+
+func newTestLog(t *testing.T) *LogTree {
+	t.Helper()
+	log := NewLogTree(nil)
+	for _, s := range logEntries {
+		entry, _ := hex.DecodeString(s)
+		if _, err := log.Append(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return log
+}
+
+func TestLogTreeRoots(t *testing.T) {
+	log := newTestLog(t)
+	empty, err := log.RootAt(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := hex.EncodeToString(empty.Hash); got != "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855" {
+		t.Fatalf("empty root %s", got)
+	}
+	for i, want := range logRoots {
+		root, err := log.RootAt(uint64(i + 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := hex.EncodeToString(root.Hash); got != want {
+			t.Fatalf("root of %d entries is %s, want %s", i+1, got, want)
+		}
+	}
+	if _, err := log.RootAt(log.Size() + 1); !errors.Is(err, ErrLeafOutOfRange) {
+		t.Fatalf("got %v, want %v", err, ErrLeafOutOfRange)
+	}
+}
+
+func TestLogTreeProofs(t *testing.T) {
+	log := NewLogTree(nil)
+	for i := 0; i < 37; i++ {
+		if _, err := log.Append([]byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for size := uint64(1); size <= log.Size(); size++ {
+		root, _ := log.RootAt(size)
+		for index := uint64(0); index < size; index++ {
+			p, err := log.InclusionProof(index, size)
+			if err != nil {
+				t.Fatal(err)
+			}
+			leaf := log.LeafHash([]byte{byte(index)})
+			if err := VerifyInclusion(root, leaf, p); err != nil {
+				t.Fatalf("entry %d of %d: %v", index, size, err)
+			}
+			if err := VerifyInclusion(root, log.LeafHash([]byte{byte(index + 1)}), p); !errors.Is(err, ErrInvalidProof) {
+				t.Fatalf("wrong entry %d of %d verified: %v", index, size, err)
+			}
+		}
+	}
+	for newSize := uint64(0); newSize <= log.Size(); newSize++ {
+		newRoot, _ := log.RootAt(newSize)
+		for oldSize := uint64(0); oldSize <= newSize; oldSize++ {
+			oldRoot, _ := log.RootAt(oldSize)
+			p, err := log.ConsistencyProof(oldSize, newSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := VerifyConsistency(oldRoot, newRoot, p); err != nil {
+				t.Fatalf("sizes %d and %d: %v", oldSize, newSize, err)
+			}
+			forked := Root{Algorithm: oldRoot.Algorithm, Hash: append([]byte(nil), oldRoot.Hash...)}
+			forked.Hash[0] ^= 1
+			if err := VerifyConsistency(forked, newRoot, p); !errors.Is(err, ErrInvalidProof) {
+				t.Fatalf("forked sizes %d and %d verified: %v", oldSize, newSize, err)
+			}
+		}
+	}
+	if _, err := log.InclusionProof(5, 5); !errors.Is(err, ErrLeafOutOfRange) {
+		t.Fatalf("got %v, want %v", err, ErrLeafOutOfRange)
+	}
+}
+
+func TestSignedTreeHead(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPub, otherKey, _ := ed25519.GenerateKey(nil)
+	log := newTestLog(t)
+	now := time.Date(2024, 5, 1, 12, 0, 0, 123456789, time.UTC)
+
+	older, err := SignTreeHead(key, mustRootAt(t, log, 3), 3, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newer, err := log.SignTreeHead(key, now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !older.Timestamp.Equal(now.Truncate(time.Millisecond)) {
+		t.Fatalf("timestamp %v not truncated to milliseconds", older.Timestamp)
+	}
+
+	for _, sth := range []*SignedTreeHead{older, newer} {
+		if err := sth.Verify([]ed25519.PublicKey{otherPub, pub}); err != nil {
+			t.Fatal(err)
+		}
+		// the signature survives a round trip through JSON
+		b, err := json.Marshal(sth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded SignedTreeHead
+		if err := json.Unmarshal(b, &decoded); err != nil {
+			t.Fatal(err)
+		}
+		if err := decoded.Verify([]ed25519.PublicKey{pub}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := newer.Verify([]ed25519.PublicKey{otherPub}); !errors.Is(err, ErrUntrustedKey) {
+		t.Fatalf("got %v, want %v", err, ErrUntrustedKey)
+	}
+	tampered := *newer
+	tampered.TreeSize++
+	if err := tampered.Verify([]ed25519.PublicKey{pub}); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("got %v, want %v", err, ErrInvalidSignature)
+	}
+	forged, _ := SignTreeHead(otherKey, newer.RootHash(), newer.TreeSize, now)
+	forged.KeyID = KeyID(pub)
+	if err := forged.Verify([]ed25519.PublicKey{pub}); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("got %v, want %v", err, ErrInvalidSignature)
+	}
+
+	entry, _ := hex.DecodeString(logEntries[2])
+	inclusion, err := log.InclusionProof(2, older.TreeSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := older.VerifyInclusion(log.LeafHash(entry), inclusion); err != nil {
+		t.Fatal(err)
+	}
+	if err := newer.VerifyInclusion(log.LeafHash(entry), inclusion); !errors.Is(err, ErrInvalidProof) {
+		t.Fatalf("proof for another size verified: %v", err)
+	}
+	consistency, err := log.ConsistencyProof(older.TreeSize, newer.TreeSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := older.VerifyConsistency(newer, consistency); err != nil {
+		t.Fatal(err)
+	}
+	if err := newer.VerifyConsistency(older, consistency); !errors.Is(err, ErrInvalidProof) {
+		t.Fatalf("reversed tree heads verified: %v", err)
+	}
+}
+
+func mustRootAt(t *testing.T, log *LogTree, size uint64) Root {
+	t.Helper()
+	root, err := log.RootAt(size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+func TestRecordTrees(t *testing.T) {
+	records := [][]byte{
+		[]byte("GET /index.html 200"),
+		[]byte("GET /favicon.ico 404"),
+		{},
+		[]byte("POST /login 302"),
+		[]byte("GET /dashboard 200 with a much longer line than the others"),
+		[]byte("GET /logout 302"),
+		[]byte("x"),
+	}
+	store := NewMemoryStore()
+	mt, err := NewMerkleTreeFromRecords(records, Config{Store: store})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaves := make([][]byte, len(records))
+	for i, record := range records {
+		digest := sha256.Sum256(record)
+		leaves[i] = digest[:]
+	}
+	fromHashes, err := NewMerkleTreeFromLeafHashes(leaves, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(mt.GetRootHash(), fromHashes.GetRootHash()) || !mt.Equals(fromHashes) {
+		t.Fatal("trees from records and from their leaf hashes differ")
+	}
+	for _, tree := range []*MerkleTree{mt, fromHashes} {
+		if ok, err := tree.Validate(); !ok || err != nil {
+			t.Fatalf("Validate() = %v, %v", ok, err)
+		}
+	}
+
+	meta := mt.Metadata()
+	if meta.SegmentSize != 0 || meta.Size != uint64(len(records)) {
+		t.Fatalf("metadata %+v", meta)
+	}
+	text, err := meta.MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Metadata
+	if err := decoded.UnmarshalText(text); err != nil {
+		t.Fatal(err)
+	}
+	for i, record := range records {
+		p, err := fromHashes.Proof(uint64(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := decoded.VerifyProof(record, p); err != nil {
+			t.Fatalf("record %d: %v", i, err)
+		}
+		if err := decoded.VerifyProof(records[(i+1)%len(records)], p); !errors.Is(err, ErrInvalidProof) {
+			t.Fatalf("record %d verified as record %d: %v", (i+1)%len(records), i, err)
+		}
+		segment, err := mt.Segment(uint64(i))
+		if err != nil || !bytes.Equal(segment, record) {
+			t.Fatalf("Segment(%d) = %q, %v", i, segment, err)
+		}
+	}
+	if _, err := fromHashes.Segment(0); !errors.Is(err, ErrNoLeafData) {
+		t.Fatalf("got %v, want %v", err, ErrNoLeafData)
+	}
+	rp, err := mt.RangeProof(2, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := meta.VerifyRecordRangeProof(records[2:5], rp); err != nil {
+		t.Fatal(err)
+	}
+	if err := meta.VerifyRecordRangeProof(records[1:4], rp); !errors.Is(err, ErrInvalidProof) {
+		t.Fatalf("shifted records verified: %v", err)
+	}
+
+	changed := append([][]byte(nil), records...)
+	changed[3] = []byte("POST /login 200")
+	other, err := NewMerkleTreeFromRecords(changed, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, err := NewMerkleTree(bytes.Join(records, nil), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mt.Equals(other) || mt.Equals(blob) || blob.Equals(mt) {
+		t.Fatal("different trees are equal")
+	}
+
+	// a corrupted leaf digest is caught
+	if err := store.Put(0, make([]byte, sha256.Size)); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := mt.Validate(); ok || err != nil {
+		t.Fatalf("Validate() = %v, %v on a corrupted tree", ok, err)
+	}
+
+	if _, err := NewMerkleTreeFromRecords(nil, Config{}); err != ErrNoRecords {
+		t.Fatalf("got %v, want %v", err, ErrNoRecords)
+	}
+	if _, err := NewMerkleTreeFromLeafHashes([][]byte{{1, 2, 3}}, Config{}); err == nil {
+		t.Fatal("accepted a leaf hash of the wrong size")
+	}
+	single, _ := NewMerkleTreeFromRecords(records[:1], Config{})
+	if want := sha256.Sum256(records[0]); !bytes.Equal(single.GetRootHash(), want[:]) {
+		t.Fatal("root of a single record is not its digest")
+	}
+}
+
+type payment struct {
+	From, To string
+	Cents    uint64
+}
+
+func (p payment) MarshalBinary() ([]byte, error) {
+	return []byte(fmt.Sprintf("%s>%s:%d", p.From, p.To, p.Cents)), nil
+}
+
+func TestTypedTree(t *testing.T) {
+	payments := []payment{
+		{"alice", "bob", 1250},
+		{"bob", "carol", 99},
+		{"carol", "alice", 100000},
+		{"dave", "bob", 1},
+		{"erin", "frank", 31415},
+	}
+	tt, err := NewTypedTree(payments, BinaryEncoder[payment](), Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := make([][]byte, len(payments))
+	for i, p := range payments {
+		records[i], _ = p.MarshalBinary()
+	}
+	untyped, err := NewMerkleTreeFromRecords(records, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tt.Equals(untyped) {
+		t.Fatal("typed tree differs from the tree over its encodings")
+	}
+
+	meta := tt.Metadata()
+	for i := range payments {
+		p, err := tt.Proof(uint64(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// a verifier only sees the proof as JSON
+		b, err := json.Marshal(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var received TypedProof[payment]
+		if err := json.Unmarshal(b, &received); err != nil {
+			t.Fatal(err)
+		}
+		if received.Value != payments[i] {
+			t.Fatalf("proof carries %+v, want %+v", received.Value, payments[i])
+		}
+		if err := received.Verify(meta, BinaryEncoder[payment]()); err != nil {
+			t.Fatalf("payment %d: %v", i, err)
+		}
+		received.Value.Cents++
+		if err := received.Verify(meta, BinaryEncoder[payment]()); !errors.Is(err, ErrInvalidProof) {
+			t.Fatalf("altered payment %d verified: %v", i, err)
+		}
+	}
+	if _, err := tt.Proof(uint64(len(payments))); err != ErrLeafOutOfRange {
+		t.Fatalf("got %v, want %v", err, ErrLeafOutOfRange)
+	}
+
+	words := []string{"alpha", "beta", "gamma"}
+	wt, err := NewTypedTree(words, FuncEncoder(func(s string) []byte { return []byte(s) }), Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := wt.Value(2); err != nil || v != "gamma" {
+		t.Fatalf("Value(2) = %q, %v", v, err)
+	}
+	words[2] = "changed"
+	if v, _ := wt.Value(2); v != "gamma" {
+		t.Fatalf("changing the caller's slice changed Value(2) to %q", v)
+	}
+
+	// updates go through the encoder and keep proofs carrying the new value
+	updated := payment{"erin", "frank", 27182}
+	if err := tt.Update(4, updated); err != nil {
+		t.Fatal(err)
+	}
+	p, err := tt.Proof(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Value != updated {
+		t.Fatalf("proof carries %+v after the update, want %+v", p.Value, updated)
+	}
+	if err := p.Verify(tt.Metadata(), BinaryEncoder[payment]()); err != nil {
+		t.Fatal(err)
+	}
+	if err := tt.Update(uint64(len(payments)), updated); !errors.Is(err, ErrLeafOutOfRange) {
+		t.Fatalf("got %v, want %v", err, ErrLeafOutOfRange)
+	}
+	failing := Encoder[string](func(string) ([]byte, error) { return nil, errors.New("boom") })
+	if _, err := NewTypedTree(words, failing, Config{}); err == nil {
+		t.Fatal("encoder error was ignored")
+	}
+}
+
+func TestContextAndProgress(t *testing.T) {
+	data := bytes.Repeat([]byte("progress"), 100)
+	var reports []Progress
+	mt, err := NewMerkleTreeFromReaderContext(context.Background(), bytes.NewReader(data), uint64(len(data)), Config{
+		SegmentSize: 30,
+		Progress:    func(p Progress) { reports = append(reports, p) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaves := mt.leafCount(mt.size)
+	if uint64(len(reports)) != leaves {
+		t.Fatalf("%d progress reports for %d leaves", len(reports), leaves)
+	}
+	last := reports[len(reports)-1]
+	if last != (Progress{BytesHashed: 800, TotalBytes: 800, LeavesDone: leaves, TotalLeaves: leaves}) {
+		t.Fatalf("final progress %+v", last)
+	}
+	for i := 1; i < len(reports); i++ {
+		if reports[i].BytesHashed <= reports[i-1].BytesHashed {
+			t.Fatalf("progress went from %+v to %+v", reports[i-1], reports[i])
+		}
+	}
+
+	// cancelling from the progress callback stops the build at the next leaf
+	ctx, cancel := context.WithCancel(context.Background())
+	var done uint64
+	_, err = NewMerkleTreeFromReaderContext(ctx, bytes.NewReader(data), uint64(len(data)), Config{
+		SegmentSize: 30,
+		Progress: func(p Progress) {
+			done = p.LeavesDone
+			if p.LeavesDone == 3 {
+				cancel()
+			}
+		},
+	})
+	if !errors.Is(err, context.Canceled) || done != 3 {
+		t.Fatalf("got %v after %d leaves, want %v after 3", err, done, context.Canceled)
+	}
+
+	// ctx is already cancelled
+	if _, err := NewMerkleTreeFromRecordsContext(ctx, [][]byte{{1}}, Config{}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want %v", err, context.Canceled)
+	}
+	if ok, err := mt.ValidateContext(ctx, nil); ok || !errors.Is(err, context.Canceled) {
+		t.Fatalf("ValidateContext() = %v, %v", ok, err)
+	}
+
+	reports = reports[:0]
+	ok, err := mt.ValidateContext(context.Background(), func(p Progress) { reports = append(reports, p) })
+	if !ok || err != nil {
+		t.Fatalf("ValidateContext() = %v, %v", ok, err)
+	}
+	if got := reports[len(reports)-1]; got != last {
+		t.Fatalf("validation ended at %+v, want %+v", got, last)
+	}
+
+	records := [][]byte{[]byte("a"), []byte("bcd"), {}, []byte("ef")}
+	reports = reports[:0]
+	if _, err := NewMerkleTreeFromRecords(records, Config{Progress: func(p Progress) { reports = append(reports, p) }}); err != nil {
+		t.Fatal(err)
+	}
+	if got := reports[len(reports)-1]; got != (Progress{BytesHashed: 6, TotalBytes: 6, LeavesDone: 4, TotalLeaves: 4}) {
+		t.Fatalf("final record progress %+v", got)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	data := bytes.Repeat([]byte("update"), 50)
+	mt, err := NewMerkleTree(data, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	segment, err := mt.Segment(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mt.Update(5, bytes.ToUpper(segment)); err != nil {
+		t.Fatal(err)
+	}
+	changed := append([]byte(nil), data...)
+	_, start, end, _, _ := mt.leafPath(5)
+	copy(changed[start:end], bytes.ToUpper(segment))
+	want, err := NewMerkleTree(changed, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !mt.Equals(want) || !bytes.Equal(mt.GetRootHash(), want.GetRootHash()) {
+		t.Fatal("updated tree differs from a tree built over the changed data")
+	}
+	if ok, err := mt.Validate(); !ok || err != nil {
+		t.Fatalf("Validate() = %v, %v", ok, err)
+	}
+	p, err := mt.Proof(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mt.Metadata().VerifyProof(bytes.ToUpper(segment), p); err != nil {
+		t.Fatal(err)
+	}
+	if err := mt.Update(5, segment[1:]); err == nil {
+		t.Fatal("updated a segment with fewer bytes")
+	}
+	if err := mt.Update(mt.leafCount(mt.size), segment); !errors.Is(err, ErrLeafOutOfRange) {
+		t.Fatalf("got %v, want %v", err, ErrLeafOutOfRange)
+	}
+
+	records := [][]byte{[]byte("a"), []byte("b"), []byte("c")}
+	rt, err := NewMerkleTreeFromRecords(records, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.Update(1, []byte("longer record")); err != nil {
+		t.Fatal(err)
+	}
+	if string(records[1]) != "b" {
+		t.Fatal("Update changed the caller's records")
+	}
+	want, err = NewMerkleTreeFromRecords([][]byte{[]byte("a"), []byte("longer record"), []byte("c")}, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rt.Equals(want) {
+		t.Fatal("updated record tree differs from a tree built over the changed records")
+	}
+	leaves, _ := want.LeafHashes()
+	lt, err := NewMerkleTreeFromLeafHashes([][]byte{leaves[0], leaves[0], leaves[2]}, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lt.Update(1, leaves[1]); err != nil {
+		t.Fatal(err)
+	}
+	if !lt.Equals(want) {
+		t.Fatal("updated leaf hash tree differs from a tree built over the changed records")
+	}
+}
+
+type recordingObserver struct {
+	events []Event
+}
+
+func (o *recordingObserver) Observe(e Event) { o.events = append(o.events, e) }
+
+func TestObserver(t *testing.T) {
+	o := &recordingObserver{}
+	data := bytes.Repeat([]byte("observe"), 20)
+	mt, err := NewMerkleTreeFromReader(bytes.NewReader(data), uint64(len(data)), Config{SegmentSize: 16, Observer: o})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaves := mt.leafCount(mt.size)
+	build := o.events[0]
+	if build.Op != OpBuild || build.Leaves != leaves || build.Err != nil {
+		t.Fatalf("build event %+v", build)
+	}
+	// every leaf and every internal node, each internal node hashing two digests
+	if build.Hashes != 2*leaves-1 || build.Bytes != uint64(len(data))+(leaves-1)*2*sha256.Size {
+		t.Fatalf("build hashed %d digests over %d bytes", build.Hashes, build.Bytes)
+	}
+
+	p, err := mt.Proof(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mt.Proof(leaves); err == nil {
+		t.Fatal("proved a leaf beyond the tree")
+	}
+	segment, _ := mt.Segment(3)
+	updated := bytes.Repeat([]byte{'x'}, len(segment))
+	if err := mt.Update(3, updated); err != nil {
+		t.Fatal(err)
+	}
+	got := o.events[1:]
+	if len(got) != 3 || got[0].Op != OpProof || got[0].Hashes != 0 || got[1].Op != OpProof || got[1].Err == nil {
+		t.Fatalf("proof events %+v", got)
+	}
+	if u := got[2]; u.Op != OpUpdate || u.Hashes != uint64(len(p.Siblings))+1 {
+		t.Fatalf("update event %+v", u)
+	}
+
+	defer SetDefaultObserver(nil)
+	verifier := &recordingObserver{}
+	SetDefaultObserver(verifier)
+	p, _ = mt.Proof(3)
+	if err := mt.Metadata().VerifyProof(updated, p); err != nil {
+		t.Fatal(err)
+	}
+	if len(verifier.events) != 1 {
+		t.Fatalf("default observer got %d events, want the verification only", len(verifier.events))
+	}
+	if v := verifier.events[0]; v.Op != OpVerify || v.Leaves != leaves || v.Hashes != uint64(len(p.Siblings))+1 {
+		t.Fatalf("verify event %+v", v)
+	}
+
+	ev := NewExpvarObserver("merkletree_test")
+	ev.Observe(build)
+	ev.Observe(Event{Op: OpBuild, Leaves: 1, Hashes: 1, Err: ErrNoRecords})
+	m := expvar.Get("merkletree_test").(*expvar.Map)
+	for key, want := range map[string]string{"build.count": "2", "build.errors": "1", "build.hashes": fmt.Sprint(build.Hashes + 1), "build.leaves": "1"} {
+		if got := m.Get(key).String(); got != want {
+			t.Errorf("%s = %s, want %s", key, got, want)
+		}
+	}
+	if NewExpvarObserver("merkletree_test").m != m {
+		t.Fatal("a second observer published another map")
+	}
+}
+
+func TestConcurrentUpdates(t *testing.T) {
+	data := bytes.Repeat([]byte("concurrent"), 100)
+	mt, err := NewMerkleTree(data, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaves := mt.leafCount(mt.size)
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for r := 0; r < 8; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			for i := uint64(r); ; i++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				index := i % leaves
+				before := mt.Metadata()
+				p, err := mt.Proof(index)
+				if err != nil {
+					errs <- err
+					return
+				}
+				segment, err := mt.Segment(index)
+				if err != nil {
+					errs <- err
+					return
+				}
+				// the proof is only known to match the root when no update happened in between
+				if !bytes.Equal(before.Root, mt.GetRootHash()) {
+					continue
+				}
+				if err := before.VerifyProof(segment, p); err != nil {
+					errs <- fmt.Errorf("leaf %d: %w", index, err)
+					return
+				}
+			}
+		}(r)
+	}
+
+	for i := 0; i < 500; i++ {
+		index := uint64(i) % leaves
+		segment, err := mt.Segment(index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		segment[0]++
+		if err := mt.Update(index, segment); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if ok, err := mt.Validate(); !ok || err != nil {
+		t.Fatalf("Validate() = %v, %v", ok, err)
+	}
+	if !mt.Equals(mt) {
+		t.Fatal("tree differs from itself")
+	}
+}
+
+func TestConcurrentEquals(t *testing.T) {
+	data := bytes.Repeat([]byte("equals"), 100)
+	a, err := NewMerkleTree(data, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewMerkleTree(data, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.id == b.id {
+		t.Fatalf("two trees share id %d", a.id)
+	}
+
+	// comparisons in both directions, with updates queued behind them, must not deadlock
+	var wg sync.WaitGroup
+	for _, pair := range [][2]*MerkleTree{{a, b}, {b, a}} {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				pair[0].Equals(pair[1])
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				segment, _ := pair[0].Segment(uint64(i) % pair[0].LeafCount())
+				if err := pair[0].Update(uint64(i)%pair[0].LeafCount(), segment); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if !a.Equals(b) {
+		t.Fatal("trees rewritten with their own segments differ")
+	}
+}
+
+func TestVersions(t *testing.T) {
+	data := bytes.Repeat([]byte("versions"), 40)
+	mt, err := NewMerkleTree(data, 24)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := mt.Snapshot()
+	versions := [][]byte{append([]byte(nil), data...)}
+	for i, index := range []uint64{2, 7, 2} {
+		segment, err := mt.Segment(index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		segment[0] = byte('A' + i)
+		if err := mt.Update(index, segment); err != nil {
+			t.Fatal(err)
+		}
+		_, start, _, _, _ := mt.leafPath(index)
+		changed := append([]byte(nil), versions[len(versions)-1]...)
+		copy(changed[start:], segment)
+		versions = append(versions, changed)
+	}
+	if mt.Version() != 3 {
+		t.Fatalf("tree at version %d after 3 updates", mt.Version())
+	}
+
+	for v, want := range versions {
+		s, err := mt.At(uint64(v))
+		if err != nil {
+			t.Fatal(err)
+		}
+		built, err := NewMerkleTree(want, 24)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(s.GetRootHash(), built.GetRootHash()) {
+			t.Fatalf("version %d has another root than a tree built over its data", v)
+		}
+		if v == 0 && !bytes.Equal(first.GetRootHash(), built.GetRootHash()) {
+			t.Fatal("snapshot root changed after updates")
+		}
+		got, err := s.LeafHashes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if wantLeaves, _ := built.LeafHashes(); !reflect.DeepEqual(got, wantLeaves) {
+			t.Fatalf("version %d has other leaves than a tree built over its data", v)
+		}
+		for index := uint64(0); index < mt.leafCount(mt.size); index++ {
+			segment, err := s.Segment(index)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p, err := s.Proof(index)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Metadata().VerifyProof(segment, p); err != nil {
+				t.Fatalf("version %d leaf %d: %v", v, index, err)
+			}
+		}
+		rp, err := s.RangeProof(1, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, from, _, _, _ := mt.leafPath(1)
+		_, _, to, _, _ := mt.leafPath(3)
+		if err := s.Metadata().VerifyRangeProof(want[from:to], rp); err != nil {
+			t.Fatalf("version %d range: %v", v, err)
+		}
+	}
+	if _, err := mt.At(4); !errors.Is(err, ErrUnknownVersion) {
+		t.Fatalf("got %v for a future version, want %v", err, ErrUnknownVersion)
+	}
+	if err := mt.Prune(2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mt.At(1); !errors.Is(err, ErrUnknownVersion) {
+		t.Fatalf("got %v for a pruned version, want %v", err, ErrUnknownVersion)
+	}
+	if _, err := first.Proof(0); !errors.Is(err, ErrUnknownVersion) {
+		t.Fatalf("got %v from a pruned snapshot, want %v", err, ErrUnknownVersion)
+	}
+	if s, err := mt.At(2); err != nil || s.Root().Algorithm != "sha256" {
+		t.Fatalf("At(2) = %v, %v", s, err)
+	}
+	if err := mt.Prune(4); !errors.Is(err, ErrUnknownVersion) {
+		t.Fatalf("pruned beyond the current version: %v", err)
+	}
+	if err := mt.Prune(3); err != nil || len(mt.history.nodes) != 0 || len(mt.history.leaves) != 0 {
+		t.Fatalf("pruning every older version kept %d nodes and %d leaves: %v", len(mt.history.nodes), len(mt.history.leaves), err)
+	}
+
+	rt, err := NewMerkleTreeFromRecords([][]byte{[]byte("a"), {}, []byte("c")}, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.Update(1, []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	old, err := rt.At(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record, err := old.Segment(1); err != nil || len(record) != 0 {
+		t.Fatalf("version 0 record 1 is %q, %v", record, err)
+	}
+}
+
+func FuzzNewMerkleTree(f *testing.F) {
+	f.Add([]byte("fuzz"), uint64(1))
+	f.Add(bytes.Repeat([]byte("abc"), 33), uint64(7))
+	f.Add([]byte{}, uint64(3))
+	f.Add([]byte{1, 2, 3}, uint64(0))
+	f.Fuzz(func(t *testing.T, data []byte, segmentSize uint64) {
+		mt, err := NewMerkleTree(data, segmentSize)
+		if segmentSize == 0 {
+			if !errors.Is(err, ErrInvalidSegmentSize) {
+				t.Fatalf("got %v for a zero segment size", err)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok, err := mt.Validate(); !ok || err != nil {
+			t.Fatalf("Validate() = %v, %v", ok, err)
+		}
+		leaves, err := mt.LeafHashes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := mt.Metadata().VerifyLeafHashes(leaves); err != nil {
+			t.Fatal(err)
+		}
+		var covered []byte
+		for index := range leaves {
+			segment, err := mt.Segment(uint64(index))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(segment) > int(segmentSize) {
+				t.Fatalf("leaf %d holds %d bytes, segment size is %d", index, len(segment), segmentSize)
+			}
+			covered = append(covered, segment...)
+		}
+		if !bytes.Equal(covered, data) {
+			t.Fatal("leaves do not cover the data")
+		}
+	})
+}
+
+func FuzzProofRoundTrip(f *testing.F) {
+	f.Add([]byte("round trip"), uint64(3), uint64(2), uint64(4))
+	f.Add(bytes.Repeat([]byte{0xff}, 100), uint64(9), uint64(0), uint64(11))
+	f.Fuzz(func(t *testing.T, data []byte, segmentSize uint64, index, end uint64) {
+		if segmentSize == 0 {
+			return
+		}
+		mt, err := NewMerkleTree(data, segmentSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		meta := mt.Metadata()
+		leaves := mt.leafCount(mt.size)
+		index %= leaves
+		p, err := mt.Proof(index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		segment, err := mt.Segment(index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := meta.VerifyProof(segment, p); err != nil {
+			t.Fatal(err)
+		}
+		if len(segment) > 0 {
+			segment[len(segment)/2] ^= 1
+			if err := meta.VerifyProof(segment, p); !errors.Is(err, ErrInvalidProof) {
+				t.Fatalf("verified a changed segment: %v", err)
+			}
+		}
+		var decoded Proof
+		if b, err := json.Marshal(p); err != nil {
+			t.Fatal(err)
+		} else if err := json.Unmarshal(b, &decoded); err != nil || !reflect.DeepEqual(&decoded, p) {
+			t.Fatalf("proof changed in JSON: %v", err)
+		}
+
+		end = index + 1 + end%(leaves-index)
+		rp, err := mt.RangeProof(index, end)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, from, _, _, _ := mt.leafPath(index)
+		_, _, to, _, _ := mt.leafPath(end - 1)
+		if err := meta.VerifyRangeProof(data[from:to], rp); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// FuzzDecode checks that decoding arbitrary input never panics and that
+// whatever decodes encodes back to the same bytes.
+func FuzzDecode(f *testing.F) {
+	mt, _ := NewMerkleTree([]byte("decoding seeds"), 4)
+	p, _ := mt.Proof(1)
+	rp, _ := mt.RangeProof(0, 2)
+	for _, v := range []any{mt.Root(), mt.Metadata(), p, rp} {
+		b, _ := json.Marshal(v)
+		f.Add(b)
+		if m, ok := v.(encoding.TextMarshaler); ok {
+			text, _ := m.MarshalText()
+			f.Add(text)
+		}
+	}
+	f.Add([]byte(`{"algorithm":"sha256","index":1,"siblings":["00"]}`))
+	f.Add([]byte("not json"))
+	f.Fuzz(func(t *testing.T, input []byte) {
+		for _, v := range []any{new(Root), new(Metadata), new(Proof), new(RangeProof), new(InclusionProof), new(ConsistencyProof), new(SignedTreeHead)} {
+			if json.Unmarshal(input, v) == nil {
+				checkReencodes(t, v, json.Marshal, json.Unmarshal)
+			}
+			if u, ok := v.(encoding.TextUnmarshaler); ok && u.UnmarshalText(input) == nil {
+				checkReencodes(t, v, func(v any) ([]byte, error) {
+					return v.(encoding.TextMarshaler).MarshalText()
+				}, func(b []byte, v any) error {
+					return v.(encoding.TextUnmarshaler).UnmarshalText(b)
+				})
+			}
+		}
+	})
+}
+
+func checkReencodes(t *testing.T, v any, marshal func(any) ([]byte, error), unmarshal func([]byte, any) error) {
+	t.Helper()
+	b, err := marshal(v)
+	if err != nil {
+		t.Fatalf("%T decoded but does not encode: %v", v, err)
+	}
+	again := reflect.New(reflect.TypeOf(v).Elem()).Interface()
+	if err := unmarshal(b, again); err != nil {
+		t.Fatalf("%T does not decode its own encoding %q: %v", v, b, err)
+	}
+	if b2, _ := marshal(again); !bytes.Equal(b, b2) {
+		t.Fatalf("%T encodes as %q, then as %q", v, b, b2)
+	}
+}
+
+func TestMutatingAnyByteChangesRoot(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	for _, segmentSize := range []uint64{1, 5, 16, 1000} {
+		data := make([]byte, 97)
+		for i := range data {
+			data[i] = byte(rng.Uint32())
+		}
+		mt, err := NewMerkleTree(data, segmentSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range data {
+			changed := append([]byte(nil), data...)
+			changed[i] ^= byte(1 + rng.IntN(255))
+			other, err := NewMerkleTree(changed, segmentSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Equal(mt.GetRootHash(), other.GetRootHash()) || mt.Equals(other) {
+				t.Fatalf("segment size %d: changing byte %d kept the root", segmentSize, i)
+			}
+		}
+	}
+}
+
+func TestEqualsReflexiveAndSymmetric(t *testing.T) {
+	rng := rand.New(rand.NewPCG(3, 4))
+	var trees []*MerkleTree
+	for i := 0; i < 12; i++ {
+		data := make([]byte, rng.IntN(40))
+		for j := range data {
+			data[j] = byte(rng.IntN(3))
+		}
+		mt, err := NewMerkleTree(data, uint64(1+rng.IntN(8)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		trees = append(trees, mt)
+		// an identical tree built separately
+		twin, _ := NewMerkleTree(data, mt.segmentSize)
+		trees = append(trees, twin)
+	}
+	for i, a := range trees {
+		if !a.Equals(a) {
+			t.Fatalf("tree %d differs from itself", i)
+		}
+		for j, b := range trees {
+			if a.Equals(b) != b.Equals(a) {
+				t.Fatalf("trees %d and %d: Equals is not symmetric", i, j)
+			}
+			if i^1 == j && !a.Equals(b) {
+				t.Fatalf("trees %d and %d are built over the same data but differ", i, j)
+			}
+		}
+	}
+}
+
+func TestValidateDetectsCorruption(t *testing.T) {
+	data := bytes.Repeat([]byte("corrupt"), 23)
+	for _, segmentSize := range []uint64{1, 6, 50} {
+		mt, err := NewMerkleTree(data, segmentSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		store := mt.store.(*MemoryStore)
+		for pos := uint64(0); pos <= mt.rootPos(); pos++ {
+			digest := store.nodes[pos]
+			corrupted := append([]byte(nil), digest...)
+			corrupted[pos%uint64(len(corrupted))] ^= 0x80
+			store.nodes[pos] = corrupted
+			if ok, err := mt.Validate(); ok || err != nil {
+				t.Fatalf("segment size %d: Validate() = %v, %v with node %d corrupted", segmentSize, ok, err, pos)
+			}
+			store.nodes[pos] = digest
+		}
+		if ok, err := mt.Validate(); !ok || err != nil {
+			t.Fatalf("Validate() = %v, %v after restoring every node", ok, err)
+		}
+	}
+}
+
+// TestDifferential compares every way of building and changing a tree
+// against the reference implementation over random inputs.
+func TestDifferential(t *testing.T) {
+	rng := rand.New(rand.NewPCG(5, 6))
+	randomBytes := func(n int) []byte {
+		b := make([]byte, n)
+		for i := range b {
+			b[i] = byte(rng.Uint32())
+		}
+		return b
+	}
+
+	for round := 0; round < 60; round++ {
+		data := randomBytes(rng.IntN(300))
+		segmentSize := uint64(1 + rng.IntN(40))
+		if round%10 == 0 {
+			segmentSize = uint64(len(data) + 1)
+		}
+		arity := []int{2, 3, 4, 16}[round%4]
+		var built *MerkleTree
+		var err error
+		if arity == 2 {
+			built, err = NewMerkleTree(data, segmentSize)
+		} else {
+			built, err = NewMerkleTreeFromReader(bytes.NewReader(data), uint64(len(data)), Config{SegmentSize: segmentSize, Arity: arity})
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		streamed, err := NewMerkleTreeFromReader(io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data))), uint64(len(data)), Config{
+			SegmentSize: segmentSize,
+			Arity:       arity,
+			Store:       openFileStore(t, sha256.Size),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := LoadMerkleTree(bytes.NewReader(data), uint64(len(data)), Config{SegmentSize: segmentSize, Arity: arity, Store: streamed.store})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := reference.Bytes(data, int(segmentSize), arity, sha256.New)
+		for name, mt := range map[string]*MerkleTree{"NewMerkleTree": built, "NewMerkleTreeFromReader": streamed, "LoadMerkleTree": loaded} {
+			compareWithReference(t, fmt.Sprintf("round %d %s", round, name), mt, want)
+		}
+
+		// incremental: update leaves one at a time
+		for i := 0; i < 5; i++ {
+			index := rng.Uint64N(built.leafCount(built.size))
+			_, start, end, _, _ := built.leafPath(index)
+			segment := randomBytes(int(end - start))
+			if err := built.Update(index, segment); err != nil {
+				t.Fatal(err)
+			}
+			copy(data[start:end], segment)
+			compareWithReference(t, fmt.Sprintf("round %d update %d", round, i), built, reference.Bytes(data, int(segmentSize), arity, sha256.New))
+		}
+
+		records := make([][]byte, 1+rng.IntN(40))
+		for i := range records {
+			records[i] = randomBytes(rng.IntN(20))
+		}
+		rt, err := NewMerkleTreeFromRecords(records, Config{Arity: arity})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want = reference.Records(records, arity, sha256.New)
+		compareWithReference(t, fmt.Sprintf("round %d records", round), rt, want)
+		var leaves [][]byte
+		for _, leaf := range want.Leaves() {
+			leaves = append(leaves, leaf.Hash)
+		}
+		lt, err := NewMerkleTreeFromLeafHashes(leaves, Config{Arity: arity})
+		if err != nil {
+			t.Fatal(err)
+		}
+		compareWithReference(t, fmt.Sprintf("round %d leaf hashes", round), lt, want)
+
+		index := rng.Uint64N(uint64(len(records)))
+		records[index] = randomBytes(rng.IntN(20))
+		if err := rt.Update(index, records[index]); err != nil {
+			t.Fatal(err)
+		}
+		compareWithReference(t, fmt.Sprintf("round %d record update", round), rt, reference.Records(records, arity, sha256.New))
+	}
+}
+
+func compareWithReference(t *testing.T, name string, mt *MerkleTree, want *reference.Node) {
+	t.Helper()
+	if !bytes.Equal(mt.GetRootHash(), want.Hash) {
+		t.Fatalf("%s: root %x, reference %x", name, mt.GetRootHash(), want.Hash)
+	}
+	wantLeaves := want.Leaves()
+	leaves, err := mt.LeafHashes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leaves) != len(wantLeaves) {
+		t.Fatalf("%s: %d leaves, reference %d", name, len(leaves), len(wantLeaves))
+	}
+	for i, leaf := range wantLeaves {
+		if !bytes.Equal(leaves[i], leaf.Hash) {
+			t.Fatalf("%s: leaf %d differs from the reference", name, i)
+		}
+		p, err := mt.Proof(uint64(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		siblings := want.Proof(i)
+		if len(p.Siblings) != len(siblings) {
+			t.Fatalf("%s: proof of leaf %d has %d siblings, reference %d", name, i, len(p.Siblings), len(siblings))
+		}
+		for j := range siblings {
+			if !bytes.Equal(p.Siblings[j], siblings[j]) {
+				t.Fatalf("%s: sibling %d of leaf %d differs from the reference", name, j, i)
+			}
+		}
+	}
+}
+
+func openFileStore(t *testing.T, digestSize int) *FileStore {
+	t.Helper()
+	fs, err := OpenFileStore(filepath.Join(t.TempDir(), "nodes"), digestSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { fs.Close() })
+	return fs
+}
+
+func TestIterators(t *testing.T) {
+	data := bytes.Repeat([]byte("iterate"), 13)
+	mt, err := NewMerkleTree(data, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := mt.LeafHashes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var leaves [][]byte
+	var end uint64
+	for n := range mt.Leaves() {
+		if !n.Leaf || n.Start != end || n.FirstLeaf != uint64(len(leaves)) {
+			t.Fatalf("leaf %d is %+v", len(leaves), n)
+		}
+		leaves = append(leaves, n.Hash)
+		end = n.End
+	}
+	if !reflect.DeepEqual(leaves, want) || end != mt.size || uint64(len(leaves)) != mt.LeafCount() {
+		t.Fatalf("walked %d leaves up to byte %d", len(leaves), end)
+	}
+
+	var dfs, bfs []Node
+	for n := range mt.Nodes(DepthFirst) {
+		dfs = append(dfs, n)
+	}
+	for n := range mt.Nodes(BreadthFirst) {
+		bfs = append(bfs, n)
+	}
+	if uint64(len(dfs)) != mt.NodeCount() || len(bfs) != len(dfs) {
+		t.Fatalf("walked %d nodes depth first and %d breadth first, tree has %d", len(dfs), len(bfs), mt.NodeCount())
+	}
+	if dfs[0].Pos != mt.rootPos() || !bytes.Equal(dfs[0].Hash, mt.GetRootHash()) || bfs[0].Pos != dfs[0].Pos {
+		t.Fatal("walks do not start at the root")
+	}
+	maxDepth := 0
+	for i, n := range bfs {
+		if i > 0 && n.Depth < bfs[i-1].Depth {
+			t.Fatalf("breadth first walk went from depth %d to %d", bfs[i-1].Depth, n.Depth)
+		}
+		maxDepth = max(maxDepth, n.Depth)
+	}
+	if maxDepth != mt.Depth() {
+		t.Fatalf("deepest node at %d, Depth() = %d", maxDepth, mt.Depth())
+	}
+
+	for depth := 0; depth <= mt.Depth(); depth++ {
+		var level []Node
+		for n := range mt.Level(depth) {
+			level = append(level, n)
+		}
+		var fromBFS []Node
+		for _, n := range bfs {
+			if n.Depth == depth {
+				fromBFS = append(fromBFS, n)
+			}
+		}
+		if !reflect.DeepEqual(level, fromBFS) {
+			t.Fatalf("level %d differs from the breadth first walk", depth)
+		}
+	}
+
+	// stopping early and updating during a walk
+	third, _ := mt.Segment(2)
+	count := 0
+	for n := range mt.Leaves() {
+		if count++; count == 1 {
+			if err := mt.Update(2, bytes.ToUpper(third)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if !bytes.Equal(n.Hash, want[n.FirstLeaf]) {
+			t.Fatalf("leaf %d changed during the walk", n.FirstLeaf)
+		}
+		if count == 3 {
+			break
+		}
+	}
+	if count != 3 {
+		t.Fatalf("walk stopped after %d leaves", count)
+	}
+
+	single, _ := NewMerkleTree([]byte("one"), 8)
+	if single.Depth() != 0 || single.LeafCount() != 1 || single.NodeCount() != 1 {
+		t.Fatalf("single leaf tree: depth %d, %d leaves, %d nodes", single.Depth(), single.LeafCount(), single.NodeCount())
+	}
+}
+
+func TestRender(t *testing.T) {
+	data := bytes.Repeat([]byte("render"), 10)
+	mt, err := NewMerkleTree(data, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path, err := mt.ProofNodes(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _ := mt.Proof(2)
+	if len(path) != 1+2*len(p.Siblings) || !slices.Contains(path, mt.rootPos()) {
+		t.Fatalf("proof of leaf 2 involves nodes %v", path)
+	}
+
+	var dot strings.Builder
+	if err := mt.WriteDOT(&dot, RenderOptions{Highlight: path}); err != nil {
+		t.Fatal(err)
+	}
+	root := hex.EncodeToString(mt.GetRootHash()[:4]) + "…"
+	for _, want := range []string{
+		"digraph merkletree {",
+		fmt.Sprintf(`n%d [label="pos %d\nbytes [0, 60)\n%s", style="filled", fillcolor=gold];`, mt.rootPos(), mt.rootPos(), root),
+		fmt.Sprintf("n%d -> n%d;", mt.rootPos(), mt.rootPos()-1),
+	} {
+		if !strings.Contains(dot.String(), want) {
+			t.Fatalf("DOT output lacks %q:\n%s", want, dot.String())
+		}
+	}
+	if got := strings.Count(dot.String(), "->"); uint64(got) != mt.NodeCount()-1 {
+		t.Fatalf("DOT output has %d edges, want %d", got, mt.NodeCount()-1)
+	}
+
+	var mermaid strings.Builder
+	if err := mt.WriteMermaid(&mermaid, RenderOptions{MaxDepth: 1, HashBytes: 32}); err != nil {
+		t.Fatal(err)
+	}
+	out := mermaid.String()
+	if !strings.HasPrefix(out, "graph TD\n") || strings.Count(out, "-->") != 2 || strings.Contains(out, "highlight") {
+		t.Fatalf("Mermaid output:\n%s", out)
+	}
+	children := mt.children(mt.rootPos(), 0, mt.size)
+	if !strings.Contains(out, fmt.Sprintf("class n%d,n%d truncated", children[0].pos, children[1].pos)) || !strings.Contains(out, hex.EncodeToString(mt.GetRootHash())+`"]`) {
+		t.Fatalf("Mermaid output:\n%s", out)
+	}
+
+	other, _ := NewMerkleTree(data, 8)
+	if diff, err := mt.Diff(other); err != nil || len(diff) != 0 {
+		t.Fatalf("Diff() = %v, %v for identical trees", diff, err)
+	}
+	segment, _ := other.Segment(2)
+	if err := other.Update(2, bytes.ToUpper(segment)); err != nil {
+		t.Fatal(err)
+	}
+	diff, err := mt.Diff(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diff) != 1+len(p.Siblings) || diff[0] != mt.rootPos() {
+		t.Fatalf("Diff() = %v after updating leaf 2", diff)
+	}
+	one, _ := NewMerkleTree([]byte("one"), 8)
+	if _, err := mt.Diff(one); err == nil {
+		t.Fatal("diffed trees of different shapes")
+	}
+}
+
+// sparseReader reads 'size' bytes that are zero except for 'marks', without holding them.
+type sparseReader struct {
+	size  int64
+	marks map[int64]byte
+}
+
+func (r sparseReader) ReadAt(p []byte, off int64) (int, error) {
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	n := int(min(int64(len(p)), r.size-off))
+	clear(p[:n])
+	for at, b := range r.marks {
+		if at >= off && at < off+int64(n) {
+			p[at-off] = b
+		}
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func TestDataBeyond4GiB(t *testing.T) {
+	if testing.Short() {
+		t.Skip("hashes 10 GiB")
+	}
+	// CRC-32C keeps hashing this much data fast; the shape does not depend on the hash
+	crc32c := func() hash.Hash { return crc32.New(crc32.MakeTable(crc32.Castagnoli)) }
+	RegisterHash("crc32c-test", crc32c)
+
+	const size = 5<<30 + 12345
+	mark := int64(1<<32 + 7)
+	cfg := Config{SegmentSize: 1 << 20, NewHash: crc32c}
+	r := sparseReader{size: size, marks: map[int64]byte{mark: 'x', 7: 'y'}}
+	mt, err := NewMerkleTreeFromReader(r, size, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := mt.Metadata()
+	if meta.Size != size {
+		t.Fatalf("metadata covers %d bytes, want %d", meta.Size, size)
+	}
+
+	var marked Node
+	for n := range mt.Leaves() {
+		if n.Start <= uint64(mark) && uint64(mark) < n.End {
+			marked = n
+		}
+	}
+	segment, err := mt.Segment(marked.FirstLeaf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if segment[uint64(mark)-marked.Start] != 'x' {
+		t.Fatalf("leaf %d over [%d, %d) does not hold the byte at %d", marked.FirstLeaf, marked.Start, marked.End, mark)
+	}
+	p, err := mt.Proof(marked.FirstLeaf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := meta.VerifyProof(segment, p); err != nil {
+		t.Fatal(err)
+	}
+
+	// a range across the first byte beyond 2^32
+	rp, err := mt.RangeProof(marked.FirstLeaf-1, marked.FirstLeaf+2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, from, _, _, _ := mt.leafPath(marked.FirstLeaf - 1)
+	_, _, to, _, _ := mt.leafPath(marked.FirstLeaf + 1)
+	data := make([]byte, to-from)
+	if _, err := r.ReadAt(data, int64(from)); err != nil {
+		t.Fatal(err)
+	}
+	if err := meta.VerifyRangeProof(data, rp); err != nil {
+		t.Fatal(err)
+	}
+
+	// changing the byte beyond 2^32 leaves the byte it would wrap around to alone
+	r.marks = map[int64]byte{mark: 'z', 7: 'y'}
+	other, err := NewMerkleTreeFromReader(r, size, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(other.GetRootHash(), mt.GetRootHash()) {
+		t.Fatal("changing the byte beyond 2^32 kept the root")
+	}
+	segment[uint64(mark)-marked.Start] = 'z'
+	if err := mt.Update(marked.FirstLeaf, segment); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(other.GetRootHash(), mt.GetRootHash()) {
+		t.Fatal("updating the leaf beyond 2^32 differs from building over the changed data")
+	}
+
+	var decoded Metadata
+	b, _ := json.Marshal(other.Metadata())
+	if err := json.Unmarshal(b, &decoded); err != nil || decoded.Size != size {
+		t.Fatalf("metadata decoded with size %d: %v", decoded.Size, err)
+	}
+}
+
+func TestArity(t *testing.T) {
+	data := bytes.Repeat([]byte("k-ary trees "), 91)
+	binaryTree, err := NewMerkleTree(data, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, arity := range []int{3, 4, 8, 16} {
+		mt, err := NewMerkleTreeFromReader(bytes.NewReader(data), uint64(len(data)), Config{SegmentSize: 8, Arity: arity})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mt.Depth() >= binaryTree.Depth() || mt.Equals(binaryTree) {
+			t.Fatalf("arity %d: depth %d, binary depth %d", arity, mt.Depth(), binaryTree.Depth())
+		}
+		if ok, err := mt.Validate(); !ok || err != nil {
+			t.Fatalf("arity %d: Validate() = %v, %v", arity, ok, err)
+		}
+
+		meta := mt.Metadata()
+		if meta.Arity != arity {
+			t.Fatalf("metadata has arity %d, want %d", meta.Arity, arity)
+		}
+		text, err := meta.MarshalText()
+		if err != nil || !strings.HasSuffix(string(text), fmt.Sprintf(":arity=%d", arity)) {
+			t.Fatalf("MarshalText() = %s, %v", text, err)
+		}
+		var decoded Metadata
+		if err := decoded.UnmarshalText(text); err != nil || !reflect.DeepEqual(decoded, meta) {
+			t.Fatalf("UnmarshalText(%s) = %+v, %v", text, decoded, err)
+		}
+		js, _ := json.Marshal(meta)
+		if err := json.Unmarshal(js, &decoded); err != nil || !reflect.DeepEqual(decoded, meta) {
+			t.Fatalf("json.Unmarshal(%s) = %+v, %v", js, decoded, err)
+		}
+
+		for i := range mt.LeafCount() {
+			p, err := mt.Proof(i)
+			if err != nil {
+				t.Fatal(err)
+			}
+			segment, _ := mt.Segment(i)
+			if err := meta.VerifyProof(segment, p); err != nil {
+				t.Fatalf("arity %d leaf %d: %v", arity, i, err)
+			}
+			if err := binaryTree.Metadata().VerifyProof(segment, p); err == nil {
+				t.Fatalf("arity %d proof verified against a binary tree: %v", arity, err)
+			}
+		}
+		rp, err := mt.RangeProof(3, 40)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, from, _, _, _ := mt.leafPath(3)
+		_, _, to, _, _ := mt.leafPath(39)
+		if err := meta.VerifyRangeProof(data[from:to], rp); err != nil {
+			t.Fatalf("arity %d range: %v", arity, err)
+		}
+
+		var interleaved bytes.Buffer
+		if err := mt.WriteInterleaved(&interleaved); err != nil {
+			t.Fatal(err)
+		}
+		vr, err := NewInterleavedVerifyingReader(&interleaved, meta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := io.ReadAll(vr); err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("arity %d interleaved read: %v", arity, err)
+		}
+	}
+
+	for _, arity := range []int{-1, 1, maxArity + 1} {
+		if _, err := NewMerkleTreeFromRecords([][]byte{{1}}, Config{Arity: arity}); err != ErrInvalidArity {
+			t.Fatalf("arity %d: got %v, want %v", arity, err, ErrInvalidArity)
+		}
+	}
+	var meta Metadata
+	if err := meta.UnmarshalText([]byte("sha256:8:1092:" + strings.Repeat("00", 32) + ":arity=1")); !errors.Is(err, ErrInvalidEncoding) {
+		t.Fatalf("got %v, want %v", err, ErrInvalidEncoding)
+	}
+}
+
+func TestCountsComputedOnce(t *testing.T) {
+	data := bytes.Repeat([]byte("counted"), 1000)
+	mt, err := NewMerkleTreeFromReader(bytes.NewReader(data), uint64(len(data)), Config{SegmentSize: 10, Arity: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pos, start, end := mt.rootPos(), uint64(0), mt.size
+	if allocs := testing.AllocsPerRun(100, func() { mt.leafCount(mt.size) }); allocs != 0 {
+		t.Fatalf("counting leaves allocated %v times", allocs)
+	}
+	// only the slice of children is allocated, not a table per call
+	for !mt.isLeaf(start, end) {
+		if allocs := testing.AllocsPerRun(100, func() { mt.children(pos, start, end) }); allocs != 1 {
+			t.Fatalf("children of [%d, %d) allocated %v times", start, end, allocs)
+		}
+		c := mt.children(pos, start, end)[1]
+		pos, start, end = c.pos, c.start, c.end
+	}
+
+	// layouts made without the table count the same
+	bare := mt.layout
+	bare.counted = nil
+	if !bare.same(mt.layout) || bare.leafCount(bare.size) != mt.leafCount(mt.size) || bare.rootPos() != mt.rootPos() {
+		t.Fatal("counts differ without the table")
+	}
+}
+
+func TestShapes(t *testing.T) {
+	rng := rand.New(rand.NewPCG(7, 8))
+	references := map[Shape]func(records [][]byte, arity int, newHash func() hash.Hash) *reference.Node{
+		ShapeLeafCount:    reference.Records,
+		ShapeLeftBalanced: reference.LeftBalanced,
+		ShapeComplete:     reference.Complete,
+	}
+	for shape, build := range references {
+		for _, arity := range []int{2, 3, 4} {
+			for _, size := range []int{0, 1, 7, 8, 9, 64, 100, 257} {
+				name := fmt.Sprintf("%v arity %d size %d", shape, arity, size)
+				data := make([]byte, size)
+				for i := range data {
+					data[i] = byte(rng.Uint32())
+				}
+				cfg := Config{SegmentSize: 8, Arity: arity, Shape: shape}
+				mt, err := NewMerkleTreeFromReader(bytes.NewReader(data), uint64(size), cfg)
+				if err != nil {
+					t.Fatal(err)
+				}
+				compareWithReference(t, name, mt, build(reference.Segments(data, 8), arity, sha256.New))
+				if ok, err := mt.Validate(); !ok || err != nil {
+					t.Fatalf("%s: Validate() = %v, %v", name, ok, err)
+				}
+				if n := uint64(len(slices.Collect(mt.Leaves()))); n != mt.LeafCount() {
+					t.Fatalf("%s: Leaves() yields %d leaves, LeafCount() = %d", name, n, mt.LeafCount())
+				}
+
+				meta := mt.Metadata()
+				text, _ := meta.MarshalText()
+				var decoded Metadata
+				if err := decoded.UnmarshalText(text); err != nil || decoded.Shape != shape {
+					t.Fatalf("%s: UnmarshalText(%s) = %v, %v", name, text, decoded.Shape, err)
+				}
+				leaves, _ := mt.LeafHashes()
+				if err := decoded.VerifyLeafHashes(leaves); err != nil {
+					t.Fatalf("%s: %v", name, err)
+				}
+				last := mt.LeafCount() - 1
+				p, _ := mt.Proof(last)
+				segment, _ := mt.Segment(last)
+				if err := decoded.VerifyProof(segment, p); err != nil {
+					t.Fatalf("%s: %v", name, err)
+				}
+				rp, _ := mt.RangeProof(0, mt.LeafCount())
+				if err := decoded.VerifyRangeProof(data, rp); err != nil {
+					t.Fatalf("%s: range: %v", name, err)
+				}
+
+				// the last leaf may be short, even when padding follows it
+				for i := range segment {
+					segment[i] ^= 0xff
+				}
+				if err := mt.Update(last, segment); err != nil {
+					t.Fatal(err)
+				}
+				copy(data[len(data)-len(segment):], segment)
+				compareWithReference(t, name+" updated", mt, build(reference.Segments(data, 8), arity, sha256.New))
+				var interleaved bytes.Buffer
+				if err := mt.WriteInterleaved(&interleaved); err != nil {
+					t.Fatal(err)
+				}
+				vr, err := NewInterleavedVerifyingReader(&interleaved, mt.Metadata())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, err := io.ReadAll(vr); err != nil || !bytes.Equal(got, data) {
+					t.Fatalf("%s: interleaved read: %v", name, err)
+				}
+			}
+
+			records := make([][]byte, 1+rng.IntN(30))
+			for i := range records {
+				records[i] = []byte(fmt.Sprint(i))
+			}
+			rt, err := NewMerkleTreeFromRecords(records, Config{Arity: arity, Shape: shape})
+			if err != nil {
+				t.Fatal(err)
+			}
+			compareWithReference(t, fmt.Sprintf("%v arity %d records", shape, arity), rt, build(records, arity, sha256.New))
+		}
+	}
+
+	if _, err := NewMerkleTreeFromRecords([][]byte{{1}}, Config{Shape: ShapeComplete + 1}); !errors.Is(err, ErrInvalidShape) {
+		t.Fatalf("got %v, want %v", err, ErrInvalidShape)
+	}
+	if _, err := NewMerkleTreeFromReader(bytes.NewReader(nil), maxSize, Config{SegmentSize: 1, Arity: 256, Shape: ShapeComplete}); err == nil {
+		t.Fatal("built a complete tree whose padding overflows")
+	}
+	var meta Metadata
+	if err := meta.UnmarshalText([]byte("sha256:8:100:" + strings.Repeat("00", 32) + ":shape=round")); !errors.Is(err, ErrInvalidEncoding) {
+		t.Fatalf("got %v, want %v", err, ErrInvalidEncoding)
+	}
+}
+
+func TestKeyedTrees(t *testing.T) {
+	key := []byte("integrity check secret")
+	data := bytes.Repeat([]byte("keyed "), 30)
+	for _, hashfn := range []func() hash.Hash{sha256.New, sha512.New} {
+		mt, err := NewMerkleTreeFromReader(bytes.NewReader(data), uint64(len(data)), Config{SegmentSize: 90, NewHash: hashfn, Key: key, KeyID: "ops-2026"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		mac := func(parts ...[]byte) []byte {
+			h := hmac.New(hashfn, key)
+			for _, part := range parts {
+				h.Write(part)
+			}
+			return h.Sum(nil)
+		}
+		if want := mac(mac(data[:90]), mac(data[90:])); !bytes.Equal(mt.GetRootHash(), want) {
+			t.Fatalf("root %x, want %x", mt.GetRootHash(), want)
+		}
+		plain, _ := NewMerkleTreeFromReader(bytes.NewReader(data), uint64(len(data)), Config{SegmentSize: 90, NewHash: hashfn})
+		if bytes.Equal(mt.GetRootHash(), plain.GetRootHash()) || mt.Equals(plain) {
+			t.Fatal("keyed and unkeyed trees match")
+		}
+
+		meta := mt.Metadata()
+		p, err := mt.Proof(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if meta.KeyID != "ops-2026" || p.KeyID != "ops-2026" {
+			t.Fatalf("metadata key %q, proof key %q", meta.KeyID, p.KeyID)
+		}
+		if err := meta.VerifyProof(data[90:], p); !errors.Is(err, ErrUnknownKey) {
+			t.Fatalf("got %v, want %v", err, ErrUnknownKey)
+		}
+		// verifiers in one process may hold different keys under the same ID
+		verifier := Verifier{Keys: Keyring{"ops-2026": key}}
+		other := Verifier{Keys: Keyring{"ops-2026": []byte("some other secret")}}
+		if err := other.VerifyProof(meta, data[90:], p); !errors.Is(err, ErrInvalidProof) {
+			t.Fatalf("verified with the wrong key: %v", err)
+		}
+		if err := verifier.VerifyProof(meta, data[90:], p); err != nil {
+			t.Fatal(err)
+		}
+		if err := (Verifier{Keys: Keyring{"ops-2026": nil}}).VerifyProof(meta, data[90:], p); !errors.Is(err, ErrInvalidKey) {
+			t.Fatalf("got %v, want %v", err, ErrInvalidKey)
+		}
+		unkeyed := *p
+		unkeyed.KeyID = ""
+		if err := verifier.VerifyProof(meta, data[90:], &unkeyed); !errors.Is(err, ErrInvalidProof) {
+			t.Fatalf("proof without its key ID verified: %v", err)
+		}
+		rp, _ := mt.RangeProof(0, 2)
+		if err := verifier.VerifyRangeProof(meta, data, rp); err != nil {
+			t.Fatal(err)
+		}
+		leaves, _ := mt.LeafHashes()
+		if err := verifier.VerifyLeafHashes(meta, leaves); err != nil {
+			t.Fatal(err)
+		}
+		if err := other.VerifyLeafHashes(meta, leaves); !errors.Is(err, ErrInvalidProof) {
+			t.Fatalf("leaf hashes verified with the wrong key: %v", err)
+		}
+		var interleaved bytes.Buffer
+		if err := mt.WriteInterleaved(&interleaved); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewInterleavedVerifyingReader(bytes.NewReader(interleaved.Bytes()), meta); !errors.Is(err, ErrUnknownKey) {
+			t.Fatalf("got %v, want %v", err, ErrUnknownKey)
+		}
+		vr, err := verifier.NewInterleavedVerifyingReader(&interleaved, meta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := io.ReadAll(vr); err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("interleaved read: %v", err)
+		}
+
+		// the key shows up in nothing the tree prints or encodes
+		var outputs [][]byte
+		outputs = append(outputs, []byte(mt.String()), []byte(fmt.Sprintf("%#v %+v", mt, mt)))
+		for _, v := range []any{meta, p, rp} {
+			text, err := v.(encoding.TextMarshaler).MarshalText()
+			if err != nil {
+				t.Fatal(err)
+			}
+			js, err := json.Marshal(v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			outputs = append(outputs, text, js)
+		}
+		var decoded Proof
+		if err := decoded.UnmarshalText(outputs[4]); err != nil || decoded.KeyID != p.KeyID {
+			t.Fatalf("UnmarshalText(%s) = %q, %v", outputs[4], decoded.KeyID, err)
+		}
+		for _, out := range outputs {
+			if bytes.Contains(out, key) || bytes.Contains(out, []byte(hex.EncodeToString(key))) || bytes.Contains(out, []byte(fmt.Sprint(key))) {
+				t.Fatalf("output leaks the key: %s", out)
+			}
+		}
+	}
+
+	for _, cfg := range []Config{{Key: key}, {KeyID: "ops"}, {Key: key, KeyID: "ops:1"}, {Key: []byte{}, KeyID: "ops"}} {
+		if _, err := NewMerkleTreeFromRecords([][]byte{{1}}, cfg); !errors.Is(err, ErrInvalidKey) {
+			t.Fatalf("%+v: got %v, want %v", cfg, err, ErrInvalidKey)
+		}
+	}
+}
+
+func TestSaltedTrees(t *testing.T) {
+	salt := []byte("per-tree salt")
+	data := bytes.Repeat([]byte("salted "), 20)
+	mt, err := NewMerkleTreeFromReader(bytes.NewReader(data), uint64(len(data)), Config{SegmentSize: 70, Salt: salt})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := func(parts ...[]byte) []byte {
+		h := sha256.New()
+		h.Write(salt)
+		for _, part := range parts {
+			h.Write(part)
+		}
+		return h.Sum(nil)
+	}
+	if want := sum(sum(data[:70]), sum(data[70:])); !bytes.Equal(mt.GetRootHash(), want) {
+		t.Fatalf("root %x, want %x", mt.GetRootHash(), want)
+	}
+	for _, other := range []Config{{SegmentSize: 70}, {SegmentSize: 70, Salt: []byte("another salt")}} {
+		o, _ := NewMerkleTreeFromReader(bytes.NewReader(data), uint64(len(data)), other)
+		if bytes.Equal(o.GetRootHash(), mt.GetRootHash()) {
+			t.Fatalf("salt %q gives the same root", other.Salt)
+		}
+	}
+
+	meta := mt.Metadata()
+	text, _ := meta.MarshalText()
+	if !strings.HasSuffix(string(text), ":salt="+hex.EncodeToString(salt)) {
+		t.Fatalf("MarshalText() = %s", text)
+	}
+	var decoded Metadata
+	if err := decoded.UnmarshalText(text); err != nil || !bytes.Equal(decoded.Salt, salt) {
+		t.Fatalf("UnmarshalText(%s) = %q, %v", text, decoded.Salt, err)
+	}
+	js, _ := json.Marshal(meta)
+	if err := json.Unmarshal(js, &decoded); err != nil || !reflect.DeepEqual(decoded, meta) {
+		t.Fatalf("json.Unmarshal(%s) = %+v, %v", js, decoded, err)
+	}
+
+	if err := mt.Update(0, bytes.ToUpper(data[:70])); err != nil {
+		t.Fatal(err)
+	}
+	copy(data, bytes.ToUpper(data[:70]))
+	meta = mt.Metadata()
+	p, _ := mt.Proof(0)
+	if err := meta.VerifyProof(data[:70], p); err != nil {
+		t.Fatal(err)
+	}
+	unsalted := meta
+	unsalted.Salt = nil
+	if err := unsalted.VerifyProof(data[:70], p); !errors.Is(err, ErrInvalidProof) {
+		t.Fatalf("proof verified without the salt: %v", err)
+	}
+	rp, _ := mt.RangeProof(0, 2)
+	if err := meta.VerifyRangeProof(data, rp); err != nil {
+		t.Fatal(err)
+	}
+	leaves, _ := mt.LeafHashes()
+	if err := meta.VerifyLeafHashes(leaves); err != nil {
+		t.Fatal(err)
+	}
+	if err := unsalted.VerifyLeafHashes(leaves); !errors.Is(err, ErrInvalidProof) {
+		t.Fatalf("leaf hashes verified without the salt: %v", err)
+	}
+	var interleaved bytes.Buffer
+	if err := mt.WriteInterleaved(&interleaved); err != nil {
+		t.Fatal(err)
+	}
+	vr, err := NewInterleavedVerifyingReader(&interleaved, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := io.ReadAll(vr); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("interleaved read: %v", err)
+	}
+
+	// salts and keys combine, the salt being the first bytes under the HMAC
+	key := []byte("secret")
+	kt, err := NewMerkleTreeFromRecords([][]byte{[]byte("record")}, Config{Salt: salt, Key: key, KeyID: "salted"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(salt)
+	mac.Write([]byte("record"))
+	if !bytes.Equal(kt.GetRootHash(), mac.Sum(nil)) {
+		t.Fatal("keyed salted root differs from HMAC(key, salt || record)")
+	}
+
+	if _, err := NewMerkleTreeFromRecords([][]byte{{1}}, Config{Salt: make([]byte, maxSaltSize+1)}); err != ErrInvalidSalt {
+		t.Fatalf("got %v, want %v", err, ErrInvalidSalt)
+	}
+}
+
+// BenchmarkArity compares build time and proof size across arities; wider
+// nodes make shallower trees but send more siblings per level.
+func BenchmarkArity(b *testing.B) {
+	data := make([]byte, 1<<20)
+	for _, arity := range []int{2, 4, 8, 16} {
+		cfg := Config{SegmentSize: 1 << 10, Arity: arity}
+		b.Run(fmt.Sprintf("build/arity=%d", arity), func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for range b.N {
+				if _, err := NewMerkleTreeFromReader(bytes.NewReader(data), uint64(len(data)), cfg); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		mt, err := NewMerkleTreeFromReader(bytes.NewReader(data), uint64(len(data)), cfg)
+		if err != nil {
+			b.Fatal(err)
+		}
+		meta := mt.Metadata()
+		b.Run(fmt.Sprintf("proof/arity=%d", arity), func(b *testing.B) {
+			var size int
+			for i := range uint64(b.N) {
+				p, err := mt.Proof(i % mt.LeafCount())
+				if err != nil {
+					b.Fatal(err)
+				}
+				size = len(p.Siblings) * sha256.Size
+			}
+			b.ReportMetric(float64(size), "proof-bytes")
+		})
+		b.Run(fmt.Sprintf("verify/arity=%d", arity), func(b *testing.B) {
+			p, _ := mt.Proof(0)
+			segment, _ := mt.Segment(0)
+			b.ResetTimer()
+			for range b.N {
+				if err := meta.VerifyProof(segment, p); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package merkletree
+
+import (
+	"expvar"
+	"sync/atomic"
+	"time"
+)
+
+// Op is a kind of work reported to an Observer.
+type Op string
+
+const (
+	OpBuild    Op = "build"
+	OpValidate Op = "validate"
+	OpUpdate   Op = "update"
+	OpProof    Op = "proof"
+	OpVerify   Op = "verify"
+)
+
+// Event describes one finished operation on a tree.
+type Event struct {
+	Op Op
+	// Leaves is the number of leaves of the tree operated on.
+	Leaves uint64
+	// Hashes counts leaf and node digests computed, each allocating a hash.Hash.
+	Hashes uint64
+	// Bytes counts the bytes written to those hashes.
+	Bytes    uint64
+	Duration time.Duration
+	Err      error
+}
+
+// Observer is told about the work done on trees. Observe is called
+// synchronously once the operation returns and must be safe for concurrent use.
+type Observer interface {
+	Observe(Event)
+}
+
+// NopObserver ignores every event.
+type NopObserver struct{}
+
+// Observe does nothing.
+func (NopObserver) Observe(Event) {}
+
+// observerHolder gives the default observer a single concrete type for atomic.Value.
+type observerHolder struct{ Observer }
+
+var defaultObserver atomic.Value
+
+func init() {
+	defaultObserver.Store(observerHolder{NopObserver{}})
+}
+
+// SetDefaultObserver sets the observer of trees built without Config.Observer
+// and of proof verification. A nil observer restores NopObserver.
+func SetDefaultObserver(o Observer) {
+	if o == nil {
+		o = NopObserver{}
+	}
+	defaultObserver.Store(observerHolder{o})
+}
+
+// DefaultObserver returns the observer set with SetDefaultObserver.
+func DefaultObserver() Observer {
+	return defaultObserver.Load().(observerHolder).Observer
+}
+
+// meter counts the hashing done by one operation; a nil meter counts nothing.
+type meter struct {
+	hashes uint64
+	bytes  uint64
+}
+
+func (m *meter) count(n uint64) {
+	if m != nil {
+		m.hashes++
+		m.bytes += n
+	}
+}
+
+// span measures one operation.
+type span struct {
+	op     Op
+	leaves uint64
+	start  time.Time
+	meter  meter
+}
+
+func startSpan(op Op, leaves uint64) *span {
+	return &span{op: op, leaves: leaves, start: time.Now()}
+}
+
+// hasher returns 'h' counting its hashing in the span.
+func (s *span) hasher(h hasher) hasher {
+	h.meter = &s.meter
+	return h
+}
+
+// end reports the span to 'o', or to the default observer when 'o' is nil.
+func (s *span) end(o Observer, err error) {
+	if o == nil {
+		o = DefaultObserver()
+	}
+	o.Observe(Event{
+		Op:       s.op,
+		Leaves:   s.leaves,
+		Hashes:   s.meter.hashes,
+		Bytes:    s.meter.bytes,
+		Duration: time.Since(s.start),
+		Err:      err,
+	})
+}
+
+// ExpvarObserver publishes running totals per operation in an expvar.Map,
+// under the keys "<op>.count", "<op>.errors", "<op>.hashes", "<op>.bytes" and
+// "<op>.nanoseconds", along with "<op>.leaves", the size of the last tree operated on.
+type ExpvarObserver struct {
+	m *expvar.Map
+}
+
+// NewExpvarObserver returns an observer publishing the map 'name', which is
+// reused when already published.
+func NewExpvarObserver(name string) *ExpvarObserver {
+	if m, ok := expvar.Get(name).(*expvar.Map); ok {
+		return &ExpvarObserver{m: m}
+	}
+	return &ExpvarObserver{m: expvar.NewMap(name)}
+}
+
+// Observe adds the event to the totals.
+func (o *ExpvarObserver) Observe(e Event) {
+	prefix := string(e.Op) + "."
+	o.m.Add(prefix+"count", 1)
+	if e.Err != nil {
+		o.m.Add(prefix+"errors", 1)
+	}
+	o.m.Add(prefix+"hashes", int64(e.Hashes))
+	o.m.Add(prefix+"bytes", int64(e.Bytes))
+	o.m.Add(prefix+"nanoseconds", int64(e.Duration))
+	o.m.Add(prefix+"leaves", 0)
+	o.m.Get(prefix + "leaves").(*expvar.Int).Set(int64(e.Leaves))
+}
@@ -0,0 +1,463 @@
+package merkletree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrLeafOutOfRange is returned when a leaf index is beyond the last leaf.
+	ErrLeafOutOfRange = errors.New("merkletree: leaf index out of range")
+	// ErrInvalidProof is returned when a proof does not verify against a root.
+	ErrInvalidProof = errors.New("merkletree: invalid proof")
+)
+
+// Proof is an inclusion proof of a single leaf.
+type Proof struct {
+	Algorithm string
+	// KeyID identifies the key of a keyed tree, empty for others.
+	KeyID string
+	Index uint64
+	// Siblings holds the digests of the nodes next to the path from the leaf
+	// to the root, starting at the leaf.
+	Siblings [][]byte
+}
+
+// RangeProof proves inclusion of the consecutive leaves in [Start, End).
+type RangeProof struct {
+	Algorithm string
+	// KeyID identifies the key of a keyed tree, empty for others.
+	KeyID string
+	Start uint64
+	End   uint64
+	// Hashes holds the digests of the largest subtrees outside the range, from left to right.
+	Hashes [][]byte
+}
+
+// pathStep is a node on the path from the root to a leaf along with its
+// children, of which the one at 'index' is next on the path.
+type pathStep struct {
+	parent   uint64
+	children []uint64
+	index    int
+}
+
+// siblings returns the positions of the children off the path, from left to right.
+func (s pathStep) siblings() []uint64 {
+	return append(s.children[:s.index:s.index], s.children[s.index+1:]...)
+}
+
+// leafPath descends from the root to leaf 'index' and returns the leaf's
+// position and byte range along with the steps taken, starting at the root.
+// The range of the last leaf of a complete tree ends with the data.
+func (l layout) leafPath(index uint64) (pos uint64, start, end uint64, steps []pathStep, err error) {
+	if index >= l.leaves() {
+		return 0, 0, 0, nil, ErrLeafOutOfRange
+	}
+	pos, start, end = l.rootPos(), 0, l.extent()
+	for !l.isLeaf(start, end) {
+		children := l.children(pos, start, end)
+		step := pathStep{parent: pos, children: make([]uint64, len(children))}
+		for i, c := range children {
+			step.children[i] = c.pos
+		}
+		for i, c := range children {
+			if n := l.leafCount(c.end - c.start); index >= n && i < len(children)-1 {
+				index -= n
+				continue
+			}
+			step.index = i
+			pos, start, end = c.pos, c.start, c.end
+			break
+		}
+		steps = append(steps, step)
+	}
+	return pos, start, min(end, l.size), steps, nil
+}
+
+// rootFromLeaves folds 'leaves', consumed in order, into the root of the subtree spanning [start, end).
+func (l layout) rootFromLeaves(h hasher, start, end uint64, leaves *[][]byte) ([]byte, error) {
+	if l.isLeaf(start, end) {
+		if l.padding(start) {
+			return h.zero(), nil
+		}
+		if len(*leaves) == 0 {
+			return nil, ErrLeafOutOfRange
+		}
+		leaf := (*leaves)[0]
+		*leaves = (*leaves)[1:]
+		return leaf, nil
+	}
+	children := l.childRanges(start, end)
+	digests := make([][]byte, len(children))
+	for i, c := range children {
+		var err error
+		if digests[i], err = l.rootFromLeaves(h, c.start, c.end, leaves); err != nil {
+			return nil, err
+		}
+	}
+	return h.hashNode(digests...), nil
+}
+
+// Proof returns the inclusion proof of the leaf at 'index'.
+func (mt *MerkleTree) Proof(index uint64) (_ *Proof, err error) {
+	s := startSpan(OpProof, mt.leaves())
+	defer func() { s.end(mt.observer, err) }()
+	mt.mu.RLock()
+	defer mt.mu.RUnlock()
+	return mt.proof(mt.store, index)
+}
+
+// proof returns the inclusion proof of the leaf at 'index' with siblings read from 'nodes'.
+func (mt *MerkleTree) proof(nodes NodeStore, index uint64) (*Proof, error) {
+	_, _, _, steps, err := mt.leafPath(index)
+	if err != nil {
+		return nil, err
+	}
+	p := &Proof{Algorithm: mt.algorithm, KeyID: mt.keyID, Index: index, Siblings: [][]byte{}}
+	for i := len(steps) - 1; i >= 0; i-- {
+		for _, sibling := range steps[i].siblings() {
+			digest, err := nodes.Get(sibling)
+			if err != nil {
+				return nil, err
+			}
+			p.Siblings = append(p.Siblings, append([]byte(nil), digest...))
+		}
+	}
+	return p, nil
+}
+
+// RangeProof returns the proof of the leaves in [start, end).
+func (mt *MerkleTree) RangeProof(start, end uint64) (_ *RangeProof, err error) {
+	s := startSpan(OpProof, mt.leaves())
+	defer func() { s.end(mt.observer, err) }()
+	mt.mu.RLock()
+	defer mt.mu.RUnlock()
+	return mt.rangeProof(mt.store, start, end)
+}
+
+// rangeProof returns the proof of the leaves in [start, end) with hashes read from 'nodes'.
+func (mt *MerkleTree) rangeProof(nodes NodeStore, start, end uint64) (*RangeProof, error) {
+	if start >= end || end > mt.leaves() {
+		return nil, ErrLeafOutOfRange
+	}
+	p := &RangeProof{Algorithm: mt.algorithm, KeyID: mt.keyID, Start: start, End: end, Hashes: [][]byte{}}
+	var walk func(pos uint64, from, to uint64, first uint64) error
+	walk = func(pos uint64, from, to uint64, first uint64) error {
+		last := first + mt.leafCount(to-from)
+		if last <= start || first >= end {
+			digest, err := nodes.Get(pos)
+			if err != nil {
+				return err
+			}
+			p.Hashes = append(p.Hashes, append([]byte(nil), digest...))
+			return nil
+		}
+		if first >= start && last <= end {
+			return nil
+		}
+		for _, c := range mt.children(pos, from, to) {
+			if err := walk(c.pos, c.start, c.end, first); err != nil {
+				return err
+			}
+			first += mt.leafCount(c.end - c.start)
+		}
+		return nil
+	}
+	if err := walk(mt.rootPos(), 0, mt.extent(), 0); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Segment returns the bytes of the leaf at 'index'.
+func (mt *MerkleTree) Segment(index uint64) ([]byte, error) {
+	_, start, end, _, err := mt.leafPath(index)
+	if err != nil {
+		return nil, err
+	}
+	mt.mu.RLock()
+	defer mt.mu.RUnlock()
+	return mt.readSegment(start, end, make([]byte, end-start))
+}
+
+// LeafHashes returns the digests of all leaves, from left to right.
+func (mt *MerkleTree) LeafHashes() ([][]byte, error) {
+	mt.mu.RLock()
+	defer mt.mu.RUnlock()
+	return mt.leafHashesFrom(mt.store)
+}
+
+// leafHashesFrom returns the digests of all leaves read from 'nodes'.
+func (mt *MerkleTree) leafHashesFrom(nodes NodeStore) ([][]byte, error) {
+	leaves := make([][]byte, 0, mt.leaves())
+	var walk func(pos uint64, start, end uint64) error
+	walk = func(pos uint64, start, end uint64) error {
+		if mt.padding(start) {
+			return nil
+		}
+		if mt.isLeaf(start, end) {
+			digest, err := nodes.Get(pos)
+			if err != nil {
+				return err
+			}
+			leaves = append(leaves, append([]byte(nil), digest...))
+			return nil
+		}
+		for _, c := range mt.children(pos, start, end) {
+			if err := walk(c.pos, c.start, c.end); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(mt.rootPos(), 0, mt.extent()); err != nil {
+		return nil, err
+	}
+	return leaves, nil
+}
+
+// tree returns the shape and hashing described by the metadata, keyed
+// trees hashing with their key in 'keys'.
+func (m Metadata) tree(keys Keyring) (layout, hasher, error) {
+	if m.Size > maxSize {
+		return layout{}, hasher{}, fmt.Errorf("merkletree: data size %d too large", m.Size)
+	}
+	hashfn, err := LookupHash(m.Algorithm)
+	if err != nil {
+		return layout{}, hasher{}, err
+	}
+	if m.Arity != 0 && (m.Arity < 2 || m.Arity > maxArity) {
+		return layout{}, hasher{}, ErrInvalidArity
+	}
+	l := layout{size: m.Size, segmentSize: m.SegmentSize, arity: uint64(max(m.Arity, 2)), shape: m.Shape}
+	if m.SegmentSize == 0 {
+		if m.Size == 0 {
+			return layout{}, hasher{}, ErrNoRecords
+		}
+		l.segmentSize, l.records = 1, true
+	}
+	if err := l.check(); err != nil {
+		return layout{}, hasher{}, err
+	}
+	l = l.withCounts()
+	if len(m.Salt) > maxSaltSize {
+		return layout{}, hasher{}, ErrInvalidSalt
+	}
+	h := hasher{newHash: hashfn, salt: m.Salt}
+	if m.KeyID != "" {
+		key, ok := keys[m.KeyID]
+		if !ok {
+			return layout{}, hasher{}, fmt.Errorf("%w %q", ErrUnknownKey, m.KeyID)
+		}
+		if err := checkKey(m.KeyID, key); err != nil {
+			return layout{}, hasher{}, err
+		}
+		h = h.keyed(key)
+	}
+	return l, h, nil
+}
+
+// VerifyProof checks that 'segment' is the leaf 'p' proves inclusion of in the tree described by 'm'.
+// For a record tree 'segment' is the record. Proofs of keyed trees are verified with a Verifier.
+func (m Metadata) VerifyProof(segment []byte, p *Proof) error {
+	return Verifier{}.VerifyProof(m, segment, p)
+}
+
+// VerifyProof is Metadata.VerifyProof for trees keyed with a key in v.Keys.
+func (v Verifier) VerifyProof(m Metadata, segment []byte, p *Proof) error {
+	return m.verify(v.Keys, func(l layout, h hasher) error {
+		return m.verifyProof(l, h, segment, p)
+	})
+}
+
+// verify runs 'check' against the shape and hashing described by 'm',
+// reporting it to the default observer.
+func (m Metadata) verify(keys Keyring, check func(l layout, h hasher) error) error {
+	s := startSpan(OpVerify, 0)
+	l, h, err := m.tree(keys)
+	if err == nil {
+		s.leaves = l.leaves()
+		err = check(l, s.hasher(h))
+	}
+	s.end(nil, err)
+	return err
+}
+
+func (m Metadata) verifyProof(l layout, h hasher, segment []byte, p *Proof) error {
+	if p.Algorithm != m.Algorithm {
+		return fmt.Errorf("%w: proof uses %q, tree uses %q", ErrInvalidProof, p.Algorithm, m.Algorithm)
+	}
+	if p.KeyID != m.KeyID {
+		return fmt.Errorf("%w: proof uses key %q, tree uses %q", ErrInvalidProof, p.KeyID, m.KeyID)
+	}
+	_, start, end, steps, err := l.leafPath(p.Index)
+	if err != nil {
+		return err
+	}
+	siblings := 0
+	for _, step := range steps {
+		siblings += len(step.children) - 1
+	}
+	if len(p.Siblings) != siblings {
+		return fmt.Errorf("%w: leaf %d needs %d siblings, got %d", ErrInvalidProof, p.Index, siblings, len(p.Siblings))
+	}
+	if !l.records && uint64(len(segment)) != end-start {
+		return fmt.Errorf("%w: leaf %d holds %d bytes, got %d", ErrInvalidProof, p.Index, end-start, len(segment))
+	}
+
+	digest := h.hashLeaf(segment)
+	rest := p.Siblings
+	for i := len(steps) - 1; i >= 0; i-- {
+		step := steps[i]
+		n := len(step.children) - 1
+		children := make([][]byte, 0, n+1)
+		children = append(children, rest[:step.index]...)
+		children = append(children, digest)
+		children = append(children, rest[step.index:n]...)
+		digest = h.hashNode(children...)
+		rest = rest[n:]
+	}
+	if !bytes.Equal(digest, m.Root) {
+		return ErrInvalidProof
+	}
+	return nil
+}
+
+// VerifyLeafHashes checks that 'leaves' are the leaf digests of the tree described by 'm'.
+func (m Metadata) VerifyLeafHashes(leaves [][]byte) error {
+	return Verifier{}.VerifyLeafHashes(m, leaves)
+}
+
+// VerifyLeafHashes is Metadata.VerifyLeafHashes for trees keyed with a key in v.Keys.
+func (v Verifier) VerifyLeafHashes(m Metadata, leaves [][]byte) error {
+	return m.verify(v.Keys, func(l layout, h hasher) error {
+		return m.verifyLeafHashes(l, h, leaves)
+	})
+}
+
+func (m Metadata) verifyLeafHashes(l layout, h hasher, leaves [][]byte) error {
+	if uint64(len(leaves)) != l.leaves() {
+		return fmt.Errorf("%w: tree has %d leaves, got %d", ErrInvalidProof, l.leaves(), len(leaves))
+	}
+	root, err := l.rootFromLeaves(h, 0, l.extent(), &leaves)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(root, m.Root) {
+		return ErrInvalidProof
+	}
+	return nil
+}
+
+// VerifyRangeProof checks that 'data' holds exactly the leaves 'p' proves
+// inclusion of in the tree described by 'm'. Use VerifyRecordRangeProof for record trees.
+func (m Metadata) VerifyRangeProof(data []byte, p *RangeProof) error {
+	return Verifier{}.VerifyRangeProof(m, data, p)
+}
+
+// VerifyRangeProof is Metadata.VerifyRangeProof for trees keyed with a key in v.Keys.
+func (v Verifier) VerifyRangeProof(m Metadata, data []byte, p *RangeProof) error {
+	return m.verify(v.Keys, func(l layout, h hasher) error {
+		return m.verifyDataRangeProof(l, h, data, p)
+	})
+}
+
+func (m Metadata) verifyDataRangeProof(l layout, h hasher, data []byte, p *RangeProof) error {
+	if l.records {
+		return fmt.Errorf("merkletree: range proofs of record trees are verified with VerifyRecordRangeProof")
+	}
+	if p.Start >= p.End || p.End > l.leaves() {
+		return ErrLeafOutOfRange
+	}
+
+	// the range starts at the first byte of leaf p.Start
+	_, offset, _, _, err := l.leafPath(p.Start)
+	if err != nil {
+		return err
+	}
+	_, _, end, _, _ := l.leafPath(p.End - 1)
+	if end-offset != uint64(len(data)) {
+		return fmt.Errorf("%w: range holds %d bytes, got %d", ErrInvalidProof, end-offset, len(data))
+	}
+	return m.verifyRangeProof(l, h, p, func(from, to uint64) []byte {
+		return h.hashLeaf(data[from-offset : to-offset])
+	})
+}
+
+// VerifyRecordRangeProof checks that 'records' are exactly the records 'p'
+// proves inclusion of in the record tree described by 'm'.
+func (m Metadata) VerifyRecordRangeProof(records [][]byte, p *RangeProof) error {
+	return Verifier{}.VerifyRecordRangeProof(m, records, p)
+}
+
+// VerifyRecordRangeProof is Metadata.VerifyRecordRangeProof for trees keyed with a key in v.Keys.
+func (v Verifier) VerifyRecordRangeProof(m Metadata, records [][]byte, p *RangeProof) error {
+	return m.verify(v.Keys, func(l layout, h hasher) error {
+		return m.verifyRecordRangeProof(l, h, records, p)
+	})
+}
+
+func (m Metadata) verifyRecordRangeProof(l layout, h hasher, records [][]byte, p *RangeProof) error {
+	if !l.records {
+		return fmt.Errorf("merkletree: range proofs of byte trees are verified with VerifyRangeProof")
+	}
+	if p.Start >= p.End || p.End > l.leaves() {
+		return ErrLeafOutOfRange
+	}
+	if uint64(len(records)) != p.End-p.Start {
+		return fmt.Errorf("%w: range holds %d records, got %d", ErrInvalidProof, p.End-p.Start, len(records))
+	}
+	return m.verifyRangeProof(l, h, p, func(from, to uint64) []byte {
+		return h.hashLeaf(records[uint64(from)-p.Start])
+	})
+}
+
+// verifyRangeProof folds the leaves in the range, hashed by 'leaf', and the
+// proof's hashes into the root.
+func (m Metadata) verifyRangeProof(l layout, h hasher, p *RangeProof, leaf func(from, to uint64) []byte) error {
+	if p.Algorithm != m.Algorithm {
+		return fmt.Errorf("%w: proof uses %q, tree uses %q", ErrInvalidProof, p.Algorithm, m.Algorithm)
+	}
+	if p.KeyID != m.KeyID {
+		return fmt.Errorf("%w: proof uses key %q, tree uses %q", ErrInvalidProof, p.KeyID, m.KeyID)
+	}
+	hashes := p.Hashes
+	var fold func(from, to uint64, first uint64) ([]byte, error)
+	fold = func(from, to uint64, first uint64) ([]byte, error) {
+		last := first + l.leafCount(to-from)
+		if last <= p.Start || first >= p.End {
+			if len(hashes) == 0 {
+				return nil, fmt.Errorf("%w: too few hashes", ErrInvalidProof)
+			}
+			digest := hashes[0]
+			hashes = hashes[1:]
+			return digest, nil
+		}
+		if l.isLeaf(from, to) {
+			return leaf(from, min(to, l.size)), nil
+		}
+		children := l.childRanges(from, to)
+		digests := make([][]byte, len(children))
+		for i, c := range children {
+			var err error
+			if digests[i], err = fold(c.start, c.end, first); err != nil {
+				return nil, err
+			}
+			first += l.leafCount(c.end - c.start)
+		}
+		return h.hashNode(digests...), nil
+	}
+	root, err := fold(0, l.extent(), 0)
+	if err != nil {
+		return err
+	}
+	if len(hashes) != 0 {
+		return fmt.Errorf("%w: %d unused hashes", ErrInvalidProof, len(hashes))
+	}
+	if !bytes.Equal(root, m.Root) {
+		return ErrInvalidProof
+	}
+	return nil
+}
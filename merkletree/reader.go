@@ -0,0 +1,242 @@
+package merkletree
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// maxProofDepth bounds the depth of proofs read from an interleaved stream,
+// which hold at most arity-1 siblings per level.
+const maxProofDepth = 64
+
+// MaxStreamSegmentSize bounds the segment size of trees read with a
+// VerifyingReader, which holds a whole segment in memory until it is verified.
+const MaxStreamSegmentSize = 16 << 20
+
+// IntegrityError is returned by a VerifyingReader when a segment does not
+// match the trusted root.
+type IntegrityError struct {
+	// Index is the index of the offending leaf.
+	Index uint64
+	// Offset is the offset of the leaf's first byte in the data.
+	Offset uint64
+	// Err is the underlying cause, if any.
+	Err error
+}
+
+func (e *IntegrityError) Error() string {
+	msg := fmt.Sprintf("merkletree: segment %d at offset %d failed verification", e.Index, e.Offset)
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *IntegrityError) Unwrap() error {
+	return e.Err
+}
+
+// VerifyingReader reads data described by trusted Metadata and only returns
+// the bytes of a segment once the segment has been verified against the root.
+type VerifyingReader struct {
+	layout
+	hasher
+	r          *bufio.Reader
+	meta       Metadata
+	leafHashes [][]byte // nil when proofs are interleaved with the data
+	leaves     uint64
+	index      uint64
+	buf        []byte
+	pending    []byte
+	err        error
+}
+
+// NewVerifyingReader returns a reader over 'r' checking every segment against
+// 'leafHashes', which are first checked against the root in 'meta'. Trees
+// with segments over MaxStreamSegmentSize cannot be read.
+func NewVerifyingReader(r io.Reader, meta Metadata, leafHashes [][]byte) (*VerifyingReader, error) {
+	return Verifier{}.NewVerifyingReader(r, meta, leafHashes)
+}
+
+// NewVerifyingReader is the package's NewVerifyingReader for trees keyed with a key in v.Keys.
+func (v Verifier) NewVerifyingReader(r io.Reader, meta Metadata, leafHashes [][]byte) (*VerifyingReader, error) {
+	if err := v.VerifyLeafHashes(meta, leafHashes); err != nil {
+		return nil, err
+	}
+	vr, err := newVerifyingReader(r, meta, v.Keys)
+	if err != nil {
+		return nil, err
+	}
+	vr.leafHashes = leafHashes
+	return vr, nil
+}
+
+// NewInterleavedVerifyingReader returns a reader over a stream written by
+// WriteInterleaved, checking every segment against the inclusion proof
+// preceding it and the root in 'meta'. Trees with segments over
+// MaxStreamSegmentSize cannot be read.
+func NewInterleavedVerifyingReader(r io.Reader, meta Metadata) (*VerifyingReader, error) {
+	return Verifier{}.NewInterleavedVerifyingReader(r, meta)
+}
+
+// NewInterleavedVerifyingReader is the package's NewInterleavedVerifyingReader
+// for trees keyed with a key in v.Keys.
+func (v Verifier) NewInterleavedVerifyingReader(r io.Reader, meta Metadata) (*VerifyingReader, error) {
+	return newVerifyingReader(r, meta, v.Keys)
+}
+
+func newVerifyingReader(r io.Reader, meta Metadata, keys Keyring) (*VerifyingReader, error) {
+	l, h, err := meta.tree(keys)
+	if err != nil {
+		return nil, err
+	}
+	if l.records {
+		return nil, errors.New("merkletree: record trees cannot be read as a stream")
+	}
+	// no leaf holds more than the whole data
+	if min(l.size, l.segmentSize) > MaxStreamSegmentSize {
+		return nil, fmt.Errorf("merkletree: segment size %d is above the %d bytes a stream is read in", l.segmentSize, MaxStreamSegmentSize)
+	}
+	return &VerifyingReader{
+		layout: l,
+		hasher: h,
+		r:      bufio.NewReader(r),
+		meta:   meta,
+		leaves: l.leaves(),
+		buf:    make([]byte, min(l.size, l.segmentSize)),
+	}, nil
+}
+
+// Read implements io.Reader. Once a segment fails verification every
+// subsequent call returns the same *IntegrityError.
+func (vr *VerifyingReader) Read(p []byte) (int, error) {
+	for len(vr.pending) == 0 {
+		if vr.err != nil {
+			return 0, vr.err
+		}
+		vr.pending, vr.err = vr.next()
+	}
+	n := copy(p, vr.pending)
+	vr.pending = vr.pending[n:]
+	return n, nil
+}
+
+// next reads and verifies the next segment.
+func (vr *VerifyingReader) next() ([]byte, error) {
+	if vr.index == vr.leaves {
+		return nil, io.EOF
+	}
+	_, start, end, _, err := vr.leafPath(vr.index)
+	if err != nil {
+		return nil, err
+	}
+	fail := func(err error) error {
+		return &IntegrityError{Index: vr.index, Offset: start, Err: err}
+	}
+
+	var proof *Proof
+	if vr.leafHashes == nil {
+		if proof, err = readProof(vr.r, vr.meta.Algorithm, vr.newHash().Size(), maxProofDepth*(vr.arity-1)); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, fail(err)
+		}
+		if proof.Index != vr.index {
+			return nil, fail(fmt.Errorf("%w: got proof for leaf %d", ErrInvalidProof, proof.Index))
+		}
+		// the stream holds the proofs of a single tree, so the metadata names its key
+		proof.KeyID = vr.meta.KeyID
+	}
+
+	segment := vr.buf[:end-start]
+	if _, err := io.ReadFull(vr.r, segment); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fail(err)
+	}
+
+	if proof != nil {
+		err = vr.meta.verifyProof(vr.layout, vr.hasher, segment, proof)
+	} else if !bytes.Equal(vr.hashLeaf(segment), vr.leafHashes[vr.index]) {
+		err = ErrInvalidProof
+	}
+	if err != nil {
+		return nil, fail(err)
+	}
+	vr.index++
+	return segment, nil
+}
+
+// WriteInterleaved writes the tree's data to 'w' with every segment preceded
+// by its inclusion proof, for reading with NewInterleavedVerifyingReader.
+// Updates wait until the whole tree is written.
+func (mt *MerkleTree) WriteInterleaved(w io.Writer) error {
+	mt.mu.RLock()
+	defer mt.mu.RUnlock()
+	// fail before writing anything rather than leave a truncated stream
+	switch {
+	case mt.leafHashes != nil:
+		return ErrNoLeafData
+	case mt.records:
+		return errors.New("merkletree: record trees cannot be written as a stream")
+	}
+	bw := bufio.NewWriter(w)
+	buf := make([]byte, min(mt.size, mt.segmentSize))
+	for i := uint64(0); i < mt.leaves(); i++ {
+		p, err := mt.proof(mt.store, i)
+		if err != nil {
+			return err
+		}
+		writeProof(bw, p)
+		_, start, end, _, err := mt.leafPath(i)
+		if err != nil {
+			return err
+		}
+		segment, err := mt.readSegment(start, end, buf)
+		if err != nil {
+			return err
+		}
+		if _, err := bw.Write(segment); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// writeProof writes the leaf index and the siblings, each prefixed by their count.
+func writeProof(w *bufio.Writer, p *Proof) {
+	var b [binary.MaxVarintLen64]byte
+	_, _ = w.Write(b[:binary.PutUvarint(b[:], p.Index)])
+	_, _ = w.Write(b[:binary.PutUvarint(b[:], uint64(len(p.Siblings)))])
+	for _, sibling := range p.Siblings {
+		_, _ = w.Write(sibling)
+	}
+}
+
+func readProof(r *bufio.Reader, algorithm string, digestSize int, maxSiblings uint64) (*Proof, error) {
+	index, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > maxSiblings {
+		return nil, fmt.Errorf("%w: %d siblings", ErrInvalidProof, n)
+	}
+	p := &Proof{Algorithm: algorithm, Index: index, Siblings: make([][]byte, n)}
+	for i := range p.Siblings {
+		p.Siblings[i] = make([]byte, digestSize)
+		if _, err := io.ReadFull(r, p.Siblings[i]); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
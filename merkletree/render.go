@@ -0,0 +1,167 @@
+package merkletree
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// RenderOptions controls WriteDOT and WriteMermaid.
+type RenderOptions struct {
+	// HashBytes is the number of leading digest bytes shown in hex, 4 when zero.
+	HashBytes int
+	// MaxDepth hides the nodes more than MaxDepth edges below the root; zero shows all.
+	MaxDepth int
+	// Highlight holds the positions of the nodes to emphasise, such as those
+	// returned by ProofNodes or Diff.
+	Highlight []uint64
+}
+
+// ProofNodes returns the positions of the nodes involved in proving the leaf
+// at 'index': the leaf, the nodes on its path to the root and their siblings.
+func (mt *MerkleTree) ProofNodes(index uint64) ([]uint64, error) {
+	pos, _, _, steps, err := mt.leafPath(index)
+	if err != nil {
+		return nil, err
+	}
+	positions := []uint64{pos}
+	for _, step := range steps {
+		positions = append(positions, step.parent)
+		positions = append(positions, step.siblings()...)
+	}
+	return positions, nil
+}
+
+// Diff returns the positions of the nodes whose digests differ from those of
+// 'other', which must have the same shape. The children of matching nodes
+// are not compared.
+func (mt *MerkleTree) Diff(other *MerkleTree) ([]uint64, error) {
+	if !mt.same(other.layout) {
+		return nil, errors.New("merkletree: cannot diff trees of different shapes")
+	}
+	defer readLockBoth(mt, other)()
+	var positions []uint64
+	var walk func(pos uint64, start, end uint64)
+	walk = func(pos uint64, start, end uint64) {
+		if n, o := storedDigest(mt.store, pos), storedDigest(other.store, pos); n != nil && bytes.Equal(n, o) {
+			return
+		}
+		positions = append(positions, pos)
+		if mt.isLeaf(start, end) {
+			return
+		}
+		for _, c := range mt.children(pos, start, end) {
+			walk(c.pos, c.start, c.end)
+		}
+	}
+	walk(mt.rootPos(), 0, mt.extent())
+	return positions, nil
+}
+
+// WriteDOT writes the tree as a Graphviz graph. Highlighted nodes are filled
+// and nodes whose children are hidden by the depth limit are dashed.
+func (mt *MerkleTree) WriteDOT(w io.Writer, opts RenderOptions) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "digraph merkletree {")
+	fmt.Fprintln(bw, "\tnode [shape=box, fontname=\"monospace\"];")
+	mt.render(opts, func(n Node, parent *Node, truncated, highlighted bool) {
+		var styles []string
+		if highlighted {
+			styles = append(styles, "filled")
+		}
+		if truncated {
+			styles = append(styles, "dashed")
+		}
+		attrs := ""
+		if len(styles) > 0 {
+			attrs = fmt.Sprintf(", style=\"%s\"", strings.Join(styles, ","))
+		}
+		if highlighted {
+			attrs += ", fillcolor=gold"
+		}
+		label := strings.ReplaceAll(mt.nodeLabel(n, opts), "\n", `\n`)
+		fmt.Fprintf(bw, "\tn%d [label=\"%s\"%s];\n", n.Pos, label, attrs)
+		if parent != nil {
+			fmt.Fprintf(bw, "\tn%d -> n%d;\n", parent.Pos, n.Pos)
+		}
+	})
+	fmt.Fprintln(bw, "}")
+	return bw.Flush()
+}
+
+// WriteMermaid writes the tree as a Mermaid flowchart. Highlighted nodes are
+// in the class "highlight" and nodes whose children are hidden by the depth
+// limit in the class "truncated".
+func (mt *MerkleTree) WriteMermaid(w io.Writer, opts RenderOptions) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "graph TD")
+	var highlighted, truncated []string
+	mt.render(opts, func(n Node, parent *Node, isTruncated, isHighlighted bool) {
+		id := fmt.Sprintf("n%d", n.Pos)
+		label := strings.ReplaceAll(mt.nodeLabel(n, opts), "\n", "<br/>")
+		fmt.Fprintf(bw, "\t%s[\"%s\"]\n", id, label)
+		if parent != nil {
+			fmt.Fprintf(bw, "\tn%d --> %s\n", parent.Pos, id)
+		}
+		if isHighlighted {
+			highlighted = append(highlighted, id)
+		}
+		if isTruncated {
+			truncated = append(truncated, id)
+		}
+	})
+	if len(highlighted) > 0 {
+		fmt.Fprintln(bw, "\tclassDef highlight fill:#fd0,stroke:#a80")
+		fmt.Fprintf(bw, "\tclass %s highlight\n", strings.Join(highlighted, ","))
+	}
+	if len(truncated) > 0 {
+		fmt.Fprintln(bw, "\tclassDef truncated stroke-dasharray:4")
+		fmt.Fprintf(bw, "\tclass %s truncated\n", strings.Join(truncated, ","))
+	}
+	return bw.Flush()
+}
+
+// render walks the nodes shown under 'opts' depth first, passing each with its parent.
+func (mt *MerkleTree) render(opts RenderOptions, node func(n Node, parent *Node, truncated, highlighted bool)) {
+	highlight := make(map[uint64]bool, len(opts.Highlight))
+	for _, pos := range opts.Highlight {
+		highlight[pos] = true
+	}
+	w := mt.newWalk()
+	var visit func(n Node, parent *Node)
+	visit = func(n Node, parent *Node) {
+		truncated := opts.MaxDepth > 0 && n.Depth == opts.MaxDepth && !n.Leaf
+		node(w.withHash(n), parent, truncated, highlight[n.Pos])
+		if n.Leaf || truncated {
+			return
+		}
+		for _, c := range w.children(n) {
+			visit(c, &n)
+		}
+	}
+	visit(w.root(), nil)
+}
+
+// nodeLabel shows the node's position, range and truncated digest on separate lines.
+func (mt *MerkleTree) nodeLabel(n Node, opts RenderOptions) string {
+	unit := "bytes"
+	if mt.records {
+		unit = "records"
+	}
+	digest := "missing"
+	if n.Hash != nil {
+		size := opts.HashBytes
+		if size <= 0 {
+			size = 4
+		}
+		digest = hex.EncodeToString(n.Hash[:min(size, len(n.Hash))])
+		if size < len(n.Hash) {
+			digest += "…"
+		}
+	}
+	return fmt.Sprintf("pos %d\n%s [%d, %d)\n%s", n.Pos, unit, n.Start, n.End, digest)
+}
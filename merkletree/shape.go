@@ -0,0 +1,183 @@
+package merkletree
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+)
+
+// ErrInvalidShape is returned for shapes other than the Shape constants.
+var ErrInvalidShape = errors.New("merkletree: unknown tree shape")
+
+// Shape is how a tree splits its nodes into children. Every shape but
+// ShapeBytes cuts the data into leaves of exactly the segment size, the last
+// one aside, and then arranges those leaves. Record trees have one leaf per
+// record, so ShapeBytes and ShapeLeafCount lay them out alike.
+type Shape int
+
+const (
+	// ShapeBytes splits every node by bytes into equal parts until they hold at
+	// most the segment size, so leaves may be shorter than a segment anywhere in
+	// the tree. It is the original shape of this package.
+	ShapeBytes Shape = iota
+	// ShapeLeafCount splits every node's leaves into parts of equal count.
+	ShapeLeafCount
+	// ShapeLeftBalanced fills the children of a node from the left with as many
+	// leaves as the largest power of the arity below the node's leaf count, as
+	// RFC 6962 does for binary trees.
+	ShapeLeftBalanced
+	// ShapeComplete pads the leaves to a power of the arity, so that every
+	// leaf has the same depth. Padding leaves have all-zero digests and cannot be proved.
+	ShapeComplete
+)
+
+var shapeNames = [...]string{
+	ShapeBytes:        "bytes",
+	ShapeLeafCount:    "leaf-count",
+	ShapeLeftBalanced: "left-balanced",
+	ShapeComplete:     "complete",
+}
+
+func (s Shape) String() string {
+	if s < 0 || int(s) >= len(shapeNames) {
+		return fmt.Sprintf("Shape(%d)", int(s))
+	}
+	return shapeNames[s]
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (s Shape) MarshalText() ([]byte, error) {
+	if s < 0 || int(s) >= len(shapeNames) {
+		return nil, fmt.Errorf("%w: %d", ErrInvalidShape, int(s))
+	}
+	return []byte(shapeNames[s]), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (s *Shape) UnmarshalText(text []byte) error {
+	for shape, name := range shapeNames {
+		if name == string(text) {
+			*s = Shape(shape)
+			return nil
+		}
+	}
+	return fmt.Errorf("%w %q", ErrInvalidShape, text)
+}
+
+// check reports shapes this package does not know and complete trees whose
+// padding would not fit in 64 bits.
+func (l layout) check() error {
+	if l.shape < 0 || int(l.shape) >= len(shapeNames) {
+		return fmt.Errorf("%w: %d", ErrInvalidShape, int(l.shape))
+	}
+	if _, ok := l.paddedLeaves(); !ok {
+		return fmt.Errorf("merkletree: %d leaves cannot be padded to a power of %d", l.leaves(), l.arity)
+	}
+	return nil
+}
+
+// leaves returns the number of leaves holding data, so excluding padding.
+func (l layout) leaves() uint64 {
+	return l.leafCount(l.size)
+}
+
+// paddedLeaves returns the number of leaves of a complete tree, the
+// smallest power of the arity not below its leaves, and false on overflow.
+func (l layout) paddedLeaves() (uint64, bool) {
+	if l.shape != ShapeComplete {
+		return 0, true
+	}
+	leaves, want := uint64(1), l.leaves()
+	for leaves < want {
+		hi, lo := bits.Mul64(leaves, l.arity)
+		if hi != 0 || lo > maxSize {
+			return 0, false
+		}
+		leaves = lo
+	}
+	if hi, _ := bits.Mul64(leaves, l.segmentSize); hi != 0 {
+		return 0, false
+	}
+	return leaves, true
+}
+
+// extent returns the end of the root's range: the size, padded with whole
+// segments for complete trees.
+func (l layout) extent() uint64 {
+	if l.shape != ShapeComplete {
+		return l.size
+	}
+	leaves, _ := l.paddedLeaves()
+	return leaves * l.segmentSize
+}
+
+// padding reports whether the leaf starting at 'start' is padding.
+func (l layout) padding(start uint64) bool {
+	return l.shape == ShapeComplete && start/l.segmentSize >= l.leaves()
+}
+
+// childRanges returns the ranges of the children of the node spanning
+// [start, end), from left to right.
+func (l layout) childRanges(start, end uint64) []child {
+	if l.shape == ShapeBytes {
+		return l.splitBytes(start, end)
+	}
+	n := l.leafCount(end - start)
+	if l.shape == ShapeLeafCount {
+		return l.splitLeaves(start, end, n)
+	}
+	// the largest power of the arity below n
+	per := uint64(1)
+	for per <= (n-1)/l.arity {
+		per *= l.arity
+	}
+	children := make([]child, 0, l.arity)
+	for from := start; from < end; from += per * l.segmentSize {
+		children = append(children, child{start: from, end: min(end, from+per*l.segmentSize)})
+	}
+	return children
+}
+
+// splitBytes splits [start, end) into 'arity' parts, or one per byte when
+// shorter. Child 'i' of 'n' starts floor(i*length/n) bytes into the node,
+// so binary trees split at the midpoint.
+func (l layout) splitBytes(start, end uint64) []child {
+	length := end - start
+	n := min(l.arity, length)
+	children := make([]child, n)
+	for i := range children {
+		hi, lo := bits.Mul64(uint64(i), length)
+		offset, _ := bits.Div64(hi, lo, n)
+		children[i].start = start + offset
+		if i > 0 {
+			children[i-1].end = children[i].start
+		}
+	}
+	children[n-1].end = end
+	return children
+}
+
+// splitLeaves splits the 'leaves' leaves in [start, end) into 'arity' parts
+// the same way splitBytes splits bytes.
+func (l layout) splitLeaves(start, end, leaves uint64) []child {
+	children := l.splitBytes(0, leaves)
+	for i := range children {
+		children[i].start = start + children[i].start*l.segmentSize
+		children[i].end = min(end, start+children[i].end*l.segmentSize)
+	}
+	return children
+}
+
+// leafCount returns the number of leaves of a subtree spanning 'length' bytes,
+// padding included.
+func (l layout) leafCount(length uint64) uint64 {
+	if l.shape == ShapeBytes {
+		leaves, _ := l.counts(length)
+		return leaves
+	}
+	leaves := length / l.segmentSize
+	if length%l.segmentSize != 0 || leaves == 0 {
+		leaves++
+	}
+	return leaves
+}
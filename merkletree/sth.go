@@ -0,0 +1,123 @@
+package merkletree
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	// ErrUntrustedKey is returned when a tree head is signed by a key outside the trusted set.
+	ErrUntrustedKey = errors.New("merkletree: tree head signed by an untrusted key")
+	// ErrInvalidSignature is returned when a tree head's signature does not verify.
+	ErrInvalidSignature = errors.New("merkletree: invalid tree head signature")
+)
+
+// treeHeadContext prefixes every signed tree head so that its signature
+// cannot be mistaken for one over other data.
+const treeHeadContext = "merkletree signed tree head v1\n"
+
+// SignedTreeHead is a root vouched for by the holder of an Ed25519 key at a point in time.
+type SignedTreeHead struct {
+	Algorithm string
+	// TreeSize is the number of entries under Root.
+	TreeSize uint64
+	// Timestamp is kept with millisecond precision.
+	Timestamp time.Time
+	Root      []byte
+	// KeyID is the SHA-256 digest of the signer's public key.
+	KeyID     []byte
+	Signature []byte
+}
+
+// KeyID returns the identifier of 'pub' used in signed tree heads.
+func KeyID(pub ed25519.PublicKey) []byte {
+	id := sha256.Sum256(pub)
+	return id[:]
+}
+
+// SignTreeHead signs 'root' of a tree of 'treeSize' entries as of 'timestamp'.
+func SignTreeHead(key ed25519.PrivateKey, root Root, treeSize uint64, timestamp time.Time) (*SignedTreeHead, error) {
+	if len(key) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("merkletree: ed25519 private key must be %d bytes, got %d", ed25519.PrivateKeySize, len(key))
+	}
+	if err := checkDigest(root.Algorithm, root.Hash); err != nil {
+		return nil, err
+	}
+	sth := &SignedTreeHead{
+		Algorithm: root.Algorithm,
+		TreeSize:  treeSize,
+		Timestamp: time.UnixMilli(timestamp.UnixMilli()).UTC(),
+		Root:      append([]byte(nil), root.Hash...),
+		KeyID:     KeyID(key.Public().(ed25519.PublicKey)),
+	}
+	sth.Signature = ed25519.Sign(key, sth.SignedBytes())
+	return sth, nil
+}
+
+// SignTreeHead signs the current root of the log as of 'timestamp'.
+func (t *LogTree) SignTreeHead(key ed25519.PrivateKey, timestamp time.Time) (*SignedTreeHead, error) {
+	return SignTreeHead(key, t.Root(), t.Size(), timestamp)
+}
+
+// SignedBytes returns the canonical serialization covered by the signature:
+// the context string, then the algorithm name and the root each prefixed by
+// their length in one byte, the timestamp in milliseconds since the Unix
+// epoch and the tree size, both as big endian uint64.
+func (sth *SignedTreeHead) SignedBytes() []byte {
+	var b bytes.Buffer
+	b.WriteString(treeHeadContext)
+	b.WriteByte(byte(len(sth.Algorithm)))
+	b.WriteString(sth.Algorithm)
+	b.WriteByte(byte(len(sth.Root)))
+	b.Write(sth.Root)
+	b.Write(binary.BigEndian.AppendUint64(nil, uint64(sth.Timestamp.UnixMilli())))
+	b.Write(binary.BigEndian.AppendUint64(nil, sth.TreeSize))
+	return b.Bytes()
+}
+
+// RootHash returns the signed root tagged with its algorithm.
+func (sth *SignedTreeHead) RootHash() Root {
+	return Root{Algorithm: sth.Algorithm, Hash: sth.Root}
+}
+
+// Verify checks the signature against the key in 'trusted' matching KeyID.
+func (sth *SignedTreeHead) Verify(trusted []ed25519.PublicKey) error {
+	if len(sth.Algorithm) > 255 || len(sth.Root) > 255 {
+		return ErrInvalidSignature
+	}
+	for _, pub := range trusted {
+		if len(pub) != ed25519.PublicKeySize || !bytes.Equal(KeyID(pub), sth.KeyID) {
+			continue
+		}
+		if !ed25519.Verify(pub, sth.SignedBytes(), sth.Signature) {
+			return ErrInvalidSignature
+		}
+		return nil
+	}
+	return ErrUntrustedKey
+}
+
+// VerifyInclusion checks that 'p' proves 'leaf', a leaf hash, is in the tree
+// described by the tree head. It does not check the signature; call Verify first.
+func (sth *SignedTreeHead) VerifyInclusion(leaf []byte, p *InclusionProof) error {
+	if p.TreeSize != sth.TreeSize {
+		return fmt.Errorf("%w: proof is for %d entries, tree head for %d", ErrInvalidProof, p.TreeSize, sth.TreeSize)
+	}
+	return VerifyInclusion(sth.RootHash(), leaf, p)
+}
+
+// VerifyConsistency checks that 'p' proves the tree described by the tree
+// head is a prefix of the one described by 'newer'. It does not check the
+// signatures; call Verify on both first.
+func (sth *SignedTreeHead) VerifyConsistency(newer *SignedTreeHead, p *ConsistencyProof) error {
+	if p.OldSize != sth.TreeSize || p.NewSize != newer.TreeSize {
+		return fmt.Errorf("%w: proof is for sizes %d and %d, tree heads for %d and %d",
+			ErrInvalidProof, p.OldSize, p.NewSize, sth.TreeSize, newer.TreeSize)
+	}
+	return VerifyConsistency(sth.RootHash(), newer.RootHash(), p)
+}
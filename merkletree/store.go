@@ -0,0 +1,161 @@
+package merkletree
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// ErrNodeNotFound is returned by a NodeStore for a position that was never written.
+var ErrNodeNotFound = errors.New("merkletree: node not found")
+
+// NodeStore keeps node digests keyed by their position in the tree.
+// Positions are assigned in post-order, so a tree is written sequentially
+// from position 0 while it is being built and the root is written last.
+type NodeStore interface {
+	Get(pos uint64) ([]byte, error)
+	Put(pos uint64, digest []byte) error
+}
+
+// MemoryStore is a NodeStore holding all digests in memory.
+type MemoryStore struct {
+	nodes [][]byte
+}
+
+// NewMemoryStore returns an empty in-memory node store.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{}
+}
+
+// Get returns the digest stored at 'pos'.
+func (s *MemoryStore) Get(pos uint64) ([]byte, error) {
+	if pos >= uint64(len(s.nodes)) || s.nodes[pos] == nil {
+		return nil, ErrNodeNotFound
+	}
+	return s.nodes[pos], nil
+}
+
+// Put stores 'digest' at 'pos', replacing any previous digest.
+func (s *MemoryStore) Put(pos uint64, digest []byte) error {
+	for uint64(len(s.nodes)) <= pos {
+		s.nodes = append(s.nodes, nil)
+	}
+	s.nodes[pos] = append([]byte(nil), digest...)
+	return nil
+}
+
+// FileStore is an append-only NodeStore backed by a file.
+// Every Put appends a record holding the position and the digest; a position
+// written more than once resolves to its latest record. Only positions whose
+// latest record is not at the slot matching their position are indexed in
+// memory, which for trees built once is none of them.
+type FileStore struct {
+	f          *os.File
+	digestSize int
+	records    uint64
+	moved      map[uint64]uint64
+}
+
+// OpenFileStore opens or creates the file store at 'path' for digests of 'digestSize' bytes.
+// Records already in the file are scanned so a store survives being reopened,
+// even after a crash halfway through a Put.
+func OpenFileStore(path string, digestSize int) (*FileStore, error) {
+	if digestSize <= 0 {
+		return nil, fmt.Errorf("merkletree: invalid digest size %d", digestSize)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	s := &FileStore{f: f, digestSize: digestSize, moved: map[uint64]uint64{}}
+	if err := s.scan(); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileStore) recordSize() int64 {
+	return int64(8 + s.digestSize)
+}
+
+func (s *FileStore) scan() error {
+	info, err := s.f.Stat()
+	if err != nil {
+		return err
+	}
+	s.records = uint64(info.Size() / s.recordSize())
+	// a final record that was only partly written is dropped
+	if whole := int64(s.records) * s.recordSize(); whole < info.Size() {
+		if err := s.f.Truncate(whole); err != nil {
+			return err
+		}
+	}
+
+	r := bufio.NewReader(io.NewSectionReader(s.f, 0, info.Size()))
+	record := make([]byte, s.recordSize())
+	for slot := uint64(0); slot < s.records; slot++ {
+		if _, err := io.ReadFull(r, record); err != nil {
+			return err
+		}
+		s.index(binary.BigEndian.Uint64(record), slot)
+	}
+	return nil
+}
+
+func (s *FileStore) index(pos, slot uint64) {
+	if pos == slot {
+		delete(s.moved, pos)
+		return
+	}
+	s.moved[pos] = slot
+}
+
+// Get returns the latest digest written at 'pos'.
+func (s *FileStore) Get(pos uint64) ([]byte, error) {
+	slot, ok := s.moved[pos]
+	if !ok {
+		slot = pos
+	}
+	if slot >= s.records {
+		return nil, ErrNodeNotFound
+	}
+	record := make([]byte, s.recordSize())
+	if _, err := s.f.ReadAt(record, int64(slot)*s.recordSize()); err != nil {
+		return nil, err
+	}
+	// the slot may belong to another position if 'pos' was never written
+	if binary.BigEndian.Uint64(record) != pos {
+		return nil, ErrNodeNotFound
+	}
+	return record[8:], nil
+}
+
+// Put appends a record for 'digest' at 'pos'.
+func (s *FileStore) Put(pos uint64, digest []byte) error {
+	if len(digest) != s.digestSize {
+		return fmt.Errorf("merkletree: file store holds %d byte digests, got %d", s.digestSize, len(digest))
+	}
+	record := make([]byte, s.recordSize())
+	binary.BigEndian.PutUint64(record, pos)
+	copy(record[8:], digest)
+	if _, err := s.f.WriteAt(record, int64(s.records)*s.recordSize()); err != nil {
+		return err
+	}
+	s.index(pos, s.records)
+	s.records++
+	return nil
+}
+
+// Sync commits the store to stable storage.
+func (s *FileStore) Sync() error {
+	return s.f.Sync()
+}
+
+// Close closes the underlying file.
+func (s *FileStore) Close() error {
+	return s.f.Close()
+}
@@ -0,0 +1,82 @@
+#!/usr/bin/env python3
+# Regenerates the dm-verity vectors with libcryptsetup, the library behind
+# veritysetup. Each image holds byte i = i % 251; only the hash devices and
+# root hashes are kept. Run from this directory.
+import ctypes, json, os, tempfile
+
+lib = ctypes.CDLL("libcryptsetup.so.12")
+
+CRYPT_VERITY_NO_HEADER = 1 << 0
+CRYPT_VERITY_CREATE_HASH = 1 << 2
+
+
+class Params(ctypes.Structure):
+    _fields_ = [
+        ("hash_name", ctypes.c_char_p),
+        ("data_device", ctypes.c_char_p),
+        ("hash_device", ctypes.c_char_p),
+        ("fec_device", ctypes.c_char_p),
+        ("salt", ctypes.c_char_p),
+        ("salt_size", ctypes.c_uint32),
+        ("hash_type", ctypes.c_uint32),
+        ("data_block_size", ctypes.c_uint32),
+        ("hash_block_size", ctypes.c_uint32),
+        ("data_size", ctypes.c_uint64),
+        ("hash_area_offset", ctypes.c_uint64),
+        ("fec_area_offset", ctypes.c_uint64),
+        ("fec_roots", ctypes.c_uint32),
+        ("flags", ctypes.c_uint32),
+    ]
+
+
+UUID = "12345678-1234-1234-1234-123456789abc"
+SALT = "e48da609055204e89ae53b655ca2216dd983cf3cb829f34f63a297d106d53e2d"
+
+VECTORS = [
+    # name, data size, data block, hash block, salt, algorithm, superblock
+    ("sha256-4k", 65536, 4096, 4096, SALT, "sha256", True),
+    ("sha256-512-three-levels", 262144, 512, 512, "", "sha256", True),
+    ("sha256-single-block", 4096, 4096, 4096, SALT, "sha256", True),
+    ("sha1-no-superblock", 131072, 1024, 1024, "00ff", "sha1", False),
+    ("sha512-mixed-blocks", 524288, 4096, 1024, SALT, "sha512", True),
+]
+
+
+def generate(name, size, data_block, hash_block, salt, algorithm, superblock):
+    with tempfile.TemporaryDirectory() as tmp:
+        image = os.path.join(tmp, "data.img")
+        with open(image, "wb") as f:
+            f.write(bytes(i % 251 for i in range(size)))
+        hash_path = name + ".hash"
+        open(hash_path, "wb").close()
+
+        cd = ctypes.c_void_p()
+        assert lib.crypt_init(ctypes.byref(cd), hash_path.encode()) == 0
+        salt_bytes = bytes.fromhex(salt)
+        flags = CRYPT_VERITY_CREATE_HASH | (0 if superblock else CRYPT_VERITY_NO_HEADER)
+        params = Params(algorithm.encode(), image.encode(), None, None, salt_bytes, len(salt_bytes),
+                        1, data_block, hash_block, size // data_block, 0, 0, 0, flags)
+        assert lib.crypt_format(cd, b"VERITY", None, None, UUID.encode(), None, 0, ctypes.byref(params)) == 0
+        root = ctypes.create_string_buffer(64)
+        root_size = ctypes.c_size_t(64)
+        assert lib.crypt_volume_key_get(cd, -1, root, ctypes.byref(root_size), None, 0) == 0
+        lib.crypt_free(cd)
+
+    return {
+        "name": name,
+        "dataSize": size,
+        "dataBlockSize": data_block,
+        "hashBlockSize": hash_block,
+        "salt": salt,
+        "algorithm": algorithm,
+        "superblock": superblock,
+        "uuid": UUID,
+        "root": root.raw[: root_size.value].hex(),
+    }
+
+
+if __name__ == "__main__":
+    vectors = [generate(*v) for v in VECTORS]
+    with open("vectors.json", "w") as f:
+        json.dump(vectors, f, indent=2)
+        f.write("\n")
@@ -0,0 +1,69 @@
+#!/usr/bin/env python3
+# Regenerates the fs-verity vectors with fsverity-utils 1.5 or later. Run
+# from this directory. Every vector is the output of
+#
+#   fsverity digest FILE --hash-alg=ALG --block-size=N [--salt=HEX] \
+#       --compact --out-merkle-tree=TREE --out-descriptor=DESCRIPTOR
+#
+# over a file holding byte i = i % 251: the printed file digest, the root hash
+# read from the fs-verity descriptor it writes, and the SHA-256 of the Merkle
+# tree it writes. Nothing is computed here but the SHA-256 of the tree.
+#
+# Each vector records its "source". Only the empty file vector was produced
+# by fsverity-utils so far; the others are still the libcryptsetup trees of
+# the previous generator, which assumed an fs-verity tree to be a dm-verity
+# version 1 tree without superblock. Rerunning this script on a machine with
+# fsverity-utils replaces them all.
+import hashlib, json, os, subprocess, tempfile
+
+SOURCE = "fsverity digest"
+
+VECTORS = [
+    # name, file size, algorithm, block size, salt
+    ("empty", 0, "sha256", 4096, ""),
+    ("one-byte", 1, "sha256", 4096, ""),
+    ("one-block", 4096, "sha256", 4096, ""),
+    ("block-and-a-byte", 4097, "sha256", 4096, ""),
+    ("two-levels", 1000000, "sha256", 4096, ""),
+    ("salted", 1000000, "sha256", 4096, "0102030405060708"),
+    ("sha512-three-levels", 1000000, "sha512", 1024, "deadbeef"),
+    ("sha512-long-salt", 65536, "sha512", 4096, "00" * 32),
+]
+
+
+def generate(name, size, algorithm, block_size, salt):
+    with tempfile.TemporaryDirectory() as tmp:
+        path = os.path.join(tmp, "file")
+        with open(path, "wb") as f:
+            f.write(bytes(i % 251 for i in range(size)))
+        tree_path = os.path.join(tmp, "tree")
+        descriptor_path = os.path.join(tmp, "descriptor")
+        cmd = ["fsverity", "digest", path, "--hash-alg=" + algorithm, "--block-size=%d" % block_size,
+               "--compact", "--out-merkle-tree=" + tree_path, "--out-descriptor=" + descriptor_path]
+        if salt:
+            cmd.append("--salt=" + salt)
+        digest = subprocess.run(cmd, check=True, capture_output=True, text=True).stdout.strip()
+        with open(tree_path, "rb") as f:
+            merkle_tree = f.read()
+        with open(descriptor_path, "rb") as f:
+            descriptor = f.read()
+    # struct fsverity_descriptor: the root hash follows 16 bytes of header
+    root = descriptor[16 : 16 + hashlib.new(algorithm).digest_size]
+    return {
+        "name": name,
+        "source": SOURCE,
+        "size": size,
+        "algorithm": algorithm,
+        "blockSize": block_size,
+        "salt": salt,
+        "root": root.hex(),
+        "digest": digest,
+        "treeSHA256": hashlib.sha256(merkle_tree).hexdigest(),
+    }
+
+
+if __name__ == "__main__":
+    vectors = [generate(*v) for v in VECTORS]
+    with open("vectors.json", "w") as f:
+        json.dump(vectors, f, indent=2)
+        f.write("\n")
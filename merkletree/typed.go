@@ -0,0 +1,111 @@
+package merkletree
+
+import (
+	"encoding"
+	"fmt"
+	"sync"
+)
+
+// Encoder returns the bytes a value is hashed as. Equal values must encode
+// to equal bytes for proofs to verify.
+type Encoder[T any] func(T) ([]byte, error)
+
+// BinaryEncoder encodes values with their MarshalBinary method.
+func BinaryEncoder[T encoding.BinaryMarshaler]() Encoder[T] {
+	return func(v T) ([]byte, error) {
+		return v.MarshalBinary()
+	}
+}
+
+// FuncEncoder encodes values with 'f', which cannot fail.
+func FuncEncoder[T any](f func(T) []byte) Encoder[T] {
+	return func(v T) ([]byte, error) {
+		return f(v), nil
+	}
+}
+
+// TypedTree is a record tree over Go values, one leaf per value hashed as its encoding.
+// Its Update takes a value, so the values and the leaves cannot drift apart.
+type TypedTree[T any] struct {
+	*MerkleTree
+	// mu guards values, keeping each in step with its leaf.
+	mu     sync.RWMutex
+	values []T
+	encode Encoder[T]
+}
+
+// TypedProof is an inclusion proof carrying the value it proves.
+type TypedProof[T any] struct {
+	Value T      `json:"value"`
+	Proof *Proof `json:"proof"`
+}
+
+// NewTypedTree returns new tree over 'values' encoded with 'encode'.
+// cfg.SegmentSize is ignored.
+func NewTypedTree[T any](values []T, encode Encoder[T], cfg Config) (*TypedTree[T], error) {
+	records := make([][]byte, len(values))
+	for i, v := range values {
+		record, err := encode(v)
+		if err != nil {
+			return nil, fmt.Errorf("merkletree: encoding value %d: %w", i, err)
+		}
+		records[i] = record
+	}
+	mt, err := NewMerkleTreeFromRecords(records, cfg)
+	if err != nil {
+		return nil, err
+	}
+	// copied so that the caller changing its slice cannot change a proof's value
+	values = append([]T(nil), values...)
+	return &TypedTree[T]{MerkleTree: mt, values: values, encode: encode}, nil
+}
+
+// Value returns the value at 'index'.
+func (tt *TypedTree[T]) Value(index uint64) (T, error) {
+	tt.mu.RLock()
+	defer tt.mu.RUnlock()
+	if index >= uint64(len(tt.values)) {
+		var zero T
+		return zero, ErrLeafOutOfRange
+	}
+	return tt.values[index], nil
+}
+
+// Proof returns the proof of the value at 'index'.
+func (tt *TypedTree[T]) Proof(index uint64) (*TypedProof[T], error) {
+	tt.mu.RLock()
+	defer tt.mu.RUnlock()
+	p, err := tt.MerkleTree.Proof(index)
+	if err != nil {
+		return nil, err
+	}
+	return &TypedProof[T]{Value: tt.values[index], Proof: p}, nil
+}
+
+// Update replaces the value at 'index', hashing its encoding as the new leaf.
+// It hides MerkleTree.Update, which would leave the old value in proofs.
+func (tt *TypedTree[T]) Update(index uint64, v T) error {
+	record, err := tt.encode(v)
+	if err != nil {
+		return fmt.Errorf("merkletree: encoding value %d: %w", index, err)
+	}
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	if err := tt.MerkleTree.Update(index, record); err != nil {
+		return err
+	}
+	tt.values[index] = v
+	return nil
+}
+
+// Verify checks that the proof's value, encoded with 'encode', is in the tree described by 'm'.
+func (p *TypedProof[T]) Verify(m Metadata, encode Encoder[T]) error {
+	if p.Proof == nil {
+		return fmt.Errorf("%w: missing proof", ErrInvalidProof)
+	}
+	record, err := encode(p.Value)
+	if err != nil {
+		return err
+	}
+	return m.VerifyProof(record, p.Proof)
+}
@@ -0,0 +1,107 @@
+package merkletree
+
+import "fmt"
+
+// Update replaces the leaf at 'index' and rehashes the path from it to the
+// root, writing the new digests to the store. For a byte tree 'leaf' is the
+// new segment, which must keep the leaf's length, and the tree's reader is
+// left untouched; for a record tree it is the new record, and for a tree
+// built from leaf hashes the new leaf digest.
+//
+// Every update makes a new version; the one it replaces stays readable
+// through At until pruned.
+func (mt *MerkleTree) Update(index uint64, leaf []byte) (err error) {
+	s := startSpan(OpUpdate, mt.leaves())
+	defer func() { s.end(mt.observer, err) }()
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	pos, start, end, steps, err := mt.leafPath(index)
+	if err != nil {
+		return err
+	}
+	h := s.hasher(mt.hasher)
+
+	var digest []byte
+	switch {
+	case mt.leafHashes != nil:
+		if size := mt.newHash().Size(); len(leaf) != size {
+			return fmt.Errorf("merkletree: leaf hash has %d bytes, want %d", len(leaf), size)
+		}
+		digest = append([]byte(nil), leaf...)
+	case mt.leafRecords != nil:
+		digest = h.hashLeaf(leaf)
+	default:
+		if uint64(len(leaf)) != end-start {
+			return fmt.Errorf("merkletree: leaf %d holds %d bytes, got %d", index, end-start, len(leaf))
+		}
+		digest = h.hashLeaf(leaf)
+	}
+
+	// hash the whole path before writing so a failed read leaves the tree as it was
+	nodes := make([][]byte, len(steps)+1)
+	nodes[len(steps)] = digest
+	for i := len(steps) - 1; i >= 0; i-- {
+		children := make([][]byte, len(steps[i].children))
+		for j, child := range steps[i].children {
+			if j == steps[i].index {
+				children[j] = digest
+				continue
+			}
+			var err error
+			if children[j], err = mt.store.Get(child); err != nil {
+				return err
+			}
+		}
+		digest = h.hashNode(children...)
+		nodes[i] = digest
+	}
+	// keep what the version being replaced held along the path
+	for _, p := range append(path(steps), pos) {
+		old, err := mt.store.Get(p)
+		if err != nil {
+			return err
+		}
+		mt.history.saveNode(mt.version, p, append([]byte(nil), old...))
+	}
+	switch {
+	case mt.leafHashes != nil:
+		mt.history.saveLeaf(mt.version, start, mt.leafHashes[start])
+	case mt.leafRecords != nil:
+		mt.history.saveLeaf(mt.version, start, mt.leafRecords[start])
+	default:
+		mt.history.saveLeaf(mt.version, start, mt.segments[start])
+	}
+
+	for i, step := range steps {
+		if err := mt.store.Put(step.parent, nodes[i]); err != nil {
+			return err
+		}
+	}
+	if err := mt.store.Put(pos, nodes[len(steps)]); err != nil {
+		return err
+	}
+
+	switch {
+	case mt.leafHashes != nil:
+		mt.leafHashes[start] = nodes[len(steps)]
+	case mt.leafRecords != nil:
+		mt.leafRecords[start] = append([]byte(nil), leaf...)
+	default:
+		if mt.segments == nil {
+			mt.segments = map[uint64][]byte{}
+		}
+		mt.segments[start] = append([]byte(nil), leaf...)
+	}
+	mt.root = nodes[0]
+	mt.version++
+	return nil
+}
+
+// path returns the positions of the nodes whose children are the steps' siblings.
+func path(steps []pathStep) []uint64 {
+	positions := make([]uint64, len(steps))
+	for i, step := range steps {
+		positions[i] = step.parent
+	}
+	return positions
+}
@@ -0,0 +1,369 @@
+package merkletree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+const (
+	veritySuperblockSize = 512
+	verityMaxSaltSize    = 256
+	verityMaxLevels      = 63
+	// verityHashType is the hash format written to the superblock, 1 being
+	// the normal format where the salt is prepended to every hashed block.
+	verityHashType = 1
+)
+
+var veritySignature = [8]byte{'v', 'e', 'r', 'i', 't', 'y'}
+
+var (
+	// ErrVerityMismatch is returned when a dm-verity hash block does not match the data.
+	ErrVerityMismatch = errors.New("merkletree: dm-verity hash tree mismatch")
+	// ErrVerityRootMismatch is returned when a dm-verity root hash does not match the hash tree.
+	ErrVerityRootMismatch = errors.New("merkletree: dm-verity root hash mismatch")
+)
+
+// VerityDevice is the device a dm-verity or fs-verity hash tree is written to and read from.
+type VerityDevice interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+// VerityParams describes a dm-verity hash tree in the version 1 format
+// produced by veritysetup.
+type VerityParams struct {
+	// Algorithm is a registered hash name, "sha256" when empty.
+	Algorithm string
+	// DataBlockSize and HashBlockSize are 4096 when zero.
+	DataBlockSize uint32
+	HashBlockSize uint32
+	Salt          []byte
+	// NoSuperblock leaves out the superblock, like veritysetup --no-superblock.
+	NoSuperblock bool
+	// UUID is recorded in the superblock.
+	UUID [16]byte
+}
+
+// verity is a dm-verity style hash tree: blocks are hashed with a salt
+// prefix, digests are packed into hash blocks and levels are stored from the
+// top of the tree down. It backs both dm-verity and fs-verity.
+type verity struct {
+	hasher
+	salt          []byte
+	dataSize      int64
+	dataBlockSize uint32
+	hashBlockSize uint32
+	dataBlocks    uint64
+	// entrySize is the space a digest takes in a hash block.
+	entrySize    int
+	hashPerBlock uint64
+	levels       int
+	// levelBlock[i] is the first hash block of level i, level 0 hashing the data.
+	levelBlock []uint64
+	levelSize  []uint64
+}
+
+// newVerityTree lays out the hash tree over 'dataSize' bytes with the tree starting at hash block 'start'.
+// The last data block is zero padded when 'dataSize' is not a multiple of the data block size.
+func newVerityTree(h hasher, dataSize int64, dataBlockSize, hashBlockSize uint32, entrySize int, salt []byte, start uint64) (*verity, error) {
+	v := &verity{
+		hasher:        h,
+		salt:          salt,
+		dataSize:      dataSize,
+		dataBlockSize: dataBlockSize,
+		hashBlockSize: hashBlockSize,
+		dataBlocks:    (uint64(dataSize) + uint64(dataBlockSize) - 1) / uint64(dataBlockSize),
+		entrySize:     entrySize,
+	}
+	perBlockBits := bits.Len64(uint64(hashBlockSize)/uint64(entrySize)) - 1
+	if perBlockBits <= 0 {
+		return nil, fmt.Errorf("merkletree: hash block of %d bytes too small", hashBlockSize)
+	}
+	v.hashPerBlock = 1 << perBlockBits
+
+	for v.levels*perBlockBits < 64 && (v.dataBlocks-1)>>(v.levels*perBlockBits) != 0 {
+		v.levels++
+	}
+	if v.levels > verityMaxLevels {
+		return nil, fmt.Errorf("merkletree: hash tree too deep")
+	}
+
+	// levels are laid out from the top of the tree down
+	pos := start
+	v.levelBlock = make([]uint64, v.levels)
+	v.levelSize = make([]uint64, v.levels)
+	for i := v.levels - 1; i >= 0; i-- {
+		shift := uint((i + 1) * perBlockBits)
+		v.levelBlock[i] = pos
+		if shift >= 64 {
+			v.levelSize[i] = 1
+		} else {
+			v.levelSize[i] = (v.dataBlocks + (1 << shift) - 1) >> shift
+		}
+		pos += v.levelSize[i]
+	}
+	return v, nil
+}
+
+// dmVerity is a dm-verity tree together with its parameters.
+type dmVerity struct {
+	*verity
+	VerityParams
+}
+
+func newDMVerity(p VerityParams, dataSize int64) (*dmVerity, error) {
+	if p.Algorithm == "" {
+		p.Algorithm = "sha256"
+	}
+	if p.DataBlockSize == 0 {
+		p.DataBlockSize = 4096
+	}
+	if p.HashBlockSize == 0 {
+		p.HashBlockSize = 4096
+	}
+	for _, size := range []uint32{p.DataBlockSize, p.HashBlockSize} {
+		if size < 512 || size&(size-1) != 0 {
+			return nil, fmt.Errorf("merkletree: dm-verity block size %d is not a power of two of at least 512", size)
+		}
+	}
+	if len(p.Salt) > verityMaxSaltSize {
+		return nil, fmt.Errorf("merkletree: dm-verity salt longer than %d bytes", verityMaxSaltSize)
+	}
+	if dataSize <= 0 || dataSize%int64(p.DataBlockSize) != 0 {
+		return nil, fmt.Errorf("merkletree: data size %d is not a positive multiple of the %d byte data block", dataSize, p.DataBlockSize)
+	}
+	hashfn, err := LookupHash(p.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	// the version 1 format pads every digest to a power of two
+	digestSize := hashfn().Size()
+	entrySize := 1 << bits.Len(uint(digestSize-1))
+	v, err := newVerityTree(hasher{newHash: hashfn}, dataSize, p.DataBlockSize, p.HashBlockSize, entrySize, p.Salt, p.hashStart())
+	if err != nil {
+		return nil, err
+	}
+	return &dmVerity{verity: v, VerityParams: p}, nil
+}
+
+// hashStart returns the hash block the tree starts at, after the superblock if any.
+func (p VerityParams) hashStart() uint64 {
+	if p.NoSuperblock {
+		return 0
+	}
+	return (veritySuperblockSize + uint64(p.HashBlockSize) - 1) / uint64(p.HashBlockSize)
+}
+
+// hashBlock returns the salted digest of a data or hash block.
+func (v *verity) hashBlock(block []byte) []byte {
+	d := v.newHash()
+	_, _ = d.Write(v.salt)
+	_, _ = d.Write(block)
+	return d.Sum(nil)
+}
+
+// hashLevel hashes 'blocks' blocks of 'blockSize' bytes read from 'src' at
+// 'srcBlock' into hash blocks at 'dstBlock' of 'dst', writing them or, when
+// 'verify' is set, comparing them with what is already there.
+func (v *verity) hashLevel(src io.ReaderAt, srcBlock uint64, blockSize uint32, blocks uint64, dst VerityDevice, dstBlock uint64, level int, verify bool) error {
+	in := make([]byte, blockSize)
+	out := make([]byte, v.hashBlockSize)
+	stored := make([]byte, v.hashBlockSize)
+	flush := func(block uint64) error {
+		off := int64(dstBlock+block) * int64(v.hashBlockSize)
+		if !verify {
+			_, err := dst.WriteAt(out, off)
+			return err
+		}
+		if _, err := dst.ReadAt(stored, off); err != nil {
+			return err
+		}
+		if !bytes.Equal(stored, out) {
+			return fmt.Errorf("%w: level %d hash block %d", ErrVerityMismatch, level, block)
+		}
+		return nil
+	}
+
+	for i := uint64(0); i < blocks; i++ {
+		if err := v.readBlock(src, in, int64(srcBlock+i)*int64(blockSize), level == 0); err != nil {
+			return err
+		}
+		entry := i % v.hashPerBlock
+		if entry == 0 {
+			clear(out)
+		}
+		copy(out[entry*uint64(v.entrySize):], v.hashBlock(in))
+		if entry == v.hashPerBlock-1 || i == blocks-1 {
+			if err := flush(i / v.hashPerBlock); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readBlock reads the block at 'off', zero padding the last data block.
+func (v *verity) readBlock(src io.ReaderAt, block []byte, off int64, data bool) error {
+	want := len(block)
+	if data && off+int64(want) > v.dataSize {
+		want = int(v.dataSize - off)
+	}
+	n, err := src.ReadAt(block[:want], off)
+	if n < want {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	clear(block[want:])
+	return nil
+}
+
+// createOrVerify builds every level of the tree and returns the root hash.
+func (v *verity) createOrVerify(data io.ReaderAt, hashDev VerityDevice, verify bool) ([]byte, error) {
+	for i := 0; i < v.levels; i++ {
+		var err error
+		if i == 0 {
+			err = v.hashLevel(data, 0, v.dataBlockSize, v.dataBlocks, hashDev, v.levelBlock[0], 0, verify)
+		} else {
+			err = v.hashLevel(hashDev, v.levelBlock[i-1], v.hashBlockSize, v.levelSize[i-1], hashDev, v.levelBlock[i], i, verify)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// the root hashes the single top hash block, or the only data block
+	var top []byte
+	var err error
+	if v.levels == 0 {
+		top = make([]byte, v.dataBlockSize)
+		err = v.readBlock(data, top, 0, true)
+	} else {
+		top = make([]byte, v.hashBlockSize)
+		_, err = hashDev.ReadAt(top, int64(v.levelBlock[v.levels-1])*int64(v.hashBlockSize))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return v.hashBlock(top), nil
+}
+
+func (v *dmVerity) superblock() []byte {
+	sb := make([]byte, veritySuperblockSize)
+	copy(sb[0:8], veritySignature[:])
+	binary.LittleEndian.PutUint32(sb[8:], 1)
+	binary.LittleEndian.PutUint32(sb[12:], verityHashType)
+	copy(sb[16:32], v.UUID[:])
+	copy(sb[32:64], v.Algorithm)
+	binary.LittleEndian.PutUint32(sb[64:], v.DataBlockSize)
+	binary.LittleEndian.PutUint32(sb[68:], v.HashBlockSize)
+	binary.LittleEndian.PutUint64(sb[72:], v.dataBlocks)
+	binary.LittleEndian.PutUint16(sb[80:], uint16(len(v.Salt)))
+	copy(sb[88:], v.Salt)
+	return sb
+}
+
+// VerityFormat writes the dm-verity hash tree of the first 'dataSize' bytes of
+// 'data' to 'hashDev', laid out exactly as veritysetup format does, and
+// returns the root hash.
+func VerityFormat(data io.ReaderAt, dataSize int64, hashDev VerityDevice, p VerityParams) ([]byte, error) {
+	v, err := newDMVerity(p, dataSize)
+	if err != nil {
+		return nil, err
+	}
+	if !v.NoSuperblock {
+		// the superblock is padded to a full hash block
+		sb := make([]byte, v.hashStart()*uint64(v.HashBlockSize))
+		copy(sb, v.superblock())
+		if _, err := hashDev.WriteAt(sb, 0); err != nil {
+			return nil, err
+		}
+	}
+	return v.createOrVerify(data, hashDev, false)
+}
+
+// VerityVerify checks 'data' against the dm-verity hash tree in 'hashDev' and
+// the trusted 'root', like veritysetup verify.
+func VerityVerify(data io.ReaderAt, dataSize int64, hashDev VerityDevice, root []byte, p VerityParams) error {
+	v, err := newDMVerity(p, dataSize)
+	if err != nil {
+		return err
+	}
+	if !v.NoSuperblock {
+		sb := make([]byte, veritySuperblockSize)
+		if _, err := hashDev.ReadAt(sb, 0); err != nil {
+			return err
+		}
+		if !bytes.Equal(sb, v.superblock()) {
+			return fmt.Errorf("%w: superblock does not match parameters", ErrVerityMismatch)
+		}
+	}
+	computed, err := v.createOrVerify(data, hashDev, true)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(computed, root) {
+		return ErrVerityRootMismatch
+	}
+	return nil
+}
+
+// ReadVeritySuperblock returns the parameters and data size recorded in the
+// superblock at the start of a dm-verity hash device.
+func ReadVeritySuperblock(hashDev io.ReaderAt) (VerityParams, int64, error) {
+	sb := make([]byte, veritySuperblockSize)
+	if _, err := hashDev.ReadAt(sb, 0); err != nil {
+		return VerityParams{}, 0, err
+	}
+	if !bytes.Equal(sb[0:8], veritySignature[:]) {
+		return VerityParams{}, 0, fmt.Errorf("%w: no superblock", ErrVerityMismatch)
+	}
+	if version, hashType := binary.LittleEndian.Uint32(sb[8:]), binary.LittleEndian.Uint32(sb[12:]); version != 1 || hashType != verityHashType {
+		return VerityParams{}, 0, fmt.Errorf("merkletree: unsupported dm-verity superblock version %d hash type %d", version, hashType)
+	}
+	saltSize := binary.LittleEndian.Uint16(sb[80:])
+	if saltSize > verityMaxSaltSize {
+		return VerityParams{}, 0, fmt.Errorf("%w: salt size %d", ErrVerityMismatch, saltSize)
+	}
+	p := VerityParams{
+		Algorithm:     string(bytes.TrimRight(sb[32:64], "\x00")),
+		DataBlockSize: binary.LittleEndian.Uint32(sb[64:]),
+		HashBlockSize: binary.LittleEndian.Uint32(sb[68:]),
+		Salt:          append([]byte(nil), sb[88:88+saltSize]...),
+	}
+	copy(p.UUID[:], sb[16:32])
+	dataBlocks := binary.LittleEndian.Uint64(sb[72:])
+	if dataBlocks > 1<<62/uint64(max(p.DataBlockSize, 1)) {
+		return VerityParams{}, 0, fmt.Errorf("%w: %d data blocks", ErrVerityMismatch, dataBlocks)
+	}
+	return p, int64(dataBlocks) * int64(p.DataBlockSize), nil
+}
+
+// memoryDevice is a VerityDevice held in memory.
+type memoryDevice struct {
+	b []byte
+}
+
+func (m *memoryDevice) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(m.b)) {
+		return 0, io.EOF
+	}
+	n := copy(p, m.b[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (m *memoryDevice) WriteAt(p []byte, off int64) (int, error) {
+	if end := off + int64(len(p)); end > int64(len(m.b)) {
+		m.b = append(m.b, make([]byte, end-int64(len(m.b)))...)
+	}
+	return copy(m.b[off:], p), nil
+}
@@ -0,0 +1,247 @@
+package merkletree
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+var (
+	// ErrUnknownVersion is returned for versions that were pruned or do not exist yet.
+	ErrUnknownVersion = errors.New("merkletree: unknown version")
+	// ErrReadOnly is returned when writing to a snapshot.
+	ErrReadOnly = errors.New("merkletree: snapshot is read-only")
+)
+
+// history keeps what updates overwrote so that retained versions stay
+// readable. The store and the leaves always hold the current version; an
+// older version shares every node and leaf no update has touched since.
+type history struct {
+	// oldest is the oldest retained version.
+	oldest uint64
+	nodes  map[uint64][]revision
+	leaves map[uint64][]revision
+}
+
+// revision is a value a node or leaf held up to and including 'version'.
+// A nil leaf value of a byte tree means the leaf was read from the data.
+type revision struct {
+	version uint64
+	value   []byte
+}
+
+func (h *history) saveNode(version, pos uint64, digest []byte) {
+	if h.nodes == nil {
+		h.nodes = map[uint64][]revision{}
+	}
+	h.nodes[pos] = append(h.nodes[pos], revision{version: version, value: digest})
+}
+
+func (h *history) saveLeaf(version uint64, start uint64, leaf []byte) {
+	if h.leaves == nil {
+		h.leaves = map[uint64][]revision{}
+	}
+	h.leaves[start] = append(h.leaves[start], revision{version: version, value: leaf})
+}
+
+// at returns the value 'revisions' held at 'version', if it has changed since.
+func at(revisions []revision, version uint64) ([]byte, bool) {
+	i := sort.Search(len(revisions), func(i int) bool { return revisions[i].version >= version })
+	if i == len(revisions) {
+		return nil, false
+	}
+	return revisions[i].value, true
+}
+
+// prune drops the revisions of versions before 'oldest'.
+func (h *history) prune(oldest uint64) {
+	h.oldest = oldest
+	for pos, revisions := range h.nodes {
+		if revisions = dropBefore(revisions, oldest); len(revisions) == 0 {
+			delete(h.nodes, pos)
+		} else {
+			h.nodes[pos] = revisions
+		}
+	}
+	for start, revisions := range h.leaves {
+		if revisions = dropBefore(revisions, oldest); len(revisions) == 0 {
+			delete(h.leaves, start)
+		} else {
+			h.leaves[start] = revisions
+		}
+	}
+}
+
+func dropBefore(revisions []revision, version uint64) []revision {
+	i := sort.Search(len(revisions), func(i int) bool { return revisions[i].version >= version })
+	// copied so the dropped values can be collected
+	return append([]revision(nil), revisions[i:]...)
+}
+
+// versionView is a NodeStore reading the nodes of a retained version.
+// The tree's lock must be held while reading.
+type versionView struct {
+	mt      *MerkleTree
+	version uint64
+}
+
+func (v versionView) Get(pos uint64) ([]byte, error) {
+	if digest, ok := at(v.mt.history.nodes[pos], v.version); ok {
+		return digest, nil
+	}
+	return v.mt.store.Get(pos)
+}
+
+func (v versionView) Put(uint64, []byte) error {
+	return ErrReadOnly
+}
+
+// Version returns the tree's current version, zero when built and one more after every Update.
+func (mt *MerkleTree) Version() uint64 {
+	mt.mu.RLock()
+	defer mt.mu.RUnlock()
+	return mt.version
+}
+
+// Snapshot returns a read-only view of the current version, which later updates leave unchanged.
+func (mt *MerkleTree) Snapshot() *Snapshot {
+	mt.mu.RLock()
+	defer mt.mu.RUnlock()
+	return &Snapshot{mt: mt, version: mt.version, root: mt.root}
+}
+
+// At returns a read-only view of 'version', which must not have been pruned.
+func (mt *MerkleTree) At(version uint64) (*Snapshot, error) {
+	mt.mu.RLock()
+	defer mt.mu.RUnlock()
+	if err := mt.checkVersion(version); err != nil {
+		return nil, err
+	}
+	root, err := versionView{mt, version}.Get(mt.rootPos())
+	if err != nil {
+		return nil, err
+	}
+	return &Snapshot{mt: mt, version: version, root: root}, nil
+}
+
+// Prune releases every version before 'version', so the tree only keeps
+// what updates overwrote since. Snapshots of pruned versions fail with ErrUnknownVersion.
+func (mt *MerkleTree) Prune(version uint64) error {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	if version > mt.version {
+		return fmt.Errorf("%w: cannot prune up to %d, tree is at %d", ErrUnknownVersion, version, mt.version)
+	}
+	if version > mt.history.oldest {
+		mt.history.prune(version)
+	}
+	return nil
+}
+
+func (mt *MerkleTree) checkVersion(version uint64) error {
+	switch {
+	case version < mt.history.oldest:
+		return fmt.Errorf("%w: version %d was pruned", ErrUnknownVersion, version)
+	case version > mt.version:
+		return fmt.Errorf("%w: version %d is newer than %d", ErrUnknownVersion, version, mt.version)
+	}
+	return nil
+}
+
+// Snapshot is a read-only version of a MerkleTree.
+type Snapshot struct {
+	mt      *MerkleTree
+	version uint64
+	root    []byte
+}
+
+// Version returns the version the snapshot reads.
+func (s *Snapshot) Version() uint64 {
+	return s.version
+}
+
+// GetRootHash returns the root hash of the version.
+func (s *Snapshot) GetRootHash() []byte {
+	return append([]byte(nil), s.root...)
+}
+
+// Root returns the root hash of the version tagged with its hash algorithm.
+func (s *Snapshot) Root() Root {
+	return Root{Algorithm: s.mt.algorithm, Hash: s.GetRootHash()}
+}
+
+// Metadata returns the metadata of the version, against which its proofs verify.
+func (s *Snapshot) Metadata() Metadata {
+	m := s.mt.Metadata()
+	m.Root = s.GetRootHash()
+	return m
+}
+
+// Proof returns the inclusion proof of the leaf at 'index' in the version.
+func (s *Snapshot) Proof(index uint64) (_ *Proof, err error) {
+	sp := startSpan(OpProof, s.mt.leaves())
+	defer func() { sp.end(s.mt.observer, err) }()
+	nodes, unlock, err := s.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	return s.mt.proof(nodes, index)
+}
+
+// RangeProof returns the proof of the leaves in [start, end) in the version.
+func (s *Snapshot) RangeProof(start, end uint64) (_ *RangeProof, err error) {
+	sp := startSpan(OpProof, s.mt.leaves())
+	defer func() { sp.end(s.mt.observer, err) }()
+	nodes, unlock, err := s.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	return s.mt.rangeProof(nodes, start, end)
+}
+
+// LeafHashes returns the digests of all leaves of the version, from left to right.
+func (s *Snapshot) LeafHashes() ([][]byte, error) {
+	nodes, unlock, err := s.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	return s.mt.leafHashesFrom(nodes)
+}
+
+// Segment returns the bytes of the leaf at 'index' in the version.
+func (s *Snapshot) Segment(index uint64) ([]byte, error) {
+	_, start, end, _, err := s.mt.leafPath(index)
+	if err != nil {
+		return nil, err
+	}
+	_, unlock, err := s.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	buf := make([]byte, end-start)
+	if leaf, ok := at(s.mt.history.leaves[start], s.version); ok {
+		switch {
+		case s.mt.leafHashes != nil:
+			return nil, ErrNoLeafData
+		case leaf == nil && !s.mt.records:
+			return s.mt.readData(start, end, buf)
+		}
+		return append(buf[:0], leaf...), nil
+	}
+	return s.mt.readSegment(start, end, buf)
+}
+
+// lock read-locks the tree and returns the version's nodes along with the
+// function unlocking it, failing once the version is pruned.
+func (s *Snapshot) lock() (NodeStore, func(), error) {
+	s.mt.mu.RLock()
+	if err := s.mt.checkVersion(s.version); err != nil {
+		s.mt.mu.RUnlock()
+		return nil, nil, err
+	}
+	return versionView{s.mt, s.version}, s.mt.mu.RUnlock, nil
+}